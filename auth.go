@@ -24,11 +24,14 @@ package goauth
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 
 	log "github.com/sirupsen/logrus"
 
+	"net"
 	"net/http"
 	"time"
 
@@ -70,6 +73,10 @@ const (
 // A key is considered valid if currentTime <= ValidUntil. You can use
 // the helper functions KeyValid(now, ValidUntil) or KeyInvalid(now, ValidUntil),
 // or directly use these constraints directly in your database queries.
+//
+// LastActivity and MaxValidUntil are used by the SessionController to
+// implement idle and absolute timeouts, see SessionController.IdleTimeout and
+// SessionController.AbsoluteTimeout.
 type SessionKeyData struct {
 	// User is the user connected with a key.
 	User UserKeyType
@@ -79,14 +86,90 @@ type SessionKeyData struct {
 
 	// ValidUntil is the time until the key is considered valid.
 	ValidUntil time.Time
+
+	// LastActivity is the last time the key was used.
+	//
+	// New in version v0.6
+	LastActivity time.Time
+
+	// MaxValidUntil is the time after which the key is never valid, even if
+	// ValidUntil gets extended. The zero time means that there is no such limit.
+	//
+	// New in version v0.6
+	MaxValidUntil time.Time
+
+	// Metadata contains information about the client that created the
+	// session.
+	//
+	// New in version v0.6
+	Metadata SessionMetadata
+}
+
+// SessionMetadata contains information about the client that created a
+// session. It can be used to show users where they are logged in or to
+// investigate suspicious logins. All fields are optional.
+//
+// New in version v0.6
+type SessionMetadata struct {
+	// RemoteAddr is the IP address of the client.
+	RemoteAddr string
+
+	// UserAgent is the User-Agent header sent by the client.
+	UserAgent string
+
+	// DeviceName is a name for the device, for example chosen by the user.
+	DeviceName string
+
+	// LoginMethod describes how the user logged in, for example "password".
+	LoginMethod string
+}
+
+// MetadataFromRequest returns the metadata for a request: RemoteAddr (without
+// the port) and UserAgent are set.
+// Note that if your app runs behind a proxy RemoteAddr is the address of the
+// proxy. In this case you should set RemoteAddr from the header set by your
+// proxy (for example X-Forwarded-For), but only if you really trust it.
+//
+// New in version v0.6
+func MetadataFromRequest(r *http.Request) SessionMetadata {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return SessionMetadata{RemoteAddr: addr, UserAgent: r.UserAgent()}
+}
+
+// SessionEntry describes a session of a user, it is returned by
+// SessionLister.ListEntriesForUser.
+// ID is an opaque identifier of the session that can be used to delete the
+// session with DeleteEntryByID, it is created with SessionEntryID. This way
+// you can show the sessions of a user and let the user revoke them without
+// exposing the session keys.
+//
+// New in version v0.6
+type SessionEntry struct {
+	ID string
+	*SessionKeyData
+}
+
+// SessionEntryID returns the ID of a session given the key as it is stored
+// in the storage. It is the hex encoded SHA-256 hash of the key (with a
+// constant prefix).
+//
+// New in version v0.6
+func SessionEntryID(key string) string {
+	sum := sha256.Sum256([]byte("goauth-session-id:" + key))
+	return hex.EncodeToString(sum[:])
 }
 
 // NewSessionKeyData creates a new SessionKeyData instance with the given
 // values.
+// LastActivity is set to creationTime, MaxValidUntil is the zero time.
 // If you want to create a new SessionKeyData object to insert it somewhere
 // you should use CurrentTimeKeyData for consistent behaviour.
 func NewSessionKeyData(user UserKeyType, creationTime, validUntil time.Time) *SessionKeyData {
-	return &SessionKeyData{User: user, CreationTime: creationTime, ValidUntil: validUntil}
+	return &SessionKeyData{User: user, CreationTime: creationTime, ValidUntil: validUntil,
+		LastActivity: creationTime}
 }
 
 // CurrentTime returns the current type. For consistent behaviour you should
@@ -179,6 +262,198 @@ type SessionHandler interface {
 	DeleteKey(key string) error
 }
 
+// SessionHandlerContext is a SessionHandler that also provides variants of
+// all methods that accept a context.Context. The context should be passed on
+// to the underlying storage s.t. deadlines and cancellations of requests
+// reach the database.
+//
+// Handlers that implement this interface should implement the methods
+// without context by calling the context variant with context.Background().
+// Use AsSessionHandlerContext to use a SessionHandler that does not
+// implement this interface.
+// The optional interfaces SessionEntryUpdater, SessionLimiter and
+// SessionLister have context variants as well.
+//
+// New in version v0.6
+type SessionHandlerContext interface {
+	SessionHandler
+
+	// InitContext is Init with a context.
+	InitContext(ctx context.Context) error
+
+	// GetDataContext is GetData with a context.
+	GetDataContext(ctx context.Context, key string) (*SessionKeyData, error)
+
+	// CreateEntryContext is CreateEntry with a context.
+	CreateEntryContext(ctx context.Context, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error)
+
+	// DeleteEntriesForUserContext is DeleteEntriesForUser with a context.
+	DeleteEntriesForUserContext(ctx context.Context, user UserKeyType) (int64, error)
+
+	// DeleteInvalidKeysContext is DeleteInvalidKeys with a context.
+	DeleteInvalidKeysContext(ctx context.Context) (int64, error)
+
+	// DeleteKeyContext is DeleteKey with a context.
+	DeleteKeyContext(ctx context.Context, key string) error
+}
+
+// SessionEntryUpdater is an optional interface for a SessionHandler that
+// stores all fields of SessionKeyData and can update the timestamps of an
+// entry. The SessionController uses it to store the metadata of a session,
+// for pending sessions (see CreatePendingSession), sliding expiration (see
+// SessionController.RenewDuration) and to track the last activity (see
+// SessionController.IdleTimeout).
+//
+// If a handler does not implement this interface the SessionController falls
+// back to CreateEntry (the metadata is not stored and pending sessions can't
+// be created) and sessions are neither renewed nor touched.
+//
+// New in version v0.6
+type SessionEntryUpdater interface {
+	// InsertEntry stores data for the given key. In contrast to CreateEntry
+	// all fields of data are stored as they are, CreateEntry can simply call
+	// InsertEntry with the result of CurrentTimeKeyData.
+	// Return error != nil only if the insertion really failed.
+	InsertEntry(key string, data *SessionKeyData) error
+
+	// ExtendEntry sets the ValidUntil of the entry for key to
+	// CurrentTime() + validDuration and LastActivity to CurrentTime().
+	// It should return nil and ErrKeyNotFound if the key was not found and
+	// otherwise the updated data.
+	// It is used by the SessionController for sliding expiration, see
+	// SessionController.RenewDuration.
+	ExtendEntry(key string, validDuration time.Duration) (*SessionKeyData, error)
+
+	// TouchEntry sets the LastActivity of the entry for key to CurrentTime().
+	// It should return nil and ErrKeyNotFound if the key was not found and
+	// otherwise the updated data.
+	TouchEntry(key string) (*SessionKeyData, error)
+}
+
+// SessionEntryUpdaterContext is a SessionEntryUpdater with context variants
+// of all methods, see SessionHandlerContext.
+//
+// New in version v0.6
+type SessionEntryUpdaterContext interface {
+	SessionEntryUpdater
+
+	// InsertEntryContext is InsertEntry with a context.
+	InsertEntryContext(ctx context.Context, key string, data *SessionKeyData) error
+
+	// ExtendEntryContext is ExtendEntry with a context.
+	ExtendEntryContext(ctx context.Context, key string, validDuration time.Duration) (*SessionKeyData, error)
+
+	// TouchEntryContext is TouchEntry with a context.
+	TouchEntryContext(ctx context.Context, key string) (*SessionKeyData, error)
+}
+
+// SessionLimiter is an optional interface for a SessionHandler that can
+// limit the number of sessions per user atomically, see
+// SessionController.MaxSessions.
+//
+// If a handler does not implement this interface but implements
+// SessionLister the SessionController counts and deletes the sessions with
+// ListEntriesForUser and DeleteEntryByID, this is not atomic so concurrent
+// logins may exceed the limit. Otherwise ErrNotSupported is returned if
+// MaxSessions is set.
+//
+// New in version v0.6
+type SessionLimiter interface {
+	// InsertEntryLimited is InsertEntry but it takes care that the user
+	// (data.User) has at most maxSessions valid sessions after the insert.
+	// If the user already has maxSessions (or more) sessions the policy
+	// decides what happens: With RejectNewSession nothing is inserted and
+	// ErrTooManySessions is returned, with EvictOldestSession the oldest
+	// sessions (by CreationTime) are deleted.
+	// Pending sessions (LoginMethod PendingLoginMethod) are neither counted
+	// nor deleted.
+	// Checking the number of sessions, deleting and inserting must happen
+	// atomically. If maxSessions <= 0 there is no limit.
+	// It returns the number of deleted sessions.
+	InsertEntryLimited(key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error)
+}
+
+// SessionLimiterContext is a SessionLimiter with a context variant of
+// InsertEntryLimited, see SessionHandlerContext.
+//
+// New in version v0.6
+type SessionLimiterContext interface {
+	SessionLimiter
+
+	// InsertEntryLimitedContext is InsertEntryLimited with a context.
+	InsertEntryLimitedContext(ctx context.Context, key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error)
+}
+
+// SessionLister is an optional interface for a SessionHandler that can list
+// and delete the sessions of a user. This way you can show the sessions of a
+// user and let the user revoke them.
+//
+// If a handler does not implement this interface the SessionController
+// returns ErrNotSupported in EndOtherSessions.
+//
+// New in version v0.6
+type SessionLister interface {
+	// ListEntriesForUser returns all sessions of the given user, the ID of
+	// each entry is created with SessionEntryID.
+	// Invalid entries that are not deleted yet may be included.
+	ListEntriesForUser(user UserKeyType) ([]*SessionEntry, error)
+
+	// DeleteEntryByID removes the session of the user with the given id (see
+	// SessionEntry). It doesn't return an error if no such session exists.
+	DeleteEntryByID(user UserKeyType, id string) error
+
+	// DeleteOtherEntriesForUser removes all keys for the given user except key.
+	// It returns the number of removed entries and returns an error if
+	// something went wrong.
+	DeleteOtherEntriesForUser(user UserKeyType, key string) (int64, error)
+}
+
+// SessionListerContext is a SessionLister with context variants of all
+// methods, see SessionHandlerContext.
+//
+// New in version v0.6
+type SessionListerContext interface {
+	SessionLister
+
+	// ListEntriesForUserContext is ListEntriesForUser with a context.
+	ListEntriesForUserContext(ctx context.Context, user UserKeyType) ([]*SessionEntry, error)
+
+	// DeleteEntryByIDContext is DeleteEntryByID with a context.
+	DeleteEntryByIDContext(ctx context.Context, user UserKeyType, id string) error
+
+	// DeleteOtherEntriesForUserContext is DeleteOtherEntriesForUser with a
+	// context.
+	DeleteOtherEntriesForUserContext(ctx context.Context, user UserKeyType, key string) (int64, error)
+}
+
+// ErrNotSupported is the error that is returned by the SessionController if
+// the SessionHandler does not implement an optional interface that is
+// required for an operation, for example SessionLister for EndOtherSessions.
+//
+// New in version v0.6
+var ErrNotSupported = errors.New("The operation is not supported by the SessionHandler.")
+
+// SessionLimitPolicy describes what happens if a user already has the maximal
+// number of sessions and logs in again, see SessionController.MaxSessions.
+//
+// New in version v0.6
+type SessionLimitPolicy int
+
+const (
+	// RejectNewSession rejects the new session, the user has to logout
+	// somewhere else first.
+	RejectNewSession SessionLimitPolicy = iota
+
+	// EvictOldestSession deletes the oldest sessions of the user.
+	EvictOldestSession
+)
+
+// ErrTooManySessions is the error that is returned if a user already has
+// the maximal number of sessions and the policy is RejectNewSession.
+//
+// New in version v0.6
+var ErrTooManySessions = errors.New("The user has too many sessions.")
+
 // SessionController uses a SessionHandler to query the storage and add
 // additional functionality. It is used as the main anchorpoint for user
 // authentication.
@@ -186,10 +461,72 @@ type SessionHandler interface {
 // in that session the key in session.Values["key"].
 // NumBytes is the length of the random byte slice, see GenRandomBase64
 // for details about this parameter.
+//
+// By default a session is valid for the duration given in CreateAuthSession
+// and an active user gets logged out once this duration is over. Set
+// RenewDuration to a value > 0 to enable sliding expiration: Whenever
+// ValidateSession finds a valid session that is valid for less than
+// RenewThreshold it extends the entry in the storage s.t. it is valid for
+// RenewDuration from now on. If RenewThreshold is <= 0 RenewDuration / 2 is
+// used.
+//
+// IdleTimeout and AbsoluteTimeout can be used to expire sessions after a
+// period of inactivity and after a maximal lifetime, no matter how often they
+// get renewed.
+//
+// The keys are passed to the SessionHandler as they are, wrap your handler
+// with a HashedKeySessionHandler to store only hashes of the keys.
 type SessionController struct {
 	SessionHandler
 	NumBytes    int
 	SessionName string
+
+	// RenewDuration is the duration a session gets extended by ValidateSession,
+	// sliding expiration is disabled if it is <= 0 (the default).
+	// Sessions are only renewed if the SessionHandler implements
+	// SessionEntryUpdater.
+	//
+	// New in version v0.6
+	RenewDuration time.Duration
+
+	// RenewThreshold is the remaining lifetime below which a session gets
+	// renewed.
+	//
+	// New in version v0.6
+	RenewThreshold time.Duration
+
+	// IdleTimeout is the duration after which a session without activity is
+	// considered invalid, ValidateSession returns ErrSessionIdle in this case.
+	// It is disabled if it is <= 0 (the default).
+	// To avoid a write on each request the last activity is only updated in the
+	// storage if it is older than IdleTimeout / 10, this requires a
+	// SessionHandler that implements SessionEntryUpdater.
+	//
+	// New in version v0.6
+	IdleTimeout time.Duration
+
+	// AbsoluteTimeout is the maximal lifetime of a session, a session is never
+	// valid longer than AbsoluteTimeout after its creation (it sets
+	// SessionKeyData.MaxValidUntil).
+	// It is disabled if it is <= 0 (the default).
+	//
+	// New in version v0.6
+	AbsoluteTimeout time.Duration
+
+	// MaxSessions is the maximal number of sessions a user can have at the
+	// same time. If a user already has MaxSessions sessions the
+	// SessionLimitPolicy decides what happens when a new session is created.
+	// It is disabled if it is <= 0 (the default).
+	// See SessionLimiter for SessionHandlers that don't implement it.
+	//
+	// New in version v0.6
+	MaxSessions int
+
+	// SessionLimitPolicy is the policy used if MaxSessions is reached,
+	// defaults to RejectNewSession.
+	//
+	// New in version v0.6
+	SessionLimitPolicy SessionLimitPolicy
 }
 
 // NewSessionController creates a new session controller given a SessionHandler,
@@ -202,16 +539,63 @@ func NewSessionController(h SessionHandler) *SessionController {
 		SessionName: "user-auth"}
 }
 
+// renewThreshold returns RenewThreshold or RenewDuration / 2 if it is not
+// set.
+func (c *SessionController) renewThreshold() time.Duration {
+	if c.RenewThreshold <= 0 {
+		return c.RenewDuration / 2
+	}
+	return c.RenewThreshold
+}
+
+// contextHandler returns the SessionHandler of the controller as a
+// SessionHandlerContext that also implements the optional session
+// interfaces, see asExtendedSessionHandler.
+func (c *SessionController) contextHandler() extendedSessionHandler {
+	return asExtendedSessionHandler(c.SessionHandler)
+}
+
 // AddKey adds a new entry to the storage.
 // This function returns either nil, "" and some error if something went wrong
 // or the SessionKeyData instance, the key that was used to identify this
 // session and nil.
+// If MaxSessions is reached and the policy is RejectNewSession the error is
+// ErrTooManySessions.
 func (c *SessionController) AddKey(user UserKeyType, validDuration time.Duration) (*SessionKeyData, string, error) {
+	return c.AddKeyContext(context.Background(), user, validDuration)
+}
+
+// AddKeyContext is AddKey with a context that is passed to the
+// SessionHandler.
+//
+// New in version v0.6
+func (c *SessionController) AddKeyContext(ctx context.Context, user UserKeyType, validDuration time.Duration) (*SessionKeyData, string, error) {
+	return c.AddKeyWithMetadata(ctx, user, validDuration, SessionMetadata{})
+}
+
+// AddKeyWithMetadata is AddKeyContext but also stores the metadata with the
+// key.
+//
+// New in version v0.6
+func (c *SessionController) AddKeyWithMetadata(ctx context.Context, user UserKeyType, validDuration time.Duration, meta SessionMetadata) (*SessionKeyData, string, error) {
 	key, genErr := GenRandomBase64(c.NumBytes)
 	if genErr != nil {
 		return nil, "", genErr
 	}
-	data, insertErr := c.CreateEntry(user, key, validDuration)
+	data := CurrentTimeKeyData(user, validDuration)
+	data.Metadata = meta
+	if c.AbsoluteTimeout > 0 {
+		data.MaxValidUntil = data.CreationTime.Add(c.AbsoluteTimeout)
+		if data.ValidUntil.After(data.MaxValidUntil) {
+			data.ValidUntil = data.MaxValidUntil
+		}
+	}
+	var insertErr error
+	if c.MaxSessions > 0 {
+		_, insertErr = c.contextHandler().InsertEntryLimitedContext(ctx, key, data, c.MaxSessions, c.SessionLimitPolicy)
+	} else {
+		insertErr = c.contextHandler().InsertEntryContext(ctx, key, data)
+	}
 	if insertErr != nil {
 		return nil, "", insertErr
 	}
@@ -230,6 +614,12 @@ const (
 // storage but the key is not valid anymore.
 var ErrInvalidKey = errors.New("The key is not valid any more.")
 
+// ErrSessionIdle is the error that will be returned if a key was found in the
+// storage but was not used for longer than SessionController.IdleTimeout.
+//
+// New in version v0.6
+var ErrSessionIdle = errors.New("The session expired due to inactivity.")
+
 // ErrNotAuthSession is the error that will be returned if a gorialla session
 // does not have the SessionKey in session.Values. This usually means that
 // the user does not have a session yet and needs to login.
@@ -283,7 +673,8 @@ func (c SessionController) GetKey(session *sessions.Session) (string, error) {
 // If the key is still present in the storage but not valid any more
 // InvalidKeyErr will be returned. Otherwise it returns the data found in the
 // storage, the auth session object (for possible further processing) and nil
-// as error.
+// as error. If the key was not used for longer than IdleTimeout ErrSessionIdle
+// is returned, if the AbsoluteTimeout is over ErrInvalidKey is returned.
 // Otherwise it returns any error that may have happend while asking the
 // underlying storage, such as database errors.
 // So summarize:
@@ -304,11 +695,17 @@ func (c SessionController) GetKey(session *sessions.Session) (string, error) {
 // the key is still considered valid. If the key is invalid it will set the
 // MaxAge to -1.
 //
-// This method will not call session.Save!
+// If sliding expiration is enabled (see RenewDuration) and the key is only
+// valid for less than the threshold the entry gets extended in the storage
+// and MaxAge is set accordingly. If extending fails the error is returned.
+//
+// This method will not call session.Save! Middleware wraps this method and
+// takes care of saving the session.
+//
+// The context of the request (r.Context()) is passed to the SessionHandler.
 //
 // See examples for how to use this method.
 func (c *SessionController) ValidateSession(r *http.Request, store sessions.Store) (*SessionKeyData, *sessions.Session, error) {
-	now := CurrentTime()
 	// first get the session
 	session, err := c.GetSession(r, store)
 	if err != nil {
@@ -321,22 +718,16 @@ func (c *SessionController) ValidateSession(r *http.Request, store sessions.Stor
 		return nil, session, keyErr
 	}
 
-	// try to get the information out of the underlying storage
-	info, err := c.GetData(key)
+	info, err := c.validateKey(r.Context(), key)
 	if err != nil {
+		if err == ErrInvalidKey || err == ErrSessionIdle {
+			session.Options.MaxAge = -1
+		}
 		return nil, session, err
 	}
 
-	// now info is not allowed to be nil
-	// so we validate the entry and update the max age of the session, update to
-	// the time that is still left
-
-	if KeyInvalid(now, info.ValidUntil) {
-		session.Options.MaxAge = -1
-		return nil, session, ErrInvalidKey
-	}
-
-	durationLeft := info.ValidUntil.Sub(now)
+	// update the max age of the session to the time that is still left
+	durationLeft := info.ValidUntil.Sub(CurrentTime())
 	session.Options.MaxAge = int(durationLeft / time.Second)
 
 	// everything is fine, so now return everything: the user should be considered
@@ -344,6 +735,54 @@ func (c *SessionController) ValidateSession(r *http.Request, store sessions.Stor
 	return info, session, nil
 }
 
+// validateKey looks up the key in the storage and validates it.
+// It returns ErrKeyNotFound, ErrInvalidKey or ErrSessionIdle if the key is not
+// valid. Keys of pending sessions (see CreatePendingSession) are never valid,
+// only ValidatePendingSession accepts them. If the key is valid it renews the
+// key (see RenewDuration) or updates the last activity (see IdleTimeout) if
+// required and returns the (updated) data.
+func (c *SessionController) validateKey(ctx context.Context, key string) (*SessionKeyData, error) {
+	now := CurrentTime()
+	handler := c.contextHandler()
+	// try to get the information out of the underlying storage
+	info, err := handler.GetDataContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// now info is not allowed to be nil
+	// so we validate the entry
+	// the second factor of a pending session is still missing
+	if info.Metadata.LoginMethod == PendingLoginMethod {
+		return nil, ErrInvalidKey
+	}
+	if KeyInvalid(now, info.ValidUntil) {
+		return nil, ErrInvalidKey
+	}
+	if !info.MaxValidUntil.IsZero() && KeyInvalid(now, info.MaxValidUntil) {
+		return nil, ErrInvalidKey
+	}
+	if c.IdleTimeout > 0 && now.Sub(info.LastActivity) > c.IdleTimeout {
+		return nil, ErrSessionIdle
+	}
+
+	// renew the key if required, but never after MaxValidUntil
+	if renew := c.RenewDuration; renew > 0 && info.ValidUntil.Sub(now) < c.renewThreshold() {
+		if !info.MaxValidUntil.IsZero() && now.Add(renew).After(info.MaxValidUntil) {
+			renew = info.MaxValidUntil.Sub(now)
+		}
+		if now.Add(renew).After(info.ValidUntil) {
+			return handler.ExtendEntryContext(ctx, key, renew)
+		}
+	}
+
+	// update the last activity, but not on every request
+	if c.IdleTimeout > 0 && now.Sub(info.LastActivity) > c.IdleTimeout/10 {
+		return handler.TouchEntryContext(ctx, key)
+	}
+	return info, nil
+}
+
 // CreateAuthSession will create a new session and add it to the underlying
 // storage.
 // It returns the data that was stored for the key, the generated key
@@ -356,18 +795,36 @@ func (c *SessionController) ValidateSession(r *http.Request, store sessions.Stor
 //
 // It will set the session.MaxAge to the correct value, but again will not
 // call session.Save!
+// If the existing cookie can't be decoded (for example because the keys of
+// the store were changed) a new session is used.
+//
+// The context of the request (r.Context()) is passed to the SessionHandler.
+// The metadata of the session is created with MetadataFromRequest, use
+// CreateAuthSessionWithMetadata to set it yourself.
 func (c *SessionController) CreateAuthSession(r *http.Request, store sessions.Store,
 	user UserKeyType, validDuration time.Duration) (*SessionKeyData, string, *sessions.Session, error) {
+	return c.CreateAuthSessionWithMetadata(r, store, user, validDuration, MetadataFromRequest(r))
+}
+
+// CreateAuthSessionWithMetadata is CreateAuthSession with the metadata
+// stored for the session.
+//
+// New in version v0.6
+func (c *SessionController) CreateAuthSessionWithMetadata(r *http.Request, store sessions.Store,
+	user UserKeyType, validDuration time.Duration, meta SessionMetadata) (*SessionKeyData, string, *sessions.Session, error) {
 	session, err := store.Get(r, c.SessionName)
-	if err != nil {
+	// if the old cookie can't be decoded gorilla returns a new session, in
+	// this case we can simply use it
+	if err != nil && (session == nil || !IsAuthError(err)) {
 		return nil, "", nil, err
 	}
-	data, key, err := c.AddKey(user, validDuration)
+	data, key, err := c.AddKeyWithMetadata(r.Context(), user, validDuration, meta)
 	if err != nil {
 		return nil, "", session, err
 	}
 	session.Values[SessionKey] = key
-	session.Options.MaxAge = int(validDuration / time.Second)
+	// the valid duration may be shortened by AbsoluteTimeout
+	session.Options.MaxAge = int(data.ValidUntil.Sub(data.CreationTime) / time.Second)
 	// everything ok
 	return data, key, session, nil
 }
@@ -399,7 +856,35 @@ func (c *SessionController) EndSession(r *http.Request, store sessions.Store) er
 	}
 	// set the session age to -1
 	session.Options.MaxAge = -1
-	return c.DeleteKey(key)
+	return c.contextHandler().DeleteKeyContext(r.Context(), key)
+}
+
+// EndOtherSessions deletes all sessions of the user except the current
+// session. The current session is validated like in ValidateSession, the
+// errors are the same as the errors returned by ValidateSession.
+// It returns the number of deleted sessions.
+// This can be used for a "log out all other devices" function.
+// If the SessionHandler does not implement SessionLister ErrNotSupported is
+// returned.
+//
+// This method will not call session.Save and does not update MaxAge, so
+// you probably want to call it after ValidateSession.
+//
+// New in version v0.6
+func (c *SessionController) EndOtherSessions(r *http.Request, store sessions.Store) (int64, error) {
+	session, err := c.GetSession(r, store)
+	if err != nil {
+		return -1, err
+	}
+	key, err := c.GetKey(session)
+	if err != nil {
+		return -1, err
+	}
+	info, err := c.validateKey(r.Context(), key)
+	if err != nil {
+		return -1, err
+	}
+	return c.contextHandler().DeleteOtherEntriesForUserContext(r.Context(), info.User, key)
 }
 
 // DeleteEntriesDaemon starts a goroutine that runs forever and deletes invalid
@@ -413,7 +898,8 @@ func (c *SessionController) EndSession(r *http.Request, store sessions.Store) er
 //
 // The context parameter can be set to nil and the daemon runs forever.
 // If it is set to a context however it will listen on the context.Done
-// channel and stop once it receives a stop signal.
+// channel and stop once it receives a stop signal. The context is also passed
+// to DeleteInvalidKeysContext.
 // See the wiki for an example.
 func (c *SessionController) DeleteEntriesDaemon(sleep time.Duration, ctx context.Context, reportErr bool) {
 	go func() {
@@ -433,7 +919,7 @@ func (c *SessionController) DeleteEntriesDaemon(sleep time.Duration, ctx context
 				case <-ctx.Done():
 					return
 				case <-next:
-					if _, err := c.DeleteInvalidKeys(); reportErr && err != nil {
+					if _, err := c.contextHandler().DeleteInvalidKeysContext(ctx); reportErr && err != nil {
 						log.WithError(err).Error("goauth: Error deleting invalid keys.")
 					}
 					go func() {
@@ -0,0 +1,240 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// approxTime returns true if a and b differ by at most one second.
+func approxTime(a, b time.Time) bool {
+	diff := a.Sub(b)
+	return diff >= -time.Second && diff <= time.Second
+}
+
+func TestValidateKeyTimeouts(t *testing.T) {
+	now := CurrentTime()
+	tests := []struct {
+		name          string
+		idle, renew   time.Duration
+		validUntil    time.Duration
+		maxValidUntil time.Duration
+		lastActivity  time.Duration
+		loginMethod   string
+		err           error
+		// expected ValidUntil and LastActivity of the result relative to
+		// now
+		expValidUntil, expLastActivity time.Duration
+	}{
+		{name: "valid", validUntil: time.Hour,
+			expValidUntil: time.Hour},
+		{name: "expired", validUntil: -time.Second, err: ErrInvalidKey},
+		{name: "absolute timeout", validUntil: time.Hour, maxValidUntil: -time.Second,
+			err: ErrInvalidKey},
+		{name: "before absolute timeout", validUntil: time.Hour, maxValidUntil: time.Minute,
+			expValidUntil: time.Hour},
+		{name: "idle", idle: 10 * time.Minute, validUntil: time.Hour,
+			lastActivity: -11 * time.Minute, err: ErrSessionIdle},
+		{name: "touch", idle: 10 * time.Minute, validUntil: time.Hour,
+			lastActivity: -2 * time.Minute, expValidUntil: time.Hour},
+		{name: "no touch", idle: 10 * time.Minute, validUntil: time.Hour,
+			lastActivity: -30 * time.Second, expValidUntil: time.Hour,
+			expLastActivity: -30 * time.Second},
+		{name: "renew", renew: time.Hour, validUntil: 10 * time.Minute,
+			expValidUntil: time.Hour},
+		{name: "no renew", renew: time.Hour, validUntil: 45 * time.Minute,
+			expValidUntil: 45 * time.Minute},
+		{name: "renew until absolute timeout", renew: time.Hour, validUntil: 10 * time.Minute,
+			maxValidUntil: 20 * time.Minute, expValidUntil: 20 * time.Minute},
+		{name: "pending", validUntil: time.Hour, loginMethod: PendingLoginMethod,
+			err: ErrInvalidKey},
+	}
+	for _, tc := range tests {
+		h := NewInMemoryHandler()
+		c := NewSessionController(h)
+		c.IdleTimeout, c.RenewDuration = tc.idle, tc.renew
+		data := &SessionKeyData{User: 1, CreationTime: now.Add(-time.Hour),
+			ValidUntil: now.Add(tc.validUntil), LastActivity: now.Add(tc.lastActivity)}
+		if tc.maxValidUntil != 0 {
+			data.MaxValidUntil = now.Add(tc.maxValidUntil)
+		}
+		data.Metadata.LoginMethod = tc.loginMethod
+		if err := h.InsertEntry("key", data); err != nil {
+			t.Fatal(err)
+		}
+		info, err := c.validateKey(context.Background(), "key")
+		if err != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !approxTime(info.ValidUntil, now.Add(tc.expValidUntil)) {
+			t.Errorf("%s: expected ValidUntil %v, got %v", tc.name, now.Add(tc.expValidUntil), info.ValidUntil)
+		}
+		if !approxTime(info.LastActivity, now.Add(tc.expLastActivity)) {
+			t.Errorf("%s: expected LastActivity %v, got %v", tc.name, now.Add(tc.expLastActivity), info.LastActivity)
+		}
+		// the changes must be stored
+		stored, _ := h.GetData("key")
+		if !stored.ValidUntil.Equal(info.ValidUntil) || !stored.LastActivity.Equal(info.LastActivity) {
+			t.Errorf("%s: the returned data was not stored", tc.name)
+		}
+	}
+	c := NewSessionController(NewInMemoryHandler())
+	if _, err := c.validateKey(context.Background(), "missing"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestInsertEntryLimitedPending(t *testing.T) {
+	h := NewInMemoryHandler()
+	pending := CurrentTimeKeyData(uint64(1), time.Hour)
+	pending.Metadata.LoginMethod = PendingLoginMethod
+	if err := h.InsertEntry("pending", pending); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.InsertEntryLimited("first", CurrentTimeKeyData(uint64(1), time.Hour), 1, RejectNewSession); err != nil {
+		t.Errorf("pending session counted for the limit: %v", err)
+	}
+	if _, err := h.InsertEntryLimited("second", CurrentTimeKeyData(uint64(1), time.Hour), 1, RejectNewSession); err != ErrTooManySessions {
+		t.Errorf("expected ErrTooManySessions, got %v", err)
+	}
+	removed, err := h.InsertEntryLimited("third", CurrentTimeKeyData(uint64(1), time.Hour), 1, EvictOldestSession)
+	if err != nil || removed != 1 {
+		t.Errorf("expected one evicted session, got %d, %v", removed, err)
+	}
+	if _, err := h.GetData("pending"); err != nil {
+		t.Errorf("pending session was evicted: %v", err)
+	}
+}
+
+// the handlers of this package implement all optional session interfaces
+var (
+	_ extendedSessionHandler = (*InMemoryHandler)(nil)
+	_ extendedSessionHandler = (*SQLSessionHandler)(nil)
+	_ extendedSessionHandler = (*RedisSessionHandler)(nil)
+	_ extendedSessionHandler = (*HashedKeySessionHandler)(nil)
+	_ extendedSessionHandler = (*MemcachedSessionHandler)(nil)
+)
+
+// plainSessionHandler implements only SessionHandler (like handlers written
+// before v0.6).
+type plainSessionHandler struct {
+	h *InMemoryHandler
+}
+
+func (p plainSessionHandler) Init() error { return p.h.Init() }
+
+func (p plainSessionHandler) GetData(key string) (*SessionKeyData, error) {
+	return p.h.GetData(key)
+}
+
+func (p plainSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return p.h.CreateEntry(user, key, validDuration)
+}
+
+func (p plainSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	return p.h.DeleteEntriesForUser(user)
+}
+
+func (p plainSessionHandler) DeleteInvalidKeys() (int64, error) { return p.h.DeleteInvalidKeys() }
+
+func (p plainSessionHandler) DeleteKey(key string) error { return p.h.DeleteKey(key) }
+
+// listerSessionHandler is a plainSessionHandler that also implements
+// SessionLister.
+type listerSessionHandler struct {
+	plainSessionHandler
+}
+
+func (l listerSessionHandler) ListEntriesForUser(user UserKeyType) ([]*SessionEntry, error) {
+	return l.h.ListEntriesForUser(user)
+}
+
+func (l listerSessionHandler) DeleteEntryByID(user UserKeyType, id string) error {
+	return l.h.DeleteEntryByID(user, id)
+}
+
+func (l listerSessionHandler) DeleteOtherEntriesForUser(user UserKeyType, key string) (int64, error) {
+	return l.h.DeleteOtherEntriesForUser(user, key)
+}
+
+func TestSessionHandlerFallback(t *testing.T) {
+	ctx := context.Background()
+	h := NewInMemoryHandler()
+	c := NewSessionController(plainSessionHandler{h})
+	c.RenewDuration, c.IdleTimeout = time.Hour, time.Hour
+	data, key, err := c.AddKeyWithMetadata(ctx, 1, time.Minute, SessionMetadata{UserAgent: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the entry is created with CreateEntry, so the metadata is lost
+	stored, err := h.GetData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.User != data.User || !approxTime(stored.ValidUntil, data.ValidUntil) || stored.Metadata.UserAgent != "" {
+		t.Errorf("unexpected stored entry %v", stored)
+	}
+	// the entry can't be renewed
+	info, err := c.validateKey(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ValidUntil.Equal(stored.ValidUntil) {
+		t.Errorf("expected ValidUntil %v, got %v", stored.ValidUntil, info.ValidUntil)
+	}
+	pending := CurrentTimeKeyData(uint64(1), time.Minute)
+	pending.Metadata.LoginMethod = PendingLoginMethod
+	if err := c.contextHandler().InsertEntryContext(ctx, "pending", pending); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported for a pending session, got %v", err)
+	}
+	if _, err := c.contextHandler().DeleteOtherEntriesForUserContext(ctx, 1, key); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+	c.MaxSessions = 1
+	if _, _, err := c.AddKeyContext(ctx, 1, time.Minute); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported for MaxSessions, got %v", err)
+	}
+
+	// with a SessionLister the limit is checked with ListEntriesForUser
+	c.SessionHandler = listerSessionHandler{plainSessionHandler{h}}
+	if _, _, err := c.AddKeyContext(ctx, 1, time.Minute); err != ErrTooManySessions {
+		t.Errorf("expected ErrTooManySessions, got %v", err)
+	}
+	c.SessionLimitPolicy = EvictOldestSession
+	_, newKey, err := c.AddKeyContext(ctx, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.GetData(key); err != ErrKeyNotFound {
+		t.Errorf("expected the oldest session to be evicted, got %v", err)
+	}
+	if _, err := h.GetData(newKey); err != nil {
+		t.Errorf("new session was not inserted: %v", err)
+	}
+}
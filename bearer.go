@@ -0,0 +1,145 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BearerLoginMethod is the LoginMethod stored in the metadata of sessions
+// created by IssueToken.
+//
+// New in version v0.6
+const BearerLoginMethod = "bearer"
+
+// BearerKey returns the key from the Authorization header of the request,
+// i.e. the header must have the form "Authorization: Bearer <key>".
+// If there is no such header ErrNotAuthSession is returned.
+//
+// New in version v0.6
+func BearerKey(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	// the scheme is case-insensitive, see RFC 6750
+	const prefix = "bearer "
+	if len(header) <= len(prefix) || strings.ToLower(header[:len(prefix)]) != prefix {
+		return "", ErrNotAuthSession
+	}
+	key := strings.TrimSpace(header[len(prefix):])
+	if key == "" {
+		return "", ErrNotAuthSession
+	}
+	return key, nil
+}
+
+// IssueToken creates a new session for the user and returns the key, the key
+// should be sent by the client in the Authorization header:
+// "Authorization: Bearer <key>".
+// Tokens are stored by the SessionHandler like any other session, so all
+// options of the controller (sliding expiration, timeouts, MaxSessions) apply
+// and they're listed by ListEntriesForUser.
+//
+// New in version v0.6
+func (c *SessionController) IssueToken(user UserKeyType, validDuration time.Duration) (*SessionKeyData, string, error) {
+	return c.IssueTokenWithMetadata(context.Background(), user, validDuration, SessionMetadata{})
+}
+
+// IssueTokenWithMetadata is IssueToken with a context and metadata that is
+// stored with the session. If the LoginMethod of meta is empty it is set to
+// BearerLoginMethod.
+//
+// New in version v0.6
+func (c *SessionController) IssueTokenWithMetadata(ctx context.Context, user UserKeyType, validDuration time.Duration, meta SessionMetadata) (*SessionKeyData, string, error) {
+	if meta.LoginMethod == "" {
+		meta.LoginMethod = BearerLoginMethod
+	}
+	return c.AddKeyWithMetadata(ctx, user, validDuration, meta)
+}
+
+// ValidateBearer validates the key from the Authorization header of the
+// request, see BearerKey.
+// It returns the same errors as ValidateSession: ErrNotAuthSession if there
+// is no bearer token, ErrKeyNotFound, ErrInvalidKey and ErrSessionIdle.
+// Sliding expiration works the same way as for ValidateSession, of course
+// the client doesn't get notified about that.
+// It returns the data and the key.
+//
+// The context of the request (r.Context()) is passed to the SessionHandler.
+//
+// New in version v0.6
+func (c *SessionController) ValidateBearer(r *http.Request) (*SessionKeyData, string, error) {
+	key, err := BearerKey(r)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := c.validateKey(r.Context(), key)
+	if err != nil {
+		return nil, key, err
+	}
+	return data, key, nil
+}
+
+// RevokeBearer deletes the session of the bearer token in the request.
+// If there is no bearer token it does nothing.
+//
+// New in version v0.6
+func (c *SessionController) RevokeBearer(r *http.Request) error {
+	key, err := BearerKey(r)
+	if err != nil {
+		return nil
+	}
+	return c.contextHandler().DeleteKeyContext(r.Context(), key)
+}
+
+// BearerMiddleware is like Middleware but uses ValidateBearer instead of a
+// gorilla session. Requests that are not authenticated always get a 401
+// Unauthorized with a "WWW-Authenticate: Bearer" header, LoginURL and
+// RedirectParam in opts are ignored.
+//
+// New in version v0.6
+func (c *SessionController) BearerMiddleware(opts *MiddlewareOptions) func(http.Handler) http.Handler {
+	if opts == nil {
+		opts = &MiddlewareOptions{}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _, err := c.ValidateBearer(r)
+			if err != nil {
+				if !IsAuthError(err) {
+					opts.handleError(w, r, err)
+					return
+				}
+				if opts.Optional {
+					next.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ContextWithUser(r.Context(), data)))
+		})
+	}
+}
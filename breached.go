@@ -0,0 +1,453 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachedPasswordChecker checks if a password is contained in a list of
+// breached passwords.
+//
+// All implementations in this package work offline with the files provided
+// by haveibeenpwned.com (HIBP): They contain the upper case hex encoded SHA-1
+// hashes of the passwords and the number of times it was found in a breach
+// in the form "<SHA-1>:<count>".
+//
+// New in version v0.6
+type BreachedPasswordChecker interface {
+	IsBreached(password []byte) (bool, error)
+}
+
+// passwordSHA1 returns the upper case hex encoded SHA-1 of the password.
+func passwordSHA1(password []byte) string {
+	sum := sha1.Sum(password)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// ParseHIBPLine parses a line of the form "<hash>:<count>", hash is the hex
+// encoded SHA-1 (or the suffix of it in range files).
+// The count is optional, if there is no count it is set to 1.
+//
+// New in version v0.6
+func ParseHIBPLine(line string) (string, int, error) {
+	line = strings.TrimSpace(line)
+	sep := strings.IndexByte(line, ':')
+	if sep < 0 {
+		return strings.ToUpper(line), 1, nil
+	}
+	count, err := strconv.Atoi(line[sep+1:])
+	if err != nil {
+		return "", -1, err
+	}
+	return strings.ToUpper(line[:sep]), count, nil
+}
+
+// HIBPFileChecker checks passwords against a single HIBP file that is
+// ordered by hash (the "ordered by hash" download of HIBP).
+// It doesn't load the file into memory but uses a binary search on the file,
+// so each lookup requires about log2(size of the file) reads.
+//
+// New in version v0.6
+type HIBPFileChecker struct {
+	// Path is the path of the file.
+	Path string
+
+	// MinCount is the minimal number of times a password must have been
+	// found in breaches s.t. it is considered as breached.
+	MinCount int
+}
+
+// NewHIBPFileChecker returns a new HIBPFileChecker.
+//
+// New in version v0.6
+func NewHIBPFileChecker(path string, minCount int) *HIBPFileChecker {
+	return &HIBPFileChecker{Path: path, MinCount: minCount}
+}
+
+// IsBreached searches for the hash of the password in the file.
+func (checker *HIBPFileChecker) IsBreached(password []byte) (bool, error) {
+	f, err := os.Open(checker.Path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	count, err := searchHIBPFile(f, stat.Size(), passwordSHA1(password))
+	if err != nil {
+		return false, err
+	}
+	return count > 0 && count >= checker.MinCount, nil
+}
+
+// readLineAt returns the first line that starts at a position >= pos, its
+// start and its length (including the line break).
+// If there is no such line start is >= size.
+func readLineAt(r io.ReaderAt, size, pos int64) (line string, start int64, length int64, err error) {
+	start = pos
+	if pos > 0 {
+		// start with the previous byte, if it's a line break pos is a line start
+		start = pos - 1
+	}
+	reader := bufio.NewReader(io.NewSectionReader(r, start, size-start))
+	if pos > 0 {
+		skipped, skipErr := reader.ReadString('\n')
+		start += int64(len(skipped))
+		if skipErr == io.EOF {
+			return "", size, 0, nil
+		}
+		if skipErr != nil {
+			return "", -1, -1, skipErr
+		}
+	}
+	if start >= size {
+		return "", size, 0, nil
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", -1, -1, err
+	}
+	return line, start, int64(len(line)), nil
+}
+
+// searchHIBPFile does a binary search for hash in r and returns the count.
+// It returns 0 if the hash was not found.
+func searchHIBPFile(r io.ReaderAt, size int64, hash string) (int, error) {
+	// invariant: if the hash is in the file the line starts in [lo, hi)
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, start, length, err := readLineAt(r, size, mid)
+		if err != nil {
+			return -1, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		lineHash, count, parseErr := ParseHIBPLine(line)
+		if parseErr != nil {
+			return -1, parseErr
+		}
+		switch {
+		case lineHash == hash:
+			return count, nil
+		case lineHash < hash:
+			lo = start + length
+		default:
+			hi = mid
+		}
+	}
+	return 0, nil
+}
+
+// HIBPRangeChecker checks passwords against a directory of HIBP range files:
+// For each prefix of length 5 of the hex encoded SHA-1 there is a file
+// "<PREFIX>.txt" that contains lines of the form "<SUFFIX>:<count>".
+// This is the format of the HIBP range API and of the official downloader if
+// the output is not written to a single file.
+//
+// New in version v0.6
+type HIBPRangeChecker struct {
+	// Dir is the directory containing the range files.
+	Dir string
+
+	// MinCount is the minimal number of times a password must have been
+	// found in breaches s.t. it is considered as breached.
+	MinCount int
+}
+
+// NewHIBPRangeChecker returns a new HIBPRangeChecker.
+//
+// New in version v0.6
+func NewHIBPRangeChecker(dir string, minCount int) *HIBPRangeChecker {
+	return &HIBPRangeChecker{Dir: dir, MinCount: minCount}
+}
+
+// IsBreached searches for the hash of the password in the range file of its
+// prefix. There is a file for every prefix, so if the file doesn't exist
+// (the directory is incomplete or wrong) the error is returned instead of
+// accepting the password.
+func (checker *HIBPRangeChecker) IsBreached(password []byte) (bool, error) {
+	hash := passwordSHA1(password)
+	f, err := os.Open(filepath.Join(checker.Dir, hash[:5]+".txt"))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	suffix := hash[5:]
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineSuffix, count, parseErr := ParseHIBPLine(scanner.Text())
+		if parseErr != nil {
+			return false, parseErr
+		}
+		if lineSuffix == suffix {
+			return count > 0 && count >= checker.MinCount, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// bloomMagic is the header of files created by BloomFilter.WriteTo.
+const bloomMagic = "GOAUTHBF"
+
+// maxBloomHashes and maxBloomBits are the maximal number of hash functions
+// and bits of a BloomFilter, ReadBloomFilter rejects filters with larger
+// values before allocating them. 2^36 bits (8 GiB) are enough for all
+// hashes in the HIBP files with a false positive rate of 0.001.
+const (
+	maxBloomHashes = 64
+	maxBloomBits   = 1 << 36
+)
+
+// ErrInvalidBloomFilter is returned by ReadBloomFilter if the input is not a
+// valid bloom filter.
+//
+// New in version v0.6
+var ErrInvalidBloomFilter = errors.New("Invalid bloom filter.")
+
+// BloomFilter is a compact BreachedPasswordChecker: It stores the SHA-1
+// hashes of breached passwords in a bloom filter. A bloom filter never
+// misses a breached password but may report a password as breached that
+// isn't (with the false positive rate used to create it).
+//
+// Use the tool cmd/hibpbloom to build a filter from the HIBP files, or
+// create one with NewBloomFilter and add hashes with AddHIBP.
+//
+// New in version v0.6
+type BloomFilter struct {
+	k    uint32
+	m    uint64
+	bits []uint64
+}
+
+// NewBloomFilter returns a new empty bloom filter for n entries with false
+// positive rate p (for example 0.001).
+// The filter has at most 2^36 bits and 64 hash functions, so for a larger
+// n or a smaller p the false positive rate is higher than p.
+//
+// New in version v0.6
+func NewBloomFilter(n uint64, p float64) *BloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	} else if m > maxBloomBits {
+		m = maxBloomBits
+	}
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > maxBloomHashes {
+		k = maxBloomHashes
+	}
+	return &BloomFilter{k: k, m: m, bits: make([]uint64, (m+63)/64)}
+}
+
+// indexes calls f for all bit positions of the SHA-1 hash. The hash is
+// already uniformly distributed, so two parts of it are used for double
+// hashing.
+func (filter *BloomFilter) indexes(sum []byte, f func(pos uint64) bool) {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+	for i := uint32(0); i < filter.k; i++ {
+		if !f((h1 + uint64(i)*h2) % filter.m) {
+			return
+		}
+	}
+}
+
+// AddSHA1 adds the (binary) SHA-1 hash to the filter.
+func (filter *BloomFilter) AddSHA1(sum []byte) {
+	filter.indexes(sum, func(pos uint64) bool {
+		filter.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+// ContainsSHA1 returns true if the (binary) SHA-1 hash is (probably) in the
+// filter.
+func (filter *BloomFilter) ContainsSHA1(sum []byte) bool {
+	res := true
+	filter.indexes(sum, func(pos uint64) bool {
+		res = filter.bits[pos/64]&(1<<(pos%64)) != 0
+		return res
+	})
+	return res
+}
+
+// IsBreached returns true if the password is (probably) in the filter.
+func (filter *BloomFilter) IsBreached(password []byte) (bool, error) {
+	sum := sha1.Sum(password)
+	return filter.ContainsSHA1(sum[:]), nil
+}
+
+// AddHIBP adds all hashes from a HIBP file with lines of the form
+// "<SHA-1>:<count>" that were found at least minCount times.
+// If prefix is not empty it is prepended to the hashes, use this for range
+// files that only contain the suffix.
+// It returns the number of added hashes.
+func (filter *BloomFilter) AddHIBP(r io.Reader, prefix string, minCount int) (uint64, error) {
+	var res uint64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		hash, count, err := ParseHIBPLine(line)
+		if err != nil {
+			return res, err
+		}
+		if count < minCount {
+			continue
+		}
+		sum, err := hex.DecodeString(prefix + hash)
+		if err != nil {
+			return res, err
+		}
+		if len(sum) != sha1.Size {
+			return res, errors.New("Invalid SHA-1 hash in HIBP file.")
+		}
+		filter.AddSHA1(sum)
+		res++
+	}
+	return res, scanner.Err()
+}
+
+// WriteTo writes the filter to w, it can be read again with ReadBloomFilter.
+func (filter *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var written int64
+	header := make([]byte, len(bloomMagic)+4+8)
+	copy(header, bloomMagic)
+	binary.LittleEndian.PutUint32(header[len(bloomMagic):], filter.k)
+	binary.LittleEndian.PutUint64(header[len(bloomMagic)+4:], filter.m)
+	n, err := bw.Write(header)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	buf := make([]byte, 8)
+	for _, word := range filter.bits {
+		binary.LittleEndian.PutUint64(buf, word)
+		n, err = bw.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, bw.Flush()
+}
+
+// ReadBloomFilter reads a filter that was written with WriteTo.
+// It returns ErrInvalidBloomFilter if the input is not a filter or the
+// filter is too large (more than 2^36 bits or 64 hash functions).
+//
+// New in version v0.6
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(bloomMagic)+4+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrInvalidBloomFilter
+	}
+	if !bytes.Equal(header[:len(bloomMagic)], []byte(bloomMagic)) {
+		return nil, ErrInvalidBloomFilter
+	}
+	k := binary.LittleEndian.Uint32(header[len(bloomMagic):])
+	m := binary.LittleEndian.Uint64(header[len(bloomMagic)+4:])
+	// check the values before allocating the filter
+	if k == 0 || k > maxBloomHashes || m == 0 || m > maxBloomBits {
+		return nil, ErrInvalidBloomFilter
+	}
+	filter := &BloomFilter{k: k, m: m, bits: make([]uint64, (m+63)/64)}
+	buf := make([]byte, 8)
+	for i := range filter.bits {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, ErrInvalidBloomFilter
+		}
+		filter.bits[i] = binary.LittleEndian.Uint64(buf)
+	}
+	return filter, nil
+}
+
+// LoadBloomFilter reads a filter from a file, see ReadBloomFilter.
+//
+// New in version v0.6
+func LoadBloomFilter(path string) (*BloomFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadBloomFilter(f)
+}
+
+// RuleBreached is the rule in PolicyViolation if a password was found in a
+// breach.
+//
+// New in version v0.6
+const RuleBreached = "breached"
+
+// BreachedPasswordPolicy is a PasswordPolicy that rejects passwords found by
+// the Checker. Combine it with other policies with PasswordPolicies, for
+// example:
+//
+//	handler.Policy = PasswordPolicies{NewPasswordPolicy(), &BreachedPasswordPolicy{filter}}
+//
+// New in version v0.6
+type BreachedPasswordPolicy struct {
+	Checker BreachedPasswordChecker
+}
+
+// CheckPolicy returns a *PolicyError if the password was breached and the
+// error of the Checker if there was one.
+func (policy *BreachedPasswordPolicy) CheckPolicy(user *BaseUserInformation, password []byte) error {
+	breached, err := policy.Checker.IsBreached(password)
+	if err != nil {
+		return err
+	}
+	if breached {
+		res := &PolicyError{}
+		res.add(RuleBreached, "The password was found in a data breach.")
+		return res
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testHIBPHashes are sorted SHA-1 hashes for the HIBP tests.
+var testHIBPHashes = []string{
+	"0000000000000000000000000000000000000001",
+	"00000000000000000000000A0000000000000000",
+	"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8",
+	"7C4A8D09CA3762AF61E59520943DC26494F8941B",
+	"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+}
+
+// testHIBPFile returns a HIBP file with the hashes, the count of hash i is
+// i + 1.
+func testHIBPFile(lineBreak string, trailingBreak bool) string {
+	lines := make([]string, len(testHIBPHashes))
+	for i, hash := range testHIBPHashes {
+		lines[i] = fmt.Sprintf("%s:%d", hash, i+1)
+	}
+	res := strings.Join(lines, lineBreak)
+	if trailingBreak {
+		res += lineBreak
+	}
+	return res
+}
+
+func TestSearchHIBPFile(t *testing.T) {
+	tests := []struct {
+		hash     string
+		expected int
+	}{
+		// first and last line
+		{testHIBPHashes[0], 1},
+		{testHIBPHashes[4], 5},
+		{testHIBPHashes[1], 2},
+		{testHIBPHashes[2], 3},
+		{testHIBPHashes[3], 4},
+		// before the first, between two and after the last line
+		{"0000000000000000000000000000000000000000", 0},
+		{"6000000000000000000000000000000000000000", 0},
+		{"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFE", 0},
+	}
+	for _, lineBreak := range []string{"\n", "\r\n"} {
+		for _, trailingBreak := range []bool{true, false} {
+			content := testHIBPFile(lineBreak, trailingBreak)
+			r := strings.NewReader(content)
+			for _, tc := range tests {
+				count, err := searchHIBPFile(r, int64(len(content)), tc.hash)
+				if err != nil {
+					t.Errorf("searchHIBPFile(%q) with line break %q (trailing %v) returned error %v",
+						tc.hash, lineBreak, trailingBreak, err)
+				} else if count != tc.expected {
+					t.Errorf("searchHIBPFile(%q) with line break %q (trailing %v): expected %d, got %d",
+						tc.hash, lineBreak, trailingBreak, tc.expected, count)
+				}
+			}
+		}
+	}
+}
+
+func TestSearchHIBPFileEdgeCases(t *testing.T) {
+	hash := testHIBPHashes[2]
+	tests := []struct {
+		content  string
+		expected int
+	}{
+		{"", 0},
+		{"\n", 0},
+		{hash, 1},
+		{hash + ":7", 7},
+		{hash + ":7\n", 7},
+		{strings.ToLower(hash) + ":7\r\n", 7},
+	}
+	for _, tc := range tests {
+		count, err := searchHIBPFile(strings.NewReader(tc.content), int64(len(tc.content)), hash)
+		if err != nil {
+			t.Errorf("searchHIBPFile in %q returned error %v", tc.content, err)
+		} else if count != tc.expected {
+			t.Errorf("searchHIBPFile in %q: expected %d, got %d", tc.content, tc.expected, count)
+		}
+	}
+}
+
+func TestHIBPRangeChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goauth-hibp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// "password" has the hash 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	content := "1E4C9B93F3F0682250B6CF8331B7EE68FD8:3\r\nFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:1\r\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		minCount int
+		expected bool
+	}{
+		{0, true},
+		{3, true},
+		{4, false},
+	}
+	for _, tc := range tests {
+		breached, err := NewHIBPRangeChecker(dir, tc.minCount).IsBreached([]byte("password"))
+		if err != nil {
+			t.Errorf("IsBreached with MinCount %d returned error %v", tc.minCount, err)
+		} else if breached != tc.expected {
+			t.Errorf("IsBreached with MinCount %d: expected %v, got %v", tc.minCount, tc.expected, breached)
+		}
+	}
+	// the range file of "123456" doesn't exist
+	if _, err := NewHIBPRangeChecker(dir, 0).IsBreached([]byte("123456")); err == nil {
+		t.Error("expected an error for a missing range file")
+	}
+}
+
+func TestBloomFilterRoundTrip(t *testing.T) {
+	filter := NewBloomFilter(100, 0.001)
+	added, err := filter.AddHIBP(strings.NewReader(testHIBPFile("\r\n", true)), "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != uint64(len(testHIBPHashes)-1) {
+		t.Errorf("expected %d added hashes, got %d", len(testHIBPHashes)-1, added)
+	}
+	var buf bytes.Buffer
+	written, err := filter.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(buf.Len()) {
+		t.Errorf("WriteTo reported %d bytes but wrote %d", written, buf.Len())
+	}
+	read, err := ReadBloomFilter(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.k != filter.k || read.m != filter.m || len(read.bits) != len(filter.bits) {
+		t.Fatalf("expected k=%d, m=%d, got k=%d, m=%d", filter.k, filter.m, read.k, read.m)
+	}
+	for i := range filter.bits {
+		if read.bits[i] != filter.bits[i] {
+			t.Fatalf("bits differ at word %d", i)
+		}
+	}
+	if breached, _ := read.IsBreached([]byte("password")); !breached {
+		t.Error("expected \"password\" to be breached")
+	}
+	if breached, _ := read.IsBreached([]byte("123456")); !breached {
+		t.Error("expected \"123456\" to be breached")
+	}
+	// the first hash was found only once, so it was not added
+	sum, _ := hex.DecodeString(testHIBPHashes[0])
+	if read.ContainsSHA1(sum) {
+		t.Errorf("expected %s not to be in the filter", testHIBPHashes[0])
+	}
+	// truncated and invalid filters
+	data := buf.Bytes()
+	invalid := [][]byte{
+		nil,
+		data[:len(bloomMagic)],
+		data[:len(data)-1],
+		append([]byte("XXXX"), data[4:]...),
+	}
+	for _, b := range invalid {
+		if _, err := ReadBloomFilter(bytes.NewReader(b)); err != ErrInvalidBloomFilter {
+			t.Errorf("expected ErrInvalidBloomFilter for %d bytes, got %v", len(b), err)
+		}
+	}
+}
+
+func TestReadBloomFilterHeader(t *testing.T) {
+	tests := []struct {
+		k     uint32
+		m     uint64
+		valid bool
+	}{
+		{1, 64, true},
+		{64, 128, true},
+		{0, 64, false},
+		{65, 64, false},
+		{math.MaxUint32, 64, false},
+		{1, 0, false},
+		{1, maxBloomBits + 1, false},
+		// (m + 63) / 64 overflows
+		{1, math.MaxUint64, false},
+		{1, math.MaxUint64 - 62, false},
+	}
+	for _, tc := range tests {
+		header := make([]byte, len(bloomMagic)+4+8)
+		copy(header, bloomMagic)
+		binary.LittleEndian.PutUint32(header[len(bloomMagic):], tc.k)
+		binary.LittleEndian.PutUint64(header[len(bloomMagic)+4:], tc.m)
+		// enough bits for the valid filters
+		data := append(header, make([]byte, 16)...)
+		_, err := ReadBloomFilter(bytes.NewReader(data))
+		if tc.valid && err != nil {
+			t.Errorf("k=%d, m=%d: expected a valid filter, got %v", tc.k, tc.m, err)
+		} else if !tc.valid && err != ErrInvalidBloomFilter {
+			t.Errorf("k=%d, m=%d: expected ErrInvalidBloomFilter, got %v", tc.k, tc.m, err)
+		}
+	}
+	// new filters can always be read
+	if filter := NewBloomFilter(1, 1e-30); filter.k != maxBloomHashes {
+		t.Errorf("expected k=%d, got %d", maxBloomHashes, filter.k)
+	}
+}
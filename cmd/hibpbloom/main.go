@@ -0,0 +1,163 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Command hibpbloom builds a bloom filter from the password files of
+// haveibeenpwned.com. The filter can be loaded with goauth.LoadBloomFilter
+// and used as a goauth.BreachedPasswordChecker.
+//
+// The input is either a single file (-in) with lines of the form
+// "<SHA-1>:<count>" or a directory (-dir) with range files "<PREFIX>.txt"
+// that contain lines of the form "<SUFFIX>:<count>".
+//
+// Example:
+//
+//	hibpbloom -in pwned-passwords-sha1-ordered-by-hash.txt -p 0.001 -min-count 10 -out pwned.bloom
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/FabianWe/goauth"
+	log "github.com/sirupsen/logrus"
+)
+
+// inputFiles returns the files to read and the prefix of the hashes in these
+// files.
+func inputFiles(in, dir string) (map[string]string, error) {
+	res := make(map[string]string)
+	if in != "" {
+		res[in] = ""
+		return res, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range matches {
+		res[path] = strings.ToUpper(strings.TrimSuffix(filepath.Base(path), ".txt"))
+	}
+	return res, nil
+}
+
+// countLines counts the lines in all files that would be added.
+func countLines(files map[string]string, minCount int) (uint64, error) {
+	var res uint64
+	for path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			_, count, parseErr := goauth.ParseHIBPLine(scanner.Text())
+			if parseErr != nil {
+				f.Close()
+				return 0, parseErr
+			}
+			if count >= minCount {
+				res++
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return res, nil
+}
+
+// addFile adds all hashes from the file to the filter.
+func addFile(filter *goauth.BloomFilter, path, prefix string, minCount int) (uint64, error) {
+	var r io.Reader
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return filter.AddHIBP(r, prefix, minCount)
+}
+
+func main() {
+	in := flag.String("in", "", "HIBP file ordered by hash, \"-\" for stdin")
+	dir := flag.String("dir", "", "directory with HIBP range files")
+	out := flag.String("out", "pwned.bloom", "output file")
+	n := flag.Uint64("n", 0, "number of hashes, if 0 the input is read twice to count them (required for stdin)")
+	p := flag.Float64("p", 0.001, "false positive rate")
+	minCount := flag.Int("min-count", 1, "add only hashes that were found at least min-count times")
+	flag.Parse()
+
+	if (*in == "") == (*dir == "") {
+		log.Fatal("Exactly one of -in and -dir is required")
+	}
+	if *p <= 0 || *p >= 1 {
+		log.Fatal("The false positive rate must be between 0 and 1")
+	}
+	files, err := inputFiles(*in, *dir)
+	if err != nil {
+		log.WithError(err).Fatal("Can't find input files")
+	}
+	num := *n
+	if num == 0 {
+		if *in == "-" {
+			log.Fatal("-n is required when reading from stdin")
+		}
+		log.Info("Counting hashes")
+		if num, err = countLines(files, *minCount); err != nil {
+			log.WithError(err).Fatal("Can't count hashes")
+		}
+	}
+	log.Infof("Creating filter for %d hashes", num)
+	filter := goauth.NewBloomFilter(num, *p)
+	var added uint64
+	for path, prefix := range files {
+		fileAdded, addErr := addFile(filter, path, prefix, *minCount)
+		if addErr != nil {
+			log.WithError(addErr).Fatalf("Can't read %s", path)
+		}
+		added += fileAdded
+	}
+	outFile, err := os.Create(*out)
+	if err != nil {
+		log.WithError(err).Fatal("Can't create output file")
+	}
+	if _, err := filter.WriteTo(outFile); err != nil {
+		outFile.Close()
+		log.WithError(err).Fatal("Can't write filter")
+	}
+	if err := outFile.Close(); err != nil {
+		log.WithError(err).Fatal("Can't write filter")
+	}
+	log.Infof("Added %d hashes to %s", added, *out)
+}
@@ -0,0 +1,404 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// AsSessionHandlerContext returns h as a SessionHandlerContext.
+// If h already implements SessionHandlerContext it is returned directly,
+// otherwise it gets wrapped by an adapter that checks if the context is
+// already done before calling the method of h (without a context).
+// This way old-style handlers keep working with the context aware methods
+// of SessionController.
+//
+// New in version v0.6
+func AsSessionHandlerContext(h SessionHandler) SessionHandlerContext {
+	if ctxHandler, ok := h.(SessionHandlerContext); ok {
+		return ctxHandler
+	}
+	return sessionHandlerContextAdapter{SessionHandler: h}
+}
+
+// sessionHandlerContextAdapter wraps a SessionHandler and implements
+// SessionHandlerContext. The context is only checked before the wrapped
+// method is called.
+type sessionHandlerContextAdapter struct {
+	SessionHandler
+}
+
+func (a sessionHandlerContextAdapter) InitContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Init()
+}
+
+func (a sessionHandlerContextAdapter) GetDataContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.GetData(key)
+}
+
+func (a sessionHandlerContextAdapter) CreateEntryContext(ctx context.Context, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.CreateEntry(user, key, validDuration)
+}
+
+func (a sessionHandlerContextAdapter) DeleteEntriesForUserContext(ctx context.Context, user UserKeyType) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return a.DeleteEntriesForUser(user)
+}
+
+func (a sessionHandlerContextAdapter) DeleteInvalidKeysContext(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return a.DeleteInvalidKeys()
+}
+
+func (a sessionHandlerContextAdapter) DeleteKeyContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.DeleteKey(key)
+}
+
+// extendedSessionHandler is a SessionHandlerContext that implements all
+// optional session interfaces (with context).
+type extendedSessionHandler interface {
+	SessionHandlerContext
+	SessionEntryUpdaterContext
+	SessionLimiterContext
+	SessionListerContext
+}
+
+// asExtendedSessionHandler returns h as an extendedSessionHandler.
+// If h does not implement all optional interfaces it gets wrapped by
+// sessionHandlerFallback, this way the SessionController can use all methods
+// and the fallbacks are implemented in one place.
+func asExtendedSessionHandler(h SessionHandler) extendedSessionHandler {
+	if extHandler, ok := h.(extendedSessionHandler); ok {
+		return extHandler
+	}
+	return sessionHandlerFallback{SessionHandlerContext: AsSessionHandlerContext(h), handler: h}
+}
+
+// sessionHandlerFallback wraps a SessionHandler and implements the optional
+// session interfaces. Each method uses the context or the plain variant of
+// the wrapped handler if it implements the interface and a fallback
+// otherwise, see SessionEntryUpdater, SessionLimiter and SessionLister for a
+// description of the fallbacks.
+type sessionHandlerFallback struct {
+	SessionHandlerContext
+	handler SessionHandler
+}
+
+func (a sessionHandlerFallback) InsertEntry(key string, data *SessionKeyData) error {
+	return a.InsertEntryContext(context.Background(), key, data)
+}
+
+func (a sessionHandlerFallback) InsertEntryContext(ctx context.Context, key string, data *SessionKeyData) error {
+	if ctxHandler, ok := a.handler.(SessionEntryUpdaterContext); ok {
+		return ctxHandler.InsertEntryContext(ctx, key, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if updater, ok := a.handler.(SessionEntryUpdater); ok {
+		return updater.InsertEntry(key, data)
+	}
+	// CreateEntry would turn a pending session into a valid session
+	if data.Metadata.LoginMethod == PendingLoginMethod {
+		return ErrNotSupported
+	}
+	_, err := a.CreateEntryContext(ctx, data.User, key, data.ValidUntil.Sub(data.CreationTime))
+	return err
+}
+
+func (a sessionHandlerFallback) ExtendEntry(key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return a.ExtendEntryContext(context.Background(), key, validDuration)
+}
+
+func (a sessionHandlerFallback) ExtendEntryContext(ctx context.Context, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	if ctxHandler, ok := a.handler.(SessionEntryUpdaterContext); ok {
+		return ctxHandler.ExtendEntryContext(ctx, key, validDuration)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if updater, ok := a.handler.(SessionEntryUpdater); ok {
+		return updater.ExtendEntry(key, validDuration)
+	}
+	// the entry can't be extended, it stays valid as long as before
+	return a.GetDataContext(ctx, key)
+}
+
+func (a sessionHandlerFallback) TouchEntry(key string) (*SessionKeyData, error) {
+	return a.TouchEntryContext(context.Background(), key)
+}
+
+func (a sessionHandlerFallback) TouchEntryContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	if ctxHandler, ok := a.handler.(SessionEntryUpdaterContext); ok {
+		return ctxHandler.TouchEntryContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if updater, ok := a.handler.(SessionEntryUpdater); ok {
+		return updater.TouchEntry(key)
+	}
+	// the last activity can't be updated
+	return a.GetDataContext(ctx, key)
+}
+
+func (a sessionHandlerFallback) InsertEntryLimited(key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	return a.InsertEntryLimitedContext(context.Background(), key, data, maxSessions, policy)
+}
+
+func (a sessionHandlerFallback) InsertEntryLimitedContext(ctx context.Context, key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	if ctxHandler, ok := a.handler.(SessionLimiterContext); ok {
+		return ctxHandler.InsertEntryLimitedContext(ctx, key, data, maxSessions, policy)
+	}
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	if limiter, ok := a.handler.(SessionLimiter); ok {
+		return limiter.InsertEntryLimited(key, data, maxSessions, policy)
+	}
+	if maxSessions <= 0 {
+		return 0, a.InsertEntryContext(ctx, key, data)
+	}
+	// count the sessions with ListEntriesForUser, this is not atomic
+	entries, err := a.ListEntriesForUserContext(ctx, data.User)
+	if err != nil {
+		return -1, err
+	}
+	now := CurrentTime()
+	userEntries := make([]*SessionEntry, 0, len(entries))
+	for _, entry := range entries {
+		if KeyValid(now, entry.ValidUntil) && entry.Metadata.LoginMethod != PendingLoginMethod {
+			userEntries = append(userEntries, entry)
+		}
+	}
+	var removed int64 = 0
+	if len(userEntries) >= maxSessions {
+		if policy != EvictOldestSession {
+			return 0, ErrTooManySessions
+		}
+		sort.Slice(userEntries, func(i, j int) bool {
+			return userEntries[i].CreationTime.Before(userEntries[j].CreationTime)
+		})
+		for _, entry := range userEntries[:len(userEntries)-maxSessions+1] {
+			if err := a.DeleteEntryByIDContext(ctx, data.User, entry.ID); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, a.InsertEntryContext(ctx, key, data)
+}
+
+func (a sessionHandlerFallback) ListEntriesForUser(user UserKeyType) ([]*SessionEntry, error) {
+	return a.ListEntriesForUserContext(context.Background(), user)
+}
+
+func (a sessionHandlerFallback) ListEntriesForUserContext(ctx context.Context, user UserKeyType) ([]*SessionEntry, error) {
+	if ctxHandler, ok := a.handler.(SessionListerContext); ok {
+		return ctxHandler.ListEntriesForUserContext(ctx, user)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if lister, ok := a.handler.(SessionLister); ok {
+		return lister.ListEntriesForUser(user)
+	}
+	return nil, ErrNotSupported
+}
+
+func (a sessionHandlerFallback) DeleteEntryByID(user UserKeyType, id string) error {
+	return a.DeleteEntryByIDContext(context.Background(), user, id)
+}
+
+func (a sessionHandlerFallback) DeleteEntryByIDContext(ctx context.Context, user UserKeyType, id string) error {
+	if ctxHandler, ok := a.handler.(SessionListerContext); ok {
+		return ctxHandler.DeleteEntryByIDContext(ctx, user, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if lister, ok := a.handler.(SessionLister); ok {
+		return lister.DeleteEntryByID(user, id)
+	}
+	return ErrNotSupported
+}
+
+func (a sessionHandlerFallback) DeleteOtherEntriesForUser(user UserKeyType, key string) (int64, error) {
+	return a.DeleteOtherEntriesForUserContext(context.Background(), user, key)
+}
+
+func (a sessionHandlerFallback) DeleteOtherEntriesForUserContext(ctx context.Context, user UserKeyType, key string) (int64, error) {
+	if ctxHandler, ok := a.handler.(SessionListerContext); ok {
+		return ctxHandler.DeleteOtherEntriesForUserContext(ctx, user, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	if lister, ok := a.handler.(SessionLister); ok {
+		return lister.DeleteOtherEntriesForUser(user, key)
+	}
+	return -1, ErrNotSupported
+}
+
+// AsUserHandlerContext returns h as a UserHandlerContext.
+// If h already implements UserHandlerContext it is returned directly,
+// otherwise it gets wrapped by an adapter that checks if the context is
+// already done before calling the method of h (without a context).
+//
+// New in version v0.6
+func AsUserHandlerContext(h UserHandler) UserHandlerContext {
+	if ctxHandler, ok := h.(UserHandlerContext); ok {
+		return ctxHandler
+	}
+	return userHandlerContextAdapter{UserHandler: h}
+}
+
+// userHandlerContextAdapter wraps a UserHandler and implements
+// UserHandlerContext. The context is only checked before the wrapped
+// method is called.
+type userHandlerContextAdapter struct {
+	UserHandler
+}
+
+func (a userHandlerContextAdapter) InitContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Init()
+}
+
+func (a userHandlerContextAdapter) InsertContext(ctx context.Context, userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return NoUserID, err
+	}
+	return a.Insert(userName, firstName, lastName, email, plainPW)
+}
+
+func (a userHandlerContextAdapter) ValidateContext(ctx context.Context, userName string, cleartextPwCheck []byte) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return NoUserID, err
+	}
+	return a.Validate(userName, cleartextPwCheck)
+}
+
+func (a userHandlerContextAdapter) UpdatePasswordContext(ctx context.Context, username string, plainPW []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.UpdatePassword(username, plainPW)
+}
+
+func (a userHandlerContextAdapter) ListUsersContext(ctx context.Context) (map[uint64]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.ListUsers()
+}
+
+func (a userHandlerContextAdapter) GetUserNameContext(ctx context.Context, id uint64) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return a.GetUserName(id)
+}
+
+func (a userHandlerContextAdapter) GetUserIDContext(ctx context.Context, userName string) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return NoUserID, err
+	}
+	return a.GetUserID(userName)
+}
+
+func (a userHandlerContextAdapter) DeleteUserContext(ctx context.Context, username string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.DeleteUser(username)
+}
+
+func (a userHandlerContextAdapter) GetUserBaseInfoContext(ctx context.Context, userName string) (*BaseUserInformation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.GetUserBaseInfo(userName)
+}
+
+func (a userHandlerContextAdapter) SetActiveContext(ctx context.Context, userName string, active bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.SetActive(userName, active)
+}
+
+func (a userHandlerContextAdapter) SetEmailVerifiedContext(ctx context.Context, userName string, verified bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.SetEmailVerified(userName, verified)
+}
+
+func (a userHandlerContextAdapter) VerifyEmailContext(ctx context.Context, userName, email string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.VerifyEmail(userName, email)
+}
+
+func (a userHandlerContextAdapter) UpdateUserInfoContext(ctx context.Context, userName string, update *UserInfoUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.UpdateUserInfo(userName, update)
+}
+
+func (a userHandlerContextAdapter) RenameUserContext(ctx context.Context, oldName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.RenameUser(oldName, newName)
+}
+
+func (a userHandlerContextAdapter) ListUsersPageContext(ctx context.Context, filter *UserFilter, sort UserSort, limit int, cursor string) (*UserPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.ListUsersPage(filter, sort, limit, cursor)
+}
@@ -0,0 +1,445 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidCredentials is the error that is passed to the failure hook of a
+// LoginHandler if the user doesn't exist or the password is wrong.
+//
+// New in version v0.6
+var ErrInvalidCredentials = errors.New("Invalid username or password.")
+
+// PasswordLoginMethod is the LoginMethod stored in the metadata of sessions
+// created by LoginHandler.
+//
+// New in version v0.6
+const PasswordLoginMethod = "password"
+
+// maxCredentialsSize is the maximal size of a JSON body with credentials.
+const maxCredentialsSize = 1 << 16
+
+// Credentials are the credentials sent to a LoginHandler.
+// For JSON requests the body must look like
+// {"username": "...", "password": "..."}.
+//
+// New in version v0.6
+type Credentials struct {
+	UserName string `json:"username"`
+	Password string `json:"password"`
+}
+
+// isJSONRequest returns true if the content type of the request is JSON.
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// wantsJSON returns true if the client sent JSON or accepts JSON.
+func wantsJSON(r *http.Request) bool {
+	return isJSONRequest(r) || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeJSON writes the JSON encoding of v with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("goauth: Can't write JSON response")
+	}
+}
+
+// jsonError is the JSON response in case of an error.
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+// LoginHandler is a http.Handler that logs in users: It reads the
+// credentials from a POST request, either as form values or as JSON (if the
+// content type is application/json), validates them with the UserHandler,
+// refuses users that are not active and creates and saves a new auth session
+// with the SessionController.
+//
+// If the client sent or accepts JSON, or if SuccessURL / FailureURL are
+// empty, the response is JSON: On success
+// {"id": ..., "username": "...", "valid_until": "..."},
+// otherwise {"error": "..."} with an appropriate status code.
+// Otherwise the client is redirected to SuccessURL / FailureURL.
+//
+// If TOTP is set and enabled for the user only a pending session is
+// created (see CreatePendingSession), the response is
+// {"id": ..., "username": "...", "second_factor_required": true} or a
+// redirect to SecondFactorURL. The user then sends the code to a
+// TOTPLoginHandler.
+//
+// New in version v0.6
+type LoginHandler struct {
+	// Users is used to validate the credentials.
+	Users UserHandler
+
+	// Sessions and Store are used to create the auth session.
+	Sessions *SessionController
+	Store    sessions.Store
+
+	// ValidDuration is the duration a new session is valid.
+	ValidDuration time.Duration
+
+	// UserNameField and PasswordField are the names of the form fields,
+	// they default to "username" and "password".
+	UserNameField, PasswordField string
+
+	// SuccessURL and FailureURL are the URLs form requests are redirected to.
+	SuccessURL, FailureURL string
+
+	// Throttler is used to limit the number of failed logins if not nil.
+	// If a login is not allowed the response is 429 Too Many Requests with
+	// a Retry-After header.
+	Throttler *LoginThrottler
+
+	// TOTP is used to check if a second factor is required, see above.
+	TOTP *TOTPManager
+
+	// PendingDuration is the duration a pending session is valid, defaults
+	// to DefaultPendingDuration.
+	PendingDuration time.Duration
+
+	// SecondFactorURL is the URL form requests are redirected to if a
+	// second factor is required.
+	SecondFactorURL string
+
+	// OnSecondFactor is called after the pending session was created and
+	// saved. If it is not nil it must write the response.
+	OnSecondFactor func(w http.ResponseWriter, r *http.Request, user *BaseUserInformation)
+
+	// OnSuccess is called after the session was created and saved. If it is
+	// not nil it must write the response.
+	OnSuccess func(w http.ResponseWriter, r *http.Request, user *BaseUserInformation, data *SessionKeyData)
+
+	// OnFailure is called if the login failed. err is either
+	// ErrInvalidCredentials, ErrUserInactive, ErrEmailNotVerified,
+	// ErrTooManySessions, a *ThrottleError or any other error that occurred.
+	// If it is not nil it must write the response.
+	OnFailure func(w http.ResponseWriter, r *http.Request, userName string, err error)
+}
+
+// NewLoginHandler returns a new LoginHandler with the default field names.
+//
+// New in version v0.6
+func NewLoginHandler(users UserHandler, c *SessionController, store sessions.Store, validDuration time.Duration) *LoginHandler {
+	return &LoginHandler{Users: users, Sessions: c, Store: store,
+		ValidDuration: validDuration, UserNameField: "username", PasswordField: "password"}
+}
+
+// credentials reads the credentials from the request.
+func (h *LoginHandler) credentials(w http.ResponseWriter, r *http.Request) (*Credentials, error) {
+	if isJSONRequest(r) {
+		var cred Credentials
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCredentialsSize)).Decode(&cred); err != nil {
+			return nil, err
+		}
+		return &cred, nil
+	}
+	userField, pwField := h.UserNameField, h.PasswordField
+	if userField == "" {
+		userField = "username"
+	}
+	if pwField == "" {
+		pwField = "password"
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	return &Credentials{UserName: r.PostForm.Get(userField), Password: r.PostForm.Get(pwField)}, nil
+}
+
+// login validates the credentials and creates the session. pending is true
+// if a pending session was created because a second factor is required.
+func (h *LoginHandler) login(r *http.Request, cred *Credentials) (info *BaseUserInformation, data *SessionKeyData, session *sessions.Session, pending bool, err error) {
+	ctx := r.Context()
+	users := AsUserHandlerContext(h.Users)
+	var id uint64
+	if h.Throttler != nil {
+		id, err = h.Throttler.Validate(ctx, users, cred.UserName, MetadataFromRequest(r).RemoteAddr, []byte(cred.Password))
+	} else {
+		id, err = users.ValidateContext(ctx, cred.UserName, []byte(cred.Password))
+	}
+	switch {
+	case err == ErrUserNotFound:
+		return nil, nil, nil, false, ErrInvalidCredentials
+	case err != nil:
+		return nil, nil, nil, false, err
+	case id == NoUserID:
+		return nil, nil, nil, false, ErrInvalidCredentials
+	}
+	info, err = users.GetUserBaseInfoContext(ctx, cred.UserName)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	if !info.IsActive {
+		return info, nil, nil, false, ErrUserInactive
+	}
+	deleteOldSessionKey(r, h.Sessions, h.Store)
+	if h.TOTP != nil {
+		enabled, totpErr := h.TOTP.Enabled(ctx, id)
+		if totpErr != nil {
+			return info, nil, nil, false, totpErr
+		}
+		if enabled {
+			data, session, err = h.Sessions.CreatePendingSession(r, h.Store, id, h.PendingDuration)
+			if err != nil {
+				return info, nil, nil, false, err
+			}
+			return info, data, session, true, nil
+		}
+	}
+	meta := MetadataFromRequest(r)
+	meta.LoginMethod = PasswordLoginMethod
+	data, _, session, err = h.Sessions.CreateAuthSessionWithMetadata(r, h.Store, id, h.ValidDuration, meta)
+	if err != nil {
+		return info, nil, nil, false, err
+	}
+	return info, data, session, false, nil
+}
+
+// deleteOldSessionKey deletes the key of the current auth session (if there
+// is one), a new key is used for the new session.
+func deleteOldSessionKey(r *http.Request, c *SessionController, store sessions.Store) {
+	oldSession, getErr := c.GetSession(r, store)
+	if getErr != nil {
+		return
+	}
+	if oldKey, keyErr := c.GetKey(oldSession); keyErr == nil {
+		if delErr := c.contextHandler().DeleteKeyContext(r.Context(), oldKey); delErr != nil {
+			log.WithError(delErr).Warn("goauth: Can't delete old session key")
+		}
+	}
+}
+
+func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	cred, err := h.credentials(w, r)
+	if err != nil {
+		h.failure(w, r, "", http.StatusBadRequest, err)
+		return
+	}
+	info, data, session, pending, err := h.login(r, cred)
+	if err != nil {
+		h.failure(w, r, cred.UserName, loginErrorStatus(err), err)
+		return
+	}
+	if err := session.Save(r, w); err != nil {
+		h.failure(w, r, cred.UserName, http.StatusInternalServerError, err)
+		return
+	}
+	if pending {
+		h.secondFactor(w, r, info)
+		return
+	}
+	if h.OnSuccess != nil {
+		h.OnSuccess(w, r, info, data)
+		return
+	}
+	writeLoginSuccess(w, r, h.SuccessURL, info, data)
+}
+
+// secondFactor calls the second factor hook or writes the default response.
+func (h *LoginHandler) secondFactor(w http.ResponseWriter, r *http.Request, info *BaseUserInformation) {
+	if h.OnSecondFactor != nil {
+		h.OnSecondFactor(w, r, info)
+		return
+	}
+	writeSecondFactor(w, r, h.SecondFactorURL, info)
+}
+
+// writeSecondFactor writes the default response after a pending session
+// was created.
+func writeSecondFactor(w http.ResponseWriter, r *http.Request, secondFactorURL string, info *BaseUserInformation) {
+	if secondFactorURL != "" && !wantsJSON(r) {
+		http.Redirect(w, r, secondFactorURL, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ID                   uint64 `json:"id"`
+		UserName             string `json:"username"`
+		SecondFactorRequired bool   `json:"second_factor_required"`
+	}{info.ID, info.UserName, true})
+}
+
+// writeLoginSuccess writes the default response after a successful login.
+func writeLoginSuccess(w http.ResponseWriter, r *http.Request, successURL string, info *BaseUserInformation, data *SessionKeyData) {
+	if successURL != "" && !wantsJSON(r) {
+		http.Redirect(w, r, successURL, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ID         uint64    `json:"id"`
+		UserName   string    `json:"username"`
+		ValidUntil time.Time `json:"valid_until"`
+	}{info.ID, info.UserName, data.ValidUntil})
+}
+
+// loginErrorStatus returns the status code for an error returned by login.
+func loginErrorStatus(err error) int {
+	if _, ok := err.(*ThrottleError); ok {
+		return http.StatusTooManyRequests
+	}
+	if IsAuthError(err) {
+		// no valid pending session
+		return http.StatusUnauthorized
+	}
+	switch err {
+	case ErrInvalidCredentials, ErrInvalidTOTPCode, ErrTOTPNotEnrolled, ErrInvalidRecoveryCode, ErrInvalidToken:
+		return http.StatusUnauthorized
+	case ErrUserInactive, ErrEmailNotVerified:
+		return http.StatusForbidden
+	case ErrTooManySessions:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// failure calls the failure hook or writes the default response.
+func (h *LoginHandler) failure(w http.ResponseWriter, r *http.Request, userName string, status int, err error) {
+	setRetryAfter(w, err)
+	if h.OnFailure != nil {
+		h.OnFailure(w, r, userName, err)
+		return
+	}
+	writeLoginFailure(w, r, h.FailureURL, status, err)
+}
+
+// setRetryAfter sets the Retry-After header if err is a *ThrottleError.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if throttleErr, ok := err.(*ThrottleError); ok {
+		// round up to full seconds
+		seconds := int64((throttleErr.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+}
+
+// writeLoginFailure writes the default response after a failed login,
+// internal errors are logged and not sent to the client.
+func writeLoginFailure(w http.ResponseWriter, r *http.Request, failureURL string, status int, err error) {
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		log.WithError(err).Error("goauth: Login failed")
+		msg = http.StatusText(status)
+	}
+	if failureURL != "" && !wantsJSON(r) {
+		http.Redirect(w, r, failureURL, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, status, jsonError{msg})
+}
+
+// LogoutHandler is a http.Handler that ends the auth session of a user, see
+// EndSession. Only POST requests are accepted, this way a logout can't be
+// triggered by a simple link on another page.
+//
+// On success the client is redirected to RedirectURL, if it is empty or the
+// client accepts JSON the response is {"success": true}.
+//
+// New in version v0.6
+type LogoutHandler struct {
+	Sessions *SessionController
+	Store    sessions.Store
+
+	// RedirectURL is the URL the client is redirected to after the logout.
+	RedirectURL string
+
+	// OnSuccess is called after the session was removed. If it is not nil it
+	// must write the response.
+	OnSuccess func(w http.ResponseWriter, r *http.Request)
+
+	// OnFailure is called if the session could not be removed. If it is not
+	// nil it must write the response.
+	OnFailure func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// NewLogoutHandler returns a new LogoutHandler.
+//
+// New in version v0.6
+func NewLogoutHandler(c *SessionController, store sessions.Store, redirectURL string) *LogoutHandler {
+	return &LogoutHandler{Sessions: c, Store: store, RedirectURL: redirectURL}
+}
+
+func (h *LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.logout(w, r); err != nil {
+		if h.OnFailure != nil {
+			h.OnFailure(w, r, err)
+			return
+		}
+		log.WithError(err).Error("goauth: Logout failed")
+		writeJSON(w, http.StatusInternalServerError, jsonError{http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+	if h.OnSuccess != nil {
+		h.OnSuccess(w, r)
+		return
+	}
+	if h.RedirectURL != "" && !wantsJSON(r) {
+		http.Redirect(w, r, h.RedirectURL, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Success bool `json:"success"`
+	}{true})
+}
+
+// logout deletes the key and removes the cookie.
+func (h *LogoutHandler) logout(w http.ResponseWriter, r *http.Request) error {
+	// if the cookie can't be decoded there is nothing to delete
+	if err := h.Sessions.EndSession(r, h.Store); err != nil && !IsAuthError(err) {
+		return err
+	}
+	// EndSession doesn't save the session, gorilla returns a new session if
+	// the cookie can't be decoded
+	session, err := h.Store.Get(r, h.Sessions.SessionName)
+	if session == nil {
+		return err
+	}
+	delete(session.Values, SessionKey)
+	session.Options.MaxAge = -1
+	return session.Save(r, w)
+}
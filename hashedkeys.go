@@ -0,0 +1,250 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HashedKeySessionHandler is a SessionHandler that wraps another handler and
+// only passes a hash of the session keys to it. This way the storage never
+// contains the raw keys (the keys still stored in the cookie of the user):
+// Someone with read access to your database can't use the stored keys to
+// hijack sessions.
+//
+// The hash is HMAC-SHA256 with Secret as the key, if Secret is empty plain
+// SHA-256 is used. The hash is stored hex encoded, so it has a length of 64
+// which is the DefaultKeyLength, so the SQL tables don't need to be changed.
+//
+// To use it simply wrap your handler:
+//
+//	controller := NewSessionController(NewHashedKeySessionHandler(handler, secret))
+//
+// Note that the secret must not change, otherwise all sessions become invalid.
+//
+// Migration: If you already have sessions stored with the raw key you can
+// either simply delete them (all users have to login again) or set
+// MigrateUnhashed to true. In this case GetData will also lookup the raw key
+// if the hashed key was not found. If it was found the entry gets stored with
+// the hashed key and the raw entry is deleted. Once all old sessions are
+// migrated or expired you should set it to false again because it requires an
+// additional lookup for unknown keys.
+// Keys that look like a stored hash (64 hex characters) are never looked up
+// as raw keys: Otherwise someone who knows a stored hash (for example from a
+// database dump) could use the hash itself as the key.
+//
+// The handler implements the optional session interfaces (SessionEntryUpdater,
+// SessionLimiter and SessionLister), if the parent doesn't implement them the
+// fallbacks described there are used.
+//
+// New in version v0.6
+type HashedKeySessionHandler struct {
+	// Parent is the handler that stores the hashed keys.
+	Parent SessionHandler
+
+	// Secret is the key for the HMAC, if empty SHA-256 is used.
+	Secret []byte
+
+	// MigrateUnhashed enables the lookup of raw keys, see documentation of
+	// HashedKeySessionHandler. Defaults to false.
+	MigrateUnhashed bool
+}
+
+// NewHashedKeySessionHandler returns a new HashedKeySessionHandler wrapping
+// parent. secret may be nil, in this case SHA-256 is used instead of an HMAC.
+func NewHashedKeySessionHandler(parent SessionHandler, secret []byte) *HashedKeySessionHandler {
+	return &HashedKeySessionHandler{Parent: parent, Secret: secret}
+}
+
+// HashKey returns the hash of the key that gets passed to the parent.
+func (handler *HashedKeySessionHandler) HashKey(key string) string {
+	if len(handler.Secret) == 0 {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, handler.Secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// looksLikeHash returns true if key has the format of a stored hash (64
+// lowercase hex characters). Keys generated by GenRandomBase64 use the
+// base64 alphabet, the probability that such a key consists of hex
+// characters only is negligible (2^-128 for the default length).
+func looksLikeHash(key string) bool {
+	if len(key) != 2*sha256.Size {
+		return false
+	}
+	for _, r := range key {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parent returns the Parent with the optional session interfaces, see
+// asExtendedSessionHandler.
+func (handler *HashedKeySessionHandler) parent() extendedSessionHandler {
+	return asExtendedSessionHandler(handler.Parent)
+}
+
+func (handler *HashedKeySessionHandler) Init() error {
+	return handler.InitContext(context.Background())
+}
+
+func (handler *HashedKeySessionHandler) InitContext(ctx context.Context) error {
+	return handler.parent().InitContext(ctx)
+}
+
+func (handler *HashedKeySessionHandler) GetData(key string) (*SessionKeyData, error) {
+	return handler.GetDataContext(context.Background(), key)
+}
+
+// GetDataContext looks up the hashed key. If MigrateUnhashed is true and the
+// hashed key was not found it also looks up the raw key and migrates it
+// (unless the key looks like a stored hash).
+func (handler *HashedKeySessionHandler) GetDataContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	parent := handler.parent()
+	data, err := parent.GetDataContext(ctx, handler.HashKey(key))
+	if err != ErrKeyNotFound || !handler.MigrateUnhashed || looksLikeHash(key) {
+		return data, err
+	}
+	// try the raw key
+	data, err = parent.GetDataContext(ctx, key)
+	if err != nil {
+		return data, err
+	}
+	// migrate the entry, if something goes wrong we still have a valid entry
+	if insertErr := parent.InsertEntryContext(ctx, handler.HashKey(key), data); insertErr != nil {
+		log.WithError(insertErr).Warn("goauth: Can't migrate unhashed session key")
+		return data, nil
+	}
+	if delErr := parent.DeleteKeyContext(ctx, key); delErr != nil {
+		log.WithError(delErr).Warn("goauth: Can't delete unhashed session key")
+	}
+	return data, nil
+}
+
+func (handler *HashedKeySessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return handler.CreateEntryContext(context.Background(), user, key, validDuration)
+}
+
+func (handler *HashedKeySessionHandler) CreateEntryContext(ctx context.Context, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return handler.parent().CreateEntryContext(ctx, user, handler.HashKey(key), validDuration)
+}
+
+func (handler *HashedKeySessionHandler) InsertEntry(key string, data *SessionKeyData) error {
+	return handler.InsertEntryContext(context.Background(), key, data)
+}
+
+func (handler *HashedKeySessionHandler) InsertEntryContext(ctx context.Context, key string, data *SessionKeyData) error {
+	return handler.parent().InsertEntryContext(ctx, handler.HashKey(key), data)
+}
+
+func (handler *HashedKeySessionHandler) InsertEntryLimited(key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	return handler.InsertEntryLimitedContext(context.Background(), key, data, maxSessions, policy)
+}
+
+func (handler *HashedKeySessionHandler) InsertEntryLimitedContext(ctx context.Context, key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	return handler.parent().InsertEntryLimitedContext(ctx, handler.HashKey(key), data, maxSessions, policy)
+}
+
+func (handler *HashedKeySessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	return handler.DeleteEntriesForUserContext(context.Background(), user)
+}
+
+func (handler *HashedKeySessionHandler) DeleteEntriesForUserContext(ctx context.Context, user UserKeyType) (int64, error) {
+	return handler.parent().DeleteEntriesForUserContext(ctx, user)
+}
+
+func (handler *HashedKeySessionHandler) DeleteInvalidKeys() (int64, error) {
+	return handler.DeleteInvalidKeysContext(context.Background())
+}
+
+func (handler *HashedKeySessionHandler) DeleteInvalidKeysContext(ctx context.Context) (int64, error) {
+	return handler.parent().DeleteInvalidKeysContext(ctx)
+}
+
+func (handler *HashedKeySessionHandler) DeleteKey(key string) error {
+	return handler.DeleteKeyContext(context.Background(), key)
+}
+
+// DeleteKeyContext deletes the hashed key. If MigrateUnhashed is true it also
+// deletes the raw key (unless the key looks like a stored hash).
+func (handler *HashedKeySessionHandler) DeleteKeyContext(ctx context.Context, key string) error {
+	parent := handler.parent()
+	if err := parent.DeleteKeyContext(ctx, handler.HashKey(key)); err != nil {
+		return err
+	}
+	if handler.MigrateUnhashed && !looksLikeHash(key) {
+		return parent.DeleteKeyContext(ctx, key)
+	}
+	return nil
+}
+
+func (handler *HashedKeySessionHandler) ExtendEntry(key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return handler.ExtendEntryContext(context.Background(), key, validDuration)
+}
+
+func (handler *HashedKeySessionHandler) ExtendEntryContext(ctx context.Context, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return handler.parent().ExtendEntryContext(ctx, handler.HashKey(key), validDuration)
+}
+
+func (handler *HashedKeySessionHandler) TouchEntry(key string) (*SessionKeyData, error) {
+	return handler.TouchEntryContext(context.Background(), key)
+}
+
+func (handler *HashedKeySessionHandler) TouchEntryContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	return handler.parent().TouchEntryContext(ctx, handler.HashKey(key))
+}
+
+func (handler *HashedKeySessionHandler) ListEntriesForUser(user UserKeyType) ([]*SessionEntry, error) {
+	return handler.ListEntriesForUserContext(context.Background(), user)
+}
+
+func (handler *HashedKeySessionHandler) ListEntriesForUserContext(ctx context.Context, user UserKeyType) ([]*SessionEntry, error) {
+	return handler.parent().ListEntriesForUserContext(ctx, user)
+}
+
+func (handler *HashedKeySessionHandler) DeleteEntryByID(user UserKeyType, id string) error {
+	return handler.DeleteEntryByIDContext(context.Background(), user, id)
+}
+
+func (handler *HashedKeySessionHandler) DeleteEntryByIDContext(ctx context.Context, user UserKeyType, id string) error {
+	return handler.parent().DeleteEntryByIDContext(ctx, user, id)
+}
+
+func (handler *HashedKeySessionHandler) DeleteOtherEntriesForUser(user UserKeyType, key string) (int64, error) {
+	return handler.DeleteOtherEntriesForUserContext(context.Background(), user, key)
+}
+
+func (handler *HashedKeySessionHandler) DeleteOtherEntriesForUserContext(ctx context.Context, user UserKeyType, key string) (int64, error) {
+	return handler.parent().DeleteOtherEntriesForUserContext(ctx, user, handler.HashKey(key))
+}
@@ -23,7 +23,9 @@
 package goauth
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 )
@@ -45,10 +47,21 @@ func NewInMemoryController() *SessionController {
 }
 
 func (h *InMemoryHandler) Init() error {
-	return nil
+	return h.InitContext(context.Background())
+}
+
+func (h *InMemoryHandler) InitContext(ctx context.Context) error {
+	return ctx.Err()
 }
 
 func (h *InMemoryHandler) GetData(key string) (*SessionKeyData, error) {
+	return h.GetDataContext(context.Background(), key)
+}
+
+func (h *InMemoryHandler) GetDataContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	h.mutex.RLock()
 	value, ok := h.keys[key]
 	h.mutex.RUnlock()
@@ -60,18 +73,85 @@ func (h *InMemoryHandler) GetData(key string) (*SessionKeyData, error) {
 }
 
 func (h *InMemoryHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return h.CreateEntryContext(context.Background(), user, key, validDuration)
+}
+
+func (h *InMemoryHandler) CreateEntryContext(ctx context.Context, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	data := CurrentTimeKeyData(user, validDuration)
+	if err := h.InsertEntryContext(ctx, key, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (h *InMemoryHandler) InsertEntry(key string, data *SessionKeyData) error {
+	return h.InsertEntryContext(context.Background(), key, data)
+}
+
+func (h *InMemoryHandler) InsertEntryContext(ctx context.Context, key string, data *SessionKeyData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	h.mutex.Lock()
 	if _, hasEntry := h.keys[key]; hasEntry {
 		h.mutex.Unlock()
-		return nil, errors.New("Key already exists")
+		return errors.New("Key already exists")
 	}
-	data := CurrentTimeKeyData(user, validDuration)
-	h.keys[key] = data
+	// store a copy, data might be changed by the caller
+	copied := *data
+	h.keys[key] = &copied
 	h.mutex.Unlock()
-	return data, nil
+	return nil
+}
+
+func (h *InMemoryHandler) InsertEntryLimited(key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	return h.InsertEntryLimitedContext(context.Background(), key, data, maxSessions, policy)
+}
+
+func (h *InMemoryHandler) InsertEntryLimitedContext(ctx context.Context, key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	now := CurrentTime()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, hasEntry := h.keys[key]; hasEntry {
+		return -1, errors.New("Key already exists")
+	}
+	// collect all valid sessions of the user, pending sessions don't count
+	userKeys := make([]string, 0)
+	for otherKey, value := range h.keys {
+		if value.User == data.User && KeyValid(now, value.ValidUntil) &&
+			value.Metadata.LoginMethod != PendingLoginMethod {
+			userKeys = append(userKeys, otherKey)
+		}
+	}
+	var removed int64 = 0
+	if maxSessions > 0 && len(userKeys) >= maxSessions {
+		if policy != EvictOldestSession {
+			return 0, ErrTooManySessions
+		}
+		sort.Slice(userKeys, func(i, j int) bool {
+			return h.keys[userKeys[i]].CreationTime.Before(h.keys[userKeys[j]].CreationTime)
+		})
+		for _, otherKey := range userKeys[:len(userKeys)-maxSessions+1] {
+			delete(h.keys, otherKey)
+			removed++
+		}
+	}
+	copied := *data
+	h.keys[key] = &copied
+	return removed, nil
 }
 
 func (h *InMemoryHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	return h.DeleteEntriesForUserContext(context.Background(), user)
+}
+
+func (h *InMemoryHandler) DeleteEntriesForUserContext(ctx context.Context, user UserKeyType) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
 	var removed int64 = 0
 	h.mutex.Lock()
 	for key, value := range h.keys {
@@ -86,6 +166,13 @@ func (h *InMemoryHandler) DeleteEntriesForUser(user UserKeyType) (int64, error)
 }
 
 func (h *InMemoryHandler) DeleteInvalidKeys() (int64, error) {
+	return h.DeleteInvalidKeysContext(context.Background())
+}
+
+func (h *InMemoryHandler) DeleteInvalidKeysContext(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
 	var removed int64 = 0
 	now := CurrentTime()
 	h.mutex.Lock()
@@ -100,8 +187,115 @@ func (h *InMemoryHandler) DeleteInvalidKeys() (int64, error) {
 }
 
 func (h *InMemoryHandler) DeleteKey(key string) error {
+	return h.DeleteKeyContext(context.Background(), key)
+}
+
+func (h *InMemoryHandler) DeleteKeyContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	h.mutex.Lock()
 	delete(h.keys, key)
 	h.mutex.Unlock()
 	return nil
 }
+
+func (h *InMemoryHandler) ExtendEntry(key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return h.ExtendEntryContext(context.Background(), key, validDuration)
+}
+
+func (h *InMemoryHandler) ExtendEntryContext(ctx context.Context, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	value, ok := h.keys[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	// don't modify the old value, it might be used somewhere else
+	data := *value
+	now := CurrentTime()
+	data.ValidUntil = now.Add(validDuration)
+	data.LastActivity = now
+	h.keys[key] = &data
+	return &data, nil
+}
+
+func (h *InMemoryHandler) TouchEntry(key string) (*SessionKeyData, error) {
+	return h.TouchEntryContext(context.Background(), key)
+}
+
+func (h *InMemoryHandler) TouchEntryContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	value, ok := h.keys[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	data := *value
+	data.LastActivity = CurrentTime()
+	h.keys[key] = &data
+	return &data, nil
+}
+
+func (h *InMemoryHandler) ListEntriesForUser(user UserKeyType) ([]*SessionEntry, error) {
+	return h.ListEntriesForUserContext(context.Background(), user)
+}
+
+func (h *InMemoryHandler) ListEntriesForUserContext(ctx context.Context, user UserKeyType) ([]*SessionEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res := make([]*SessionEntry, 0)
+	h.mutex.RLock()
+	for key, value := range h.keys {
+		if value.User == user {
+			res = append(res, &SessionEntry{ID: SessionEntryID(key), SessionKeyData: value})
+		}
+	}
+	h.mutex.RUnlock()
+	return res, nil
+}
+
+func (h *InMemoryHandler) DeleteEntryByID(user UserKeyType, id string) error {
+	return h.DeleteEntryByIDContext(context.Background(), user, id)
+}
+
+func (h *InMemoryHandler) DeleteEntryByIDContext(ctx context.Context, user UserKeyType, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	for key, value := range h.keys {
+		if value.User == user && SessionEntryID(key) == id {
+			delete(h.keys, key)
+		}
+	}
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *InMemoryHandler) DeleteOtherEntriesForUser(user UserKeyType, key string) (int64, error) {
+	return h.DeleteOtherEntriesForUserContext(context.Background(), user, key)
+}
+
+func (h *InMemoryHandler) DeleteOtherEntriesForUserContext(ctx context.Context, user UserKeyType, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	var removed int64 = 0
+	h.mutex.Lock()
+	for otherKey, value := range h.keys {
+		if value.User == user && otherKey != key {
+			delete(h.keys, otherKey)
+			removed++
+		}
+	}
+	h.mutex.Unlock()
+	return removed, nil
+}
@@ -0,0 +1,573 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// MagicLinkLoginMethod is the LoginMethod stored in the metadata of
+// sessions created by MagicLinkLoginHandler.
+//
+// New in version v0.6
+const MagicLinkLoginMethod = "magic-link"
+
+// DefaultMagicLinkDuration is the default time a login link is valid.
+//
+// New in version v0.6
+const DefaultMagicLinkDuration = 15 * time.Minute
+
+// DefaultMagicLinkMaxPending is the default number of login links that are
+// sent at the same time by MagicLinkRequestHandler.
+//
+// New in version v0.6
+const DefaultMagicLinkMaxPending = 100
+
+// DefaultMagicLinkSubject is the default subject of login link mails.
+//
+// New in version v0.6
+const DefaultMagicLinkSubject = "Your login link"
+
+// DefaultMagicLinkTemplate is the default template of the body of login
+// link mails, it is executed with a *MagicLinkMailData.
+//
+// New in version v0.6
+var DefaultMagicLinkTemplate = template.Must(template.New("magiclink").Parse(`Hello {{.User.FirstName}},
+
+you can log in by opening the following link:
+
+{{.Link}}
+
+The link can be used once and is valid until {{.ValidUntil.Format "2006-01-02 15:04 MST"}}.
+If you didn't request this mail you can ignore it.
+`))
+
+// MagicLinkMailData is the data the template of login link mails is
+// executed with. Link is the LoginURL of the MagicLinkManager with the
+// token.
+//
+// New in version v0.6
+type MagicLinkMailData struct {
+	User       *BaseUserInformation
+	Link       string
+	Token      string
+	ValidUntil time.Time
+}
+
+// MagicLinkManager creates and checks the tokens of passwordless logins:
+// RequestLink sends a mail with a link to the user, the token is added to
+// LoginURL as query parameter "token". The token is stored hashed in Tokens
+// together with the email address, it is valid for ValidDuration and can
+// only be used once. Login consumes the token.
+//
+// Use MagicLinkRequestHandler and MagicLinkLoginHandler to serve the two
+// steps over HTTP.
+//
+// New in version v0.6
+type MagicLinkManager struct {
+	Tokens        TokenStore
+	Users         UserHandlerContext
+	Mailer        MailSender
+	LoginURL      string
+	ValidDuration time.Duration
+
+	// Subject is the subject of the mail and Template the template of the
+	// body, see MagicLinkMailData.
+	Subject  string
+	Template *template.Template
+
+	// TokenBytes is the number of random bytes of a token, see
+	// NewOneTimeToken.
+	TokenBytes int
+}
+
+// NewMagicLinkManager returns a new manager with tokens valid for
+// DefaultMagicLinkDuration and the default subject and template.
+//
+// New in version v0.6
+func NewMagicLinkManager(tokens TokenStore, users UserHandler, mailer MailSender, loginURL string) *MagicLinkManager {
+	return &MagicLinkManager{
+		Tokens:        tokens,
+		Users:         AsUserHandlerContext(users),
+		Mailer:        mailer,
+		LoginURL:      loginURL,
+		ValidDuration: DefaultMagicLinkDuration,
+		Subject:       DefaultMagicLinkSubject,
+		Template:      DefaultMagicLinkTemplate,
+		TokenBytes:    DefaultTokenBytes,
+	}
+}
+
+// findUser returns the user with the given username or, if there is no such
+// user and the identifier looks like an email address, the only user with
+// this address. It returns ErrUserNotFound if there is no such user or the
+// address is used by more than one user.
+// The address is looked up with an email prefix filter, so the users should
+// be indexed by email (for example RedisUserHandler.EmailIndexKey or an
+// index on the email column).
+func (m *MagicLinkManager) findUser(ctx context.Context, identifier string) (*BaseUserInformation, error) {
+	user, err := m.Users.GetUserBaseInfoContext(ctx, identifier)
+	if err != ErrUserNotFound || !strings.Contains(identifier, "@") {
+		return user, err
+	}
+	// the filter matches a prefix, so we have to compare the addresses
+	filter := &UserFilter{EmailPrefix: identifier}
+	var found *BaseUserInformation
+	cursor := ""
+	for {
+		page, pageErr := m.Users.ListUsersPageContext(ctx, filter, UserSort{}, MaxUserPageLimit, cursor)
+		if pageErr != nil {
+			return nil, pageErr
+		}
+		for _, candidate := range page.Users {
+			if candidate.Email != identifier {
+				continue
+			}
+			if found != nil {
+				return nil, ErrUserNotFound
+			}
+			found = candidate
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if found == nil {
+		return nil, ErrUserNotFound
+	}
+	return found, nil
+}
+
+// RequestLink creates a new token for the user and sends the mail, all
+// previous tokens of the user are not valid any more. identifier is the
+// username or the email address of the user (looking up users by email
+// address uses ListUsersPage).
+// It returns ErrUserNotFound if there is no such user, ErrUserInactive if
+// the user is not active and ErrNoEmail if the user has no email address.
+// Don't tell the client about these errors, see MagicLinkRequestHandler.
+func (m *MagicLinkManager) RequestLink(ctx context.Context, identifier string) error {
+	user, err := m.findUser(ctx, identifier)
+	if err != nil {
+		return err
+	}
+	if !user.IsActive {
+		return ErrUserInactive
+	}
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+	token, err := NewOneTimeToken(m.TokenBytes)
+	if err != nil {
+		return err
+	}
+	link, err := tokenURL(m.LoginURL, token)
+	if err != nil {
+		return err
+	}
+	validUntil := CurrentTime().Add(m.ValidDuration)
+	var body bytes.Buffer
+	data := &MagicLinkMailData{User: user, Link: link, Token: token, ValidUntil: validUntil}
+	if err := m.Template.Execute(&body, data); err != nil {
+		return err
+	}
+	tokenData := &TokenData{UserID: user.ID, ValidUntil: validUntil, Data: user.Email}
+	if err := m.Tokens.ReplaceTokensForUser(ctx, HashToken(token), tokenData); err != nil {
+		return err
+	}
+	return m.Mailer.SendMail(ctx, &Mail{To: []string{user.Email}, Subject: m.Subject, Body: body.String()})
+}
+
+// Login consumes the token and returns the user it was created for. It
+// returns ErrInvalidToken if the token is invalid, expired, was already used
+// or the address of the user changed after the mail was sent and
+// ErrUserInactive if the user is not active.
+func (m *MagicLinkManager) Login(ctx context.Context, token string) (*BaseUserInformation, error) {
+	data, err := m.Tokens.ConsumeToken(ctx, HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if KeyInvalid(CurrentTime(), data.ValidUntil) {
+		return nil, ErrInvalidToken
+	}
+	userName, err := m.Users.GetUserNameContext(ctx, data.UserID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	user, err := m.Users.GetUserBaseInfoContext(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != data.Data {
+		return nil, ErrInvalidToken
+	}
+	if !user.IsActive {
+		return user, ErrUserInactive
+	}
+	return user, nil
+}
+
+// DeleteExpiredTokens removes all expired tokens from Tokens.
+func (m *MagicLinkManager) DeleteExpiredTokens(ctx context.Context) (int64, error) {
+	return m.Tokens.DeleteExpiredTokens(ctx, CurrentTime())
+}
+
+// magicLinkThrottleKey is the name used for a LoginThrottler to count link
+// requests.
+func magicLinkThrottleKey(identifier string) string {
+	return "magic:" + identifier
+}
+
+// errMagicLinkNoThrottler is logged if a MagicLinkRequestHandler has no
+// Throttler.
+var errMagicLinkNoThrottler = errors.New("MagicLinkRequestHandler requires a Throttler.")
+
+// MagicLinkRequestHandler is a http.Handler that sends login links: It
+// reads the username or email address from a POST request, either as form
+// value or as JSON ({"username": "..."}), and calls RequestLink of Links.
+//
+// To prevent user enumeration the response is always the same, no matter if
+// the user exists: {"success": true} with status 202 Accepted or a redirect
+// to SentURL. The mail is sent in the background (with a context that times
+// out after Timeout), so the response time doesn't depend on the user
+// either. Errors other than ErrUserNotFound, ErrUserInactive and ErrNoEmail
+// are logged.
+//
+// At most MaxPending links are sent at the same time, further requests get
+// the same response but no link is sent (a warning is logged).
+//
+// New in version v0.6
+type MagicLinkRequestHandler struct {
+	Links *MagicLinkManager
+
+	// UserNameField is the name of the form field, defaults to "username".
+	UserNameField string
+
+	// SentURL is the URL form requests are redirected to.
+	SentURL string
+
+	// Timeout is the timeout for sending a link, defaults to one minute.
+	Timeout time.Duration
+
+	// Throttler is used to limit the number of mails and must not be nil:
+	// Each request counts as a failed attempt for the username / address and
+	// the remote address. If a request is not allowed the response is 429
+	// Too Many Requests with a Retry-After header. Without a Throttler all
+	// requests fail with 500 Internal Server Error.
+	Throttler *LoginThrottler
+
+	// MaxPending is the maximal number of links that are sent at the same
+	// time, defaults to DefaultMagicLinkMaxPending.
+	MaxPending int
+
+	pendingOnce sync.Once
+	pending     chan struct{}
+}
+
+// NewMagicLinkRequestHandler returns a new MagicLinkRequestHandler with the
+// default field name.
+//
+// New in version v0.6
+func NewMagicLinkRequestHandler(links *MagicLinkManager, throttler *LoginThrottler, sentURL string) *MagicLinkRequestHandler {
+	return &MagicLinkRequestHandler{Links: links, UserNameField: "username", SentURL: sentURL,
+		Timeout: time.Minute, Throttler: throttler, MaxPending: DefaultMagicLinkMaxPending}
+}
+
+// acquire reserves a slot for sending a link, it returns false if MaxPending
+// links are already being sent. The slot must be freed with release.
+func (h *MagicLinkRequestHandler) acquire() bool {
+	h.pendingOnce.Do(func() {
+		maxPending := h.MaxPending
+		if maxPending <= 0 {
+			maxPending = DefaultMagicLinkMaxPending
+		}
+		h.pending = make(chan struct{}, maxPending)
+	})
+	select {
+	case h.pending <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot reserved with acquire.
+func (h *MagicLinkRequestHandler) release() {
+	<-h.pending
+}
+
+// identifier reads the username or email address from the request.
+func (h *MagicLinkRequestHandler) identifier(w http.ResponseWriter, r *http.Request) (string, error) {
+	if isJSONRequest(r) {
+		var req struct {
+			UserName string `json:"username"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCredentialsSize)).Decode(&req); err != nil {
+			return "", err
+		}
+		return req.UserName, nil
+	}
+	field := h.UserNameField
+	if field == "" {
+		field = "username"
+	}
+	if err := r.ParseForm(); err != nil {
+		return "", err
+	}
+	return r.PostForm.Get(field), nil
+}
+
+func (h *MagicLinkRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	identifier, err := h.identifier(w, r)
+	if err != nil || identifier == "" {
+		writeJSON(w, http.StatusBadRequest, jsonError{"Invalid request."})
+		return
+	}
+	if h.Throttler == nil {
+		writeLoginFailure(w, r, "", http.StatusInternalServerError, errMagicLinkNoThrottler)
+		return
+	}
+	ctx, key, remoteAddr := r.Context(), magicLinkThrottleKey(identifier), MetadataFromRequest(r).RemoteAddr
+	if err := h.Throttler.Attempt(ctx, key, remoteAddr); err != nil {
+		setRetryAfter(w, err)
+		writeLoginFailure(w, r, "", loginErrorStatus(err), err)
+		return
+	}
+	if err := h.Throttler.AddressFailure(ctx, remoteAddr); err != nil {
+		writeLoginFailure(w, r, "", http.StatusInternalServerError, err)
+		return
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	if h.acquire() {
+		go func() {
+			defer h.release()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			switch err := h.Links.RequestLink(ctx, identifier); err {
+			case nil, ErrUserNotFound, ErrUserInactive, ErrNoEmail:
+			default:
+				log.WithError(err).Error("goauth: Can't send login link")
+			}
+		}()
+	} else {
+		log.Warn("goauth: Too many pending login links, dropping request")
+	}
+	if h.SentURL != "" && !wantsJSON(r) {
+		http.Redirect(w, r, h.SentURL, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, struct {
+		Success bool `json:"success"`
+	}{true})
+}
+
+// MagicLinkLoginHandler is a http.Handler that logs in users with the token
+// of a login link: It reads the token from a POST request, either as form
+// value or as JSON ({"token": "..."}), consumes it with Links and creates
+// and saves a new auth session with CreateAuthSession. The token can only
+// be used once.
+//
+// GET requests with the token as query parameter are only accepted if
+// AllowGET is true: Some mail clients and scanners open links in mails, this
+// would consume the token. So usually LoginURL of the MagicLinkManager
+// should be a page that posts the token to this handler.
+//
+// The responses are the same as the ones of LoginHandler, including the
+// second factor: If TOTP is set and enabled for the user only a pending
+// session is created.
+//
+// New in version v0.6
+type MagicLinkLoginHandler struct {
+	Links *MagicLinkManager
+
+	// Sessions and Store are used to create the auth session.
+	Sessions *SessionController
+	Store    sessions.Store
+
+	// ValidDuration is the duration a new session is valid.
+	ValidDuration time.Duration
+
+	// TokenField is the name of the form field and query parameter,
+	// defaults to "token".
+	TokenField string
+
+	// AllowGET is true if GET requests are accepted, see above.
+	AllowGET bool
+
+	// SuccessURL and FailureURL are the URLs form requests are redirected to.
+	SuccessURL, FailureURL string
+
+	// TOTP, PendingDuration, SecondFactorURL and OnSecondFactor are used as
+	// in LoginHandler.
+	TOTP            *TOTPManager
+	PendingDuration time.Duration
+	SecondFactorURL string
+	OnSecondFactor  func(w http.ResponseWriter, r *http.Request, user *BaseUserInformation)
+
+	// OnSuccess is called after the session was created and saved. If it is
+	// not nil it must write the response.
+	OnSuccess func(w http.ResponseWriter, r *http.Request, user *BaseUserInformation, data *SessionKeyData)
+
+	// OnFailure is called if the login failed. err is either
+	// ErrInvalidToken, ErrUserInactive, ErrTooManySessions or any other
+	// error that occurred. If it is not nil it must write the response.
+	OnFailure func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// NewMagicLinkLoginHandler returns a new MagicLinkLoginHandler with the
+// default field name.
+//
+// New in version v0.6
+func NewMagicLinkLoginHandler(links *MagicLinkManager, c *SessionController, store sessions.Store, validDuration time.Duration) *MagicLinkLoginHandler {
+	return &MagicLinkLoginHandler{Links: links, Sessions: c, Store: store,
+		ValidDuration: validDuration, TokenField: "token"}
+}
+
+// token reads the token from the request.
+func (h *MagicLinkLoginHandler) token(w http.ResponseWriter, r *http.Request) (string, error) {
+	field := h.TokenField
+	if field == "" {
+		field = "token"
+	}
+	if r.Method == http.MethodGet {
+		return r.URL.Query().Get(field), nil
+	}
+	if isJSONRequest(r) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCredentialsSize)).Decode(&req); err != nil {
+			return "", err
+		}
+		return req.Token, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return "", err
+	}
+	return r.PostForm.Get(field), nil
+}
+
+// login consumes the token and creates the session. pending is true if a
+// pending session was created because a second factor is required.
+func (h *MagicLinkLoginHandler) login(r *http.Request, token string) (info *BaseUserInformation, data *SessionKeyData, session *sessions.Session, pending bool, err error) {
+	ctx := r.Context()
+	info, err = h.Links.Login(ctx, token)
+	if err != nil {
+		return info, nil, nil, false, err
+	}
+	deleteOldSessionKey(r, h.Sessions, h.Store)
+	if h.TOTP != nil {
+		enabled, totpErr := h.TOTP.Enabled(ctx, info.ID)
+		if totpErr != nil {
+			return info, nil, nil, false, totpErr
+		}
+		if enabled {
+			data, session, err = h.Sessions.CreatePendingSession(r, h.Store, info.ID, h.PendingDuration)
+			if err != nil {
+				return info, nil, nil, false, err
+			}
+			return info, data, session, true, nil
+		}
+	}
+	meta := MetadataFromRequest(r)
+	meta.LoginMethod = MagicLinkLoginMethod
+	data, _, session, err = h.Sessions.CreateAuthSessionWithMetadata(r, h.Store, info.ID, h.ValidDuration, meta)
+	if err != nil {
+		return info, nil, nil, false, err
+	}
+	return info, data, session, false, nil
+}
+
+func (h *MagicLinkLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && !(h.AllowGET && r.Method == http.MethodGet) {
+		allow := http.MethodPost
+		if h.AllowGET {
+			allow = http.MethodGet + ", " + http.MethodPost
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := h.token(w, r)
+	if err != nil {
+		h.failure(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if token == "" {
+		h.failure(w, r, http.StatusUnauthorized, ErrInvalidToken)
+		return
+	}
+	info, data, session, pending, err := h.login(r, token)
+	if err != nil {
+		h.failure(w, r, loginErrorStatus(err), err)
+		return
+	}
+	if err := session.Save(r, w); err != nil {
+		h.failure(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if pending {
+		if h.OnSecondFactor != nil {
+			h.OnSecondFactor(w, r, info)
+			return
+		}
+		writeSecondFactor(w, r, h.SecondFactorURL, info)
+		return
+	}
+	if h.OnSuccess != nil {
+		h.OnSuccess(w, r, info, data)
+		return
+	}
+	writeLoginSuccess(w, r, h.SuccessURL, info, data)
+}
+
+// failure calls the failure hook or writes the default response.
+func (h *MagicLinkLoginHandler) failure(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if h.OnFailure != nil {
+		h.OnFailure(w, r, err)
+		return
+	}
+	writeLoginFailure(w, r, h.FailureURL, status, err)
+}
@@ -23,6 +23,7 @@
 package goauth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -55,6 +56,14 @@ import (
 //
 // Memcached errors are not returned in the functions but printed to the log.
 //
+// The handler implements SessionHandlerContext, the context is passed to the
+// parent (see AsSessionHandlerContext). The memcached client itself does not
+// support contexts, so it is only checked if the context is already done
+// before asking memcached.
+// It also implements the optional session interfaces (SessionEntryUpdater,
+// SessionLimiter and SessionLister), if the parent doesn't implement them
+// the fallbacks described there are used.
+//
 // For more examples read the wiki: https://github.com/FabianWe/goauth/wiki/Using-Memcached-for-Session-Lookups
 type MemcachedSessionHandler struct {
 	// Parent is the handler wrapped by memcached.
@@ -139,12 +148,25 @@ func (handler *MemcachedSessionHandler) formatKeyEntry(key string) string {
 
 // formatJSONData transforms the SessionKeyData in a json object to be stored
 // in memcached:
-// It uses a dictionary {u: User, c: CreationTime, v: ValidUntil}
-// Dates are stored in the format "2006-01-02 15:04:05"
+// It uses a dictionary {u: User, c: CreationTime, v: ValidUntil,
+// a: LastActivity, m: MaxValidUntil, ra: RemoteAddr, ua: UserAgent,
+// d: DeviceName, lm: LoginMethod}
+// Dates are stored in the format "2006-01-02 15:04:05", m is the empty
+// string if there is no max valid time.
 func (handler *MemcachedSessionHandler) formatJSONData(data *SessionKeyData) ([]byte, error) {
+	maxValid := ""
+	if !data.MaxValidUntil.IsZero() {
+		maxValid = data.MaxValidUntil.Format("2006-01-02 15:04:05")
+	}
 	values := map[string]interface{}{"u": fmt.Sprintf("%v", data.User),
-		"c": data.CreationTime.Format("2006-01-02 15:04:05"),
-		"v": data.ValidUntil.Format("2006-01-02 15:04:05")}
+		"c":  data.CreationTime.Format("2006-01-02 15:04:05"),
+		"v":  data.ValidUntil.Format("2006-01-02 15:04:05"),
+		"a":  data.LastActivity.Format("2006-01-02 15:04:05"),
+		"m":  maxValid,
+		"ra": data.Metadata.RemoteAddr,
+		"ua": data.Metadata.UserAgent,
+		"d":  data.Metadata.DeviceName,
+		"lm": data.Metadata.LoginMethod}
 	return json.Marshal(values)
 }
 
@@ -154,6 +176,12 @@ func (handler *MemcachedSessionHandler) parseJSONData(b []byte) (*SessionKeyData
 		User     string `json:"u"`
 		Creation string `json:"c"`
 		Valid    string `json:"v"`
+		Activity string `json:"a"`
+		MaxValid string `json:"m"`
+		Addr     string `json:"ra"`
+		Agent    string `json:"ua"`
+		Device   string `json:"d"`
+		Method   string `json:"lm"`
 	}
 	var intermediate parseType
 	err := json.Unmarshal(b, &intermediate)
@@ -172,12 +200,40 @@ func (handler *MemcachedSessionHandler) parseJSONData(b []byte) (*SessionKeyData
 	if validErr != nil {
 		return nil, validErr
 	}
-	return NewSessionKeyData(user, creation, valid), nil
+	data := NewSessionKeyData(user, creation, valid)
+	data.Metadata = SessionMetadata{RemoteAddr: intermediate.Addr, UserAgent: intermediate.Agent,
+		DeviceName: intermediate.Device, LoginMethod: intermediate.Method}
+	if intermediate.Activity != "" {
+		activity, activityErr := time.Parse("2006-01-02 15:04:05", intermediate.Activity)
+		if activityErr != nil {
+			return nil, activityErr
+		}
+		data.LastActivity = activity
+	}
+	if intermediate.MaxValid != "" {
+		maxValid, maxValidErr := time.Parse("2006-01-02 15:04:05", intermediate.MaxValid)
+		if maxValidErr != nil {
+			return nil, maxValidErr
+		}
+		data.MaxValidUntil = maxValid
+	}
+	return data, nil
+}
+
+// parent returns the Parent with the optional session interfaces, see
+// asExtendedSessionHandler.
+func (handler *MemcachedSessionHandler) parent() extendedSessionHandler {
+	return asExtendedSessionHandler(handler.Parent)
 }
 
 // Init simply calls Parent.Init()
 func (handler *MemcachedSessionHandler) Init() error {
-	return handler.Parent.Init()
+	return handler.InitContext(context.Background())
+}
+
+// InitContext simply calls InitContext on the parent.
+func (handler *MemcachedSessionHandler) InitContext(ctx context.Context) error {
+	return handler.parent().InitContext(ctx)
 }
 
 // setMemcached formats the given session key and the SessionKeyData and
@@ -200,6 +256,14 @@ func (handler *MemcachedSessionHandler) setMemcached(key string, value *SessionK
 // Otherwise we ask the parent. If lookup on the parent succeeds we add the
 // entry in memcached as well.
 func (handler *MemcachedSessionHandler) GetData(key string) (*SessionKeyData, error) {
+	return handler.GetDataContext(context.Background(), key)
+}
+
+// GetDataContext is GetData with a context.
+func (handler *MemcachedSessionHandler) GetDataContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	// first get the key we store in memcached
 	memcachedKey := handler.formatKeyEntry(key)
 	// try to get the key from memcached
@@ -207,7 +271,7 @@ func (handler *MemcachedSessionHandler) GetData(key string) (*SessionKeyData, er
 	if err != nil {
 		// just ask the parent
 		// if parent returns a result add it to memcached
-		parentData, parentErr := handler.Parent.GetData(key)
+		parentData, parentErr := handler.parent().GetDataContext(ctx, key)
 		if parentErr != nil {
 			return parentData, parentErr
 		}
@@ -224,7 +288,7 @@ func (handler *MemcachedSessionHandler) GetData(key string) (*SessionKeyData, er
 	data, jsonErr := handler.parseJSONData(item.Value)
 	if jsonErr != nil {
 		log.WithError(jsonErr).Warn("goauth: memcached result parsing failed, this should not happen... Asking parent")
-		return handler.Parent.GetData(key)
+		return handler.parent().GetDataContext(ctx, key)
 	}
 	return data, nil
 }
@@ -232,8 +296,13 @@ func (handler *MemcachedSessionHandler) GetData(key string) (*SessionKeyData, er
 // CreateEntry creates an entry in the parent, if that succeeds it also adds
 // an entry in memcached.
 func (handler *MemcachedSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return handler.CreateEntryContext(context.Background(), user, key, validDuration)
+}
+
+// CreateEntryContext is CreateEntry with a context.
+func (handler *MemcachedSessionHandler) CreateEntryContext(ctx context.Context, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
 	// first add to parent, store the result here as well
-	data, parentErr := handler.Parent.CreateEntry(user, key, validDuration)
+	data, parentErr := handler.parent().CreateEntryContext(ctx, user, key, validDuration)
 	if parentErr != nil {
 		return data, parentErr
 	}
@@ -241,25 +310,151 @@ func (handler *MemcachedSessionHandler) CreateEntry(user UserKeyType, key string
 	return data, parentErr
 }
 
+// InsertEntry inserts the entry in the parent, if that succeeds it also adds
+// an entry in memcached.
+func (handler *MemcachedSessionHandler) InsertEntry(key string, data *SessionKeyData) error {
+	return handler.InsertEntryContext(context.Background(), key, data)
+}
+
+// InsertEntryContext is InsertEntry with a context.
+func (handler *MemcachedSessionHandler) InsertEntryContext(ctx context.Context, key string, data *SessionKeyData) error {
+	if parentErr := handler.parent().InsertEntryContext(ctx, key, data); parentErr != nil {
+		return parentErr
+	}
+	handler.setMemcached(key, data)
+	return nil
+}
+
+// InsertEntryLimited inserts the entry in the parent, if that succeeds it
+// also adds an entry in memcached. If sessions were deleted by the parent
+// ALL entries in memcached are invalidated.
+func (handler *MemcachedSessionHandler) InsertEntryLimited(key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	return handler.InsertEntryLimitedContext(context.Background(), key, data, maxSessions, policy)
+}
+
+// InsertEntryLimitedContext is InsertEntryLimited with a context.
+func (handler *MemcachedSessionHandler) InsertEntryLimitedContext(ctx context.Context, key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	removed, parentErr := handler.parent().InsertEntryLimitedContext(ctx, key, data, maxSessions, policy)
+	if parentErr != nil {
+		return removed, parentErr
+	}
+	if removed > 0 {
+		handler.updateCurrentSessionKeyIdentifier()
+	}
+	handler.setMemcached(key, data)
+	return removed, nil
+}
+
 // DeleteEntriesForUser invalidates ALL entries in memcached by creating
 // a new random number. After that it calls DeleteEntriesForUser on the parent.
 func (handler *MemcachedSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	return handler.DeleteEntriesForUserContext(context.Background(), user)
+}
+
+// DeleteEntriesForUserContext is DeleteEntriesForUser with a context.
+func (handler *MemcachedSessionHandler) DeleteEntriesForUserContext(ctx context.Context, user UserKeyType) (int64, error) {
 	// create a new random int, this invalidates all keys, not just for the user!
 	handler.updateCurrentSessionKeyIdentifier()
-	return handler.Parent.DeleteEntriesForUser(user)
+	return handler.parent().DeleteEntriesForUserContext(ctx, user)
 }
 
 // DeleteInvalidKeys only calls DeleteInvalidKeys on the parent.
 func (handler *MemcachedSessionHandler) DeleteInvalidKeys() (int64, error) {
+	return handler.DeleteInvalidKeysContext(context.Background())
+}
+
+// DeleteInvalidKeysContext only calls DeleteInvalidKeysContext on the parent.
+func (handler *MemcachedSessionHandler) DeleteInvalidKeysContext(ctx context.Context) (int64, error) {
 	// actually we do nothing...
-	return handler.Parent.DeleteInvalidKeys()
+	return handler.parent().DeleteInvalidKeysContext(ctx)
 }
 
 // DeleteKey first deletes the entry from memcached and then from the parent.
 func (handler *MemcachedSessionHandler) DeleteKey(key string) error {
+	return handler.DeleteKeyContext(context.Background(), key)
+}
+
+// DeleteKeyContext is DeleteKey with a context.
+func (handler *MemcachedSessionHandler) DeleteKeyContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	// remove the key from memcached
 	if err := handler.Client.Delete(handler.formatKeyEntry(key)); err != nil && err != memcache.ErrCacheMiss {
 		log.WithError(err).Warn("goauth: Unkown memcached error")
 	}
-	return handler.Parent.DeleteKey(key)
+	return handler.parent().DeleteKeyContext(ctx, key)
+}
+
+// ExtendEntry extends the entry in the parent and, if that succeeds, writes
+// the updated entry to memcached.
+func (handler *MemcachedSessionHandler) ExtendEntry(key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return handler.ExtendEntryContext(context.Background(), key, validDuration)
+}
+
+// ExtendEntryContext is ExtendEntry with a context.
+func (handler *MemcachedSessionHandler) ExtendEntryContext(ctx context.Context, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	data, parentErr := handler.parent().ExtendEntryContext(ctx, key, validDuration)
+	if parentErr != nil {
+		return data, parentErr
+	}
+	handler.setMemcached(key, data)
+	return data, parentErr
+}
+
+// TouchEntry updates the entry in the parent and, if that succeeds, writes
+// the updated entry to memcached.
+func (handler *MemcachedSessionHandler) TouchEntry(key string) (*SessionKeyData, error) {
+	return handler.TouchEntryContext(context.Background(), key)
+}
+
+// TouchEntryContext is TouchEntry with a context.
+func (handler *MemcachedSessionHandler) TouchEntryContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	data, parentErr := handler.parent().TouchEntryContext(ctx, key)
+	if parentErr != nil {
+		return data, parentErr
+	}
+	handler.setMemcached(key, data)
+	return data, parentErr
+}
+
+// ListEntriesForUser simply calls ListEntriesForUser on the parent.
+func (handler *MemcachedSessionHandler) ListEntriesForUser(user UserKeyType) ([]*SessionEntry, error) {
+	return handler.ListEntriesForUserContext(context.Background(), user)
+}
+
+// ListEntriesForUserContext is ListEntriesForUser with a context.
+func (handler *MemcachedSessionHandler) ListEntriesForUserContext(ctx context.Context, user UserKeyType) ([]*SessionEntry, error) {
+	return handler.parent().ListEntriesForUserContext(ctx, user)
+}
+
+// DeleteEntryByID calls DeleteEntryByID on the parent and invalidates ALL
+// entries in memcached (we don't know the key) before and after that, so an
+// entry cached while the parent deletes it is invalidated as well.
+func (handler *MemcachedSessionHandler) DeleteEntryByID(user UserKeyType, id string) error {
+	return handler.DeleteEntryByIDContext(context.Background(), user, id)
+}
+
+// DeleteEntryByIDContext is DeleteEntryByID with a context.
+func (handler *MemcachedSessionHandler) DeleteEntryByIDContext(ctx context.Context, user UserKeyType, id string) error {
+	handler.updateCurrentSessionKeyIdentifier()
+	err := handler.parent().DeleteEntryByIDContext(ctx, user, id)
+	handler.updateCurrentSessionKeyIdentifier()
+	return err
+}
+
+// DeleteOtherEntriesForUser calls DeleteOtherEntriesForUser on the parent
+// and invalidates ALL entries in memcached before and after that, see
+// DeleteEntryByID.
+func (handler *MemcachedSessionHandler) DeleteOtherEntriesForUser(user UserKeyType, key string) (int64, error) {
+	return handler.DeleteOtherEntriesForUserContext(context.Background(), user, key)
+}
+
+// DeleteOtherEntriesForUserContext is DeleteOtherEntriesForUser with a
+// context.
+func (handler *MemcachedSessionHandler) DeleteOtherEntriesForUserContext(ctx context.Context, user UserKeyType, key string) (int64, error) {
+	handler.updateCurrentSessionKeyIdentifier()
+	removed, err := handler.parent().DeleteOtherEntriesForUserContext(ctx, user, key)
+	handler.updateCurrentSessionKeyIdentifier()
+	return removed, err
 }
@@ -0,0 +1,177 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// userContextKey is the type of the key used to store the *SessionKeyData in
+// the context of a request.
+type userContextKey struct{}
+
+// UserFromContext returns the session data that was stored in the context
+// by the middleware of a SessionController. The bool is false if there is no
+// such data (the request was not authenticated).
+//
+// New in version v0.6
+func UserFromContext(ctx context.Context) (*SessionKeyData, bool) {
+	data, ok := ctx.Value(userContextKey{}).(*SessionKeyData)
+	return data, ok && data != nil
+}
+
+// ContextWithUser returns a copy of ctx that stores the session data, it can
+// be retrieved with UserFromContext.
+//
+// New in version v0.6
+func ContextWithUser(ctx context.Context, data *SessionKeyData) context.Context {
+	return context.WithValue(ctx, userContextKey{}, data)
+}
+
+// MiddlewareOptions controls how the middleware of a SessionController deals
+// with requests that are not authenticated.
+//
+// New in version v0.6
+type MiddlewareOptions struct {
+	// LoginURL is the URL unauthenticated requests are redirected to.
+	// If it is empty a 401 Unauthorized is returned instead.
+	LoginURL string
+
+	// RedirectParam is the name of the query parameter that is added to
+	// LoginURL and contains the URL of the original request, for example
+	// "next". If it is empty no parameter is added.
+	RedirectParam string
+
+	// Optional allows unauthenticated requests, they're passed to the
+	// handler without session data in the context. Use UserFromContext to
+	// check if the user is logged in.
+	Optional bool
+
+	// ErrorHandler is called for errors that don't mean that the user is not
+	// authenticated, for example if the database is not reachable.
+	// Defaults to a 500 Internal Server Error.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// IsAuthError returns true if err is one of the errors that are returned by
+// ValidateSession if the user is simply not (or not any more) logged in:
+// ErrNotAuthSession, ErrKeyNotFound, ErrInvalidKey, ErrSessionIdle or an
+// error of securecookie if the cookie could not be decoded.
+//
+// New in version v0.6
+func IsAuthError(err error) bool {
+	switch err {
+	case ErrNotAuthSession, ErrKeyNotFound, ErrInvalidKey, ErrSessionIdle:
+		return true
+	}
+	if cookieErr, ok := err.(securecookie.Error); ok && cookieErr.IsDecode() {
+		return true
+	}
+	return false
+}
+
+// unauthorized either redirects to the LoginURL or writes a 401.
+func (opts *MiddlewareOptions) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if opts.LoginURL == "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	target := opts.LoginURL
+	if opts.RedirectParam != "" {
+		if loginURL, parseErr := url.Parse(opts.LoginURL); parseErr != nil {
+			log.WithError(parseErr).Warn("goauth: Can't parse login URL")
+		} else {
+			query := loginURL.Query()
+			query.Set(opts.RedirectParam, r.URL.RequestURI())
+			loginURL.RawQuery = query.Encode()
+			target = loginURL.String()
+		}
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// handleError calls the ErrorHandler or writes a 500.
+func (opts *MiddlewareOptions) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if opts.ErrorHandler != nil {
+		opts.ErrorHandler(w, r, err)
+		return
+	}
+	log.WithError(err).Error("goauth: Can't validate session")
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// Middleware returns a middleware that validates the session of each request
+// with ValidateSession and saves the session s.t. the MaxAge of the cookie
+// gets updated. If the session is valid the *SessionKeyData is stored in the
+// context of the request, use UserFromContext to retrieve it.
+// If the user is not authenticated (see IsAuthError) the request is handled
+// as configured in opts, opts can be nil to use the defaults (401
+// Unauthorized).
+//
+// New in version v0.6
+func (c *SessionController) Middleware(store sessions.Store, opts *MiddlewareOptions) func(http.Handler) http.Handler {
+	if opts == nil {
+		opts = &MiddlewareOptions{}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, session, err := c.ValidateSession(r, store)
+			if err != nil {
+				if !IsAuthError(err) {
+					opts.handleError(w, r, err)
+					return
+				}
+				// if the key is not valid any more the cookie gets removed
+				if session != nil && session.Options.MaxAge < 0 {
+					if saveErr := session.Save(r, w); saveErr != nil {
+						log.WithError(saveErr).Warn("goauth: Can't save session")
+					}
+				}
+				if opts.Optional {
+					next.ServeHTTP(w, r)
+					return
+				}
+				opts.unauthorized(w, r)
+				return
+			}
+			if saveErr := session.Save(r, w); saveErr != nil {
+				opts.handleError(w, r, saveErr)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ContextWithUser(r.Context(), data)))
+		})
+	}
+}
+
+// RequireAuth wraps a single handler with Middleware.
+//
+// New in version v0.6
+func (c *SessionController) RequireAuth(store sessions.Store, opts *MiddlewareOptions, h http.HandlerFunc) http.Handler {
+	return c.Middleware(store, opts)(h)
+}
@@ -0,0 +1,196 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+)
+
+// pepperPrefix is the prefix of all hashes created by a
+// PepperedPasswordHandler.
+const pepperPrefix = "$pepper$"
+
+// ErrUnknownPepperVersion is returned by PepperedPasswordHandler if a hash was
+// created with a pepper version that is not known.
+//
+// New in version v0.6
+var ErrUnknownPepperVersion = errors.New("Unknown pepper version.")
+
+// ErrNotPeppered is returned by PepperedPasswordHandler if a hash was not
+// created with a pepper and AllowUnpeppered is false.
+//
+// New in version v0.6
+var ErrNotPeppered = errors.New("The hash was not created with a pepper.")
+
+// PepperedPasswordHandler is a PasswordHandler that computes the HMAC-SHA256
+// of the password with a secret (the pepper) and passes the base64 encoded
+// HMAC to the Parent handler. The pepper is not stored in the database, so an
+// attacker who only has access to the database can't brute-force the hashes.
+//
+// Peppers are versioned: The hashes have the form
+// "$pepper$<version>$<hash of parent>" and new hashes are always created with
+// CurrentVersion. To rotate the pepper add a new pepper, set CurrentVersion
+// to its version and keep the old peppers until all hashes got replaced:
+// NeedsRehash reports true for hashes of other versions, so the user handlers
+// replace them on the next login.
+//
+// The handler can be used with SQLUserHandler and RedisUserHandler as any
+// other PasswordHandler, note however that the hashes are longer than the
+// hashes of the Parent.
+//
+// New in version v0.6
+type PepperedPasswordHandler struct {
+	// Parent is the handler that creates the actual hash.
+	Parent PasswordHandler
+
+	// Peppers maps the versions to the secrets.
+	Peppers map[int][]byte
+
+	// CurrentVersion is the version of the pepper used for new hashes.
+	CurrentVersion int
+
+	// AllowUnpeppered allows hashes without a pepper, such hashes are
+	// checked with the plain password by the Parent. Use this to migrate
+	// existing hashes, NeedsRehash reports true for these hashes.
+	AllowUnpeppered bool
+}
+
+// NewPepperedPasswordHandler returns a new PepperedPasswordHandler with a
+// single pepper. version must be >= 0.
+//
+// New in version v0.6
+func NewPepperedPasswordHandler(parent PasswordHandler, version int, pepper []byte) *PepperedPasswordHandler {
+	return &PepperedPasswordHandler{Parent: parent,
+		Peppers:        map[int][]byte{version: pepper},
+		CurrentVersion: version}
+}
+
+// pepper returns the base64 encoding of the HMAC of the password.
+func (handler *PepperedPasswordHandler) pepper(version int, password []byte) ([]byte, error) {
+	secret, ok := handler.Peppers[version]
+	if !ok {
+		return nil, ErrUnknownPepperVersion
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(password)
+	sum := mac.Sum(nil)
+	res := make([]byte, base64.StdEncoding.EncodedLen(len(sum)))
+	base64.StdEncoding.Encode(res, sum)
+	return res, nil
+}
+
+// splitPepperedHash returns the version and the hash of the parent.
+// ok is false if the hash doesn't have the prefix.
+func splitPepperedHash(hashedPW []byte) (version int, parentHash []byte, ok bool, err error) {
+	if !bytes.HasPrefix(hashedPW, []byte(pepperPrefix)) {
+		return -1, nil, false, nil
+	}
+	rest := hashedPW[len(pepperPrefix):]
+	sep := bytes.IndexByte(rest, '$')
+	if sep < 0 {
+		return -1, nil, true, ErrUnknownPepperVersion
+	}
+	version, convErr := strconv.Atoi(string(rest[:sep]))
+	if convErr != nil {
+		return -1, nil, true, ErrUnknownPepperVersion
+	}
+	return version, rest[sep+1:], true, nil
+}
+
+// GenerateHash generates the hash with the current pepper.
+func (handler *PepperedPasswordHandler) GenerateHash(password []byte) ([]byte, error) {
+	peppered, err := handler.pepper(handler.CurrentVersion, password)
+	if err != nil {
+		return nil, err
+	}
+	parentHash, err := handler.Parent.GenerateHash(peppered)
+	if err != nil {
+		return nil, err
+	}
+	res := []byte(pepperPrefix + strconv.Itoa(handler.CurrentVersion) + "$")
+	return append(res, parentHash...), nil
+}
+
+// CheckPassword checks the password with the pepper of the version stored in
+// the hash.
+func (handler *PepperedPasswordHandler) CheckPassword(hashedPW, password []byte) (bool, error) {
+	// CHAR columns may pad shorter hashes with spaces
+	hashedPW = bytes.TrimRight(hashedPW, " ")
+	version, parentHash, ok, err := splitPepperedHash(hashedPW)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		if !handler.AllowUnpeppered {
+			return false, ErrNotPeppered
+		}
+		return handler.Parent.CheckPassword(hashedPW, password)
+	}
+	peppered, err := handler.pepper(version, password)
+	if err != nil {
+		return false, err
+	}
+	return handler.Parent.CheckPassword(parentHash, peppered)
+}
+
+// PasswordHashLength returns the length of the Parent plus the length of the
+// prefix with the current version.
+func (handler *PepperedPasswordHandler) PasswordHashLength() int {
+	return handler.prefixLength(handler.CurrentVersion) + handler.Parent.PasswordHashLength()
+}
+
+// MaxPasswordHashLength returns the max length of the Parent plus the length
+// of the longest prefix.
+func (handler *PepperedPasswordHandler) MaxPasswordHashLength() int {
+	parentLength := MaxPasswordHashLength(handler.Parent)
+	if parentLength <= 0 {
+		return parentLength
+	}
+	prefixLength := handler.prefixLength(handler.CurrentVersion)
+	for version := range handler.Peppers {
+		if l := handler.prefixLength(version); l > prefixLength {
+			prefixLength = l
+		}
+	}
+	return prefixLength + parentLength
+}
+
+// prefixLength returns the length of "$pepper$<version>$".
+func (handler *PepperedPasswordHandler) prefixLength(version int) int {
+	return len(pepperPrefix) + len(strconv.Itoa(version)) + 1
+}
+
+// NeedsRehash returns true if the hash was not created with the current
+// pepper or if the Parent reports that its hash needs a rehash.
+func (handler *PepperedPasswordHandler) NeedsRehash(hashedPW []byte) bool {
+	version, parentHash, ok, err := splitPepperedHash(bytes.TrimRight(hashedPW, " "))
+	if err != nil || !ok || version != handler.CurrentVersion {
+		return true
+	}
+	return NeedsRehash(handler.Parent, parentHash)
+}
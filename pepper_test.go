@@ -0,0 +1,100 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"testing"
+)
+
+func TestSplitPepperedHash(t *testing.T) {
+	tests := []struct {
+		hash       string
+		version    int
+		parentHash string
+		ok         bool
+		err        error
+	}{
+		{"$pepper$1$$2a$10$abc", 1, "$2a$10$abc", true, nil},
+		{"$pepper$42$16384$8$1$salt$key", 42, "16384$8$1$salt$key", true, nil},
+		{"$pepper$0$", 0, "", true, nil},
+		{"$pepper$$2a$10$abc", -1, "", true, ErrUnknownPepperVersion},
+		{"$pepper$x$2a$10$abc", -1, "", true, ErrUnknownPepperVersion},
+		{"$pepper$1", -1, "", true, ErrUnknownPepperVersion},
+		{"$2a$10$abc", -1, "", false, nil},
+		{"$peppe$1$abc", -1, "", false, nil},
+		{"", -1, "", false, nil},
+	}
+	for _, tc := range tests {
+		version, parentHash, ok, err := splitPepperedHash([]byte(tc.hash))
+		if version != tc.version || string(parentHash) != tc.parentHash || ok != tc.ok || err != tc.err {
+			t.Errorf("splitPepperedHash(%q): expected (%d, %q, %v, %v), got (%d, %q, %v, %v)",
+				tc.hash, tc.version, tc.parentHash, tc.ok, tc.err,
+				version, parentHash, ok, err)
+		}
+	}
+}
+
+func TestPepperedPasswordHandler(t *testing.T) {
+	parent := NewArgon2idHandler(&testArgon2Params)
+	handler := NewPepperedPasswordHandler(parent, 1, []byte("pepper1"))
+	hash, err := handler.GenerateHash([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := handler.CheckPassword(hash, []byte("secret")); err != nil || !ok {
+		t.Errorf("expected password to match, got %v, %v", ok, err)
+	}
+	// the parent alone must not accept the password
+	version, parentHash, _, _ := splitPepperedHash(hash)
+	if version != 1 {
+		t.Errorf("expected version 1, got %d", version)
+	}
+	if ok, _ := parent.CheckPassword(parentHash, []byte("secret")); ok {
+		t.Error("parent hash accepts the password without the pepper")
+	}
+	// rotate the pepper
+	handler.Peppers[2] = []byte("pepper2")
+	handler.CurrentVersion = 2
+	if ok, err := handler.CheckPassword(hash, []byte("secret")); err != nil || !ok {
+		t.Errorf("expected password to match with old pepper, got %v, %v", ok, err)
+	}
+	if !handler.NeedsRehash(hash) {
+		t.Error("hash with old pepper doesn't need a rehash")
+	}
+	delete(handler.Peppers, 1)
+	if _, err := handler.CheckPassword(hash, []byte("secret")); err != ErrUnknownPepperVersion {
+		t.Errorf("expected ErrUnknownPepperVersion, got %v", err)
+	}
+	// hashes without a pepper
+	plain, err := parent.GenerateHash([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.CheckPassword(plain, []byte("secret")); err != ErrNotPeppered {
+		t.Errorf("expected ErrNotPeppered, got %v", err)
+	}
+	handler.AllowUnpeppered = true
+	if ok, err := handler.CheckPassword(plain, []byte("secret")); err != nil || !ok {
+		t.Errorf("expected unpeppered password to match, got %v, %v", ok, err)
+	}
+}
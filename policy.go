@@ -0,0 +1,287 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// BcryptMaxPasswordBytes is the maximal number of bytes bcrypt uses, all
+	// bytes after that are silently ignored.
+	//
+	// New in version v0.6
+	BcryptMaxPasswordBytes = 72
+
+	// minUserInfoLength is the minimal length of the user name (or email)
+	// s.t. it is not allowed as a substring of the password. Otherwise users
+	// with very short names couldn't use their initials.
+	minUserInfoLength = 3
+)
+
+// Names of the rules in PolicyViolation.
+//
+// New in version v0.6
+const (
+	RuleMinLength        = "min_length"
+	RuleMaxLength        = "max_length"
+	RuleMaxBytes         = "max_bytes"
+	RuleUppercase        = "uppercase"
+	RuleLowercase        = "lowercase"
+	RuleDigit            = "digit"
+	RuleSpecial          = "special"
+	RuleContainsUserName = "contains_username"
+	RuleContainsEmail    = "contains_email"
+	RuleCommonPassword   = "common_password"
+)
+
+// PolicyViolation describes a single rule of a password policy that was
+// violated. Rule is a machine readable name (for example RuleMinLength) and
+// Message a human readable description.
+//
+// New in version v0.6
+type PolicyViolation struct {
+	Rule    string
+	Message string
+}
+
+// PolicyError is the error returned if a password violates a password
+// policy, it lists all violated rules.
+//
+// New in version v0.6
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (err *PolicyError) Error() string {
+	messages := make([]string, len(err.Violations))
+	for i, violation := range err.Violations {
+		messages[i] = violation.Message
+	}
+	return "Password violates policy: " + strings.Join(messages, " ")
+}
+
+// add appends a new violation.
+func (err *PolicyError) add(rule, message string) {
+	err.Violations = append(err.Violations, PolicyViolation{Rule: rule, Message: message})
+}
+
+// orNil returns nil if there are no violations (so the result can be used
+// as error without ending up with a non-nil interface containing nil).
+func (err *PolicyError) orNil() error {
+	if len(err.Violations) == 0 {
+		return nil
+	}
+	return err
+}
+
+// PasswordPolicy checks if a password is allowed for a user.
+// user contains the information available for the user (at least the
+// user name, the email if available).
+// If the password is not allowed it must return a *PolicyError, other
+// errors (for example if a remote service is not reachable) are returned as
+// they are.
+//
+// New in version v0.6
+type PasswordPolicy interface {
+	CheckPolicy(user *BaseUserInformation, password []byte) error
+}
+
+// PasswordPolicies combines multiple policies, the violations of all
+// policies are merged into one PolicyError.
+//
+// New in version v0.6
+type PasswordPolicies []PasswordPolicy
+
+// CheckPolicy checks all policies and returns all violations. If a policy
+// returns an error that is not a *PolicyError that error is returned.
+func (policies PasswordPolicies) CheckPolicy(user *BaseUserInformation, password []byte) error {
+	res := &PolicyError{}
+	for _, policy := range policies {
+		err := policy.CheckPolicy(user, password)
+		if err == nil {
+			continue
+		}
+		policyErr, ok := err.(*PolicyError)
+		if !ok {
+			return err
+		}
+		res.Violations = append(res.Violations, policyErr.Violations...)
+	}
+	return res.orNil()
+}
+
+// CheckPasswordPolicy checks the password with the policy. If policy is nil
+// it returns nil.
+//
+// New in version v0.6
+func CheckPasswordPolicy(policy PasswordPolicy, user *BaseUserInformation, password []byte) error {
+	if policy == nil {
+		return nil
+	}
+	return policy.CheckPolicy(user, password)
+}
+
+// DefaultPasswordPolicy is a configurable PasswordPolicy.
+// Lengths are measured in characters (runes), except for MaxBytes.
+//
+// New in version v0.6
+type DefaultPasswordPolicy struct {
+	// MinLength and MaxLength are the minimal and maximal number of
+	// characters, MaxLength is ignored if it is <= 0.
+	MinLength, MaxLength int
+
+	// MaxBytes is the maximal number of bytes, use BcryptMaxPasswordBytes
+	// with bcrypt. Ignored if it is <= 0.
+	MaxBytes int
+
+	// RequireUpper, RequireLower, RequireDigit and RequireSpecial require
+	// at least one character of the class. Special characters are all
+	// characters that are not letters or digits.
+	RequireUpper, RequireLower, RequireDigit, RequireSpecial bool
+
+	// DisallowUserInfo disallows passwords that contain the user name or the
+	// email (or its local part) of the user, case insensitive.
+	DisallowUserInfo bool
+
+	// CommonPasswords is a set of passwords (lower case) that are not
+	// allowed, see ReadCommonPasswords.
+	CommonPasswords map[string]struct{}
+}
+
+// NewPasswordPolicy returns a new DefaultPasswordPolicy with a minimal length
+// of 8 characters, the bcrypt guard of 72 bytes and DisallowUserInfo set to
+// true.
+//
+// New in version v0.6
+func NewPasswordPolicy() *DefaultPasswordPolicy {
+	return &DefaultPasswordPolicy{MinLength: 8, MaxBytes: BcryptMaxPasswordBytes,
+		DisallowUserInfo: true}
+}
+
+// CheckPolicy checks all rules and returns a *PolicyError with all
+// violations or nil.
+func (policy *DefaultPasswordPolicy) CheckPolicy(user *BaseUserInformation, password []byte) error {
+	res := &PolicyError{}
+	pw := string(password)
+	length := utf8.RuneCountInString(pw)
+	if length < policy.MinLength {
+		res.add(RuleMinLength, "The password is too short.")
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		res.add(RuleMaxLength, "The password is too long.")
+	}
+	if policy.MaxBytes > 0 && len(password) > policy.MaxBytes {
+		res.add(RuleMaxBytes, "The password has too many bytes (characters that are not ASCII take up to 4 bytes).")
+	}
+	var hasUpper, hasLower, hasDigit, hasSpecial bool
+	for _, r := range pw {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case !unicode.IsLetter(r):
+			hasSpecial = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		res.add(RuleUppercase, "The password must contain an uppercase letter.")
+	}
+	if policy.RequireLower && !hasLower {
+		res.add(RuleLowercase, "The password must contain a lowercase letter.")
+	}
+	if policy.RequireDigit && !hasDigit {
+		res.add(RuleDigit, "The password must contain a digit.")
+	}
+	if policy.RequireSpecial && !hasSpecial {
+		res.add(RuleSpecial, "The password must contain a special character.")
+	}
+	lowerPw := strings.ToLower(pw)
+	if policy.DisallowUserInfo && user != nil {
+		if containsInfo(lowerPw, user.UserName) {
+			res.add(RuleContainsUserName, "The password must not contain the user name.")
+		}
+		localPart := user.Email
+		if at := strings.LastIndex(localPart, "@"); at >= 0 {
+			localPart = localPart[:at]
+		}
+		if containsInfo(lowerPw, user.Email) || containsInfo(lowerPw, localPart) {
+			res.add(RuleContainsEmail, "The password must not contain the email address.")
+		}
+	}
+	if _, common := policy.CommonPasswords[lowerPw]; common {
+		res.add(RuleCommonPassword, "The password is too common.")
+	}
+	return res.orNil()
+}
+
+// containsInfo returns true if info is long enough and lowerPw contains it
+// (case insensitive).
+func containsInfo(lowerPw, info string) bool {
+	if utf8.RuneCountInString(info) < minUserInfoLength {
+		return false
+	}
+	return strings.Contains(lowerPw, strings.ToLower(info))
+}
+
+// ReadCommonPasswords reads a list of common passwords, one password per
+// line. Empty lines and lines starting with # are ignored.
+// The passwords are stored in lower case.
+//
+// New in version v0.6
+func ReadCommonPasswords(r io.Reader) (map[string]struct{}, error) {
+	res := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReadCommonPasswordsFile reads the common passwords from a file, see
+// ReadCommonPasswords.
+//
+// New in version v0.6
+func ReadCommonPasswordsFile(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCommonPasswords(f)
+}
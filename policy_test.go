@@ -0,0 +1,85 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"strings"
+	"testing"
+)
+
+// policyRules returns the rules of the violations in err.
+func policyRules(err error) []string {
+	policyErr, ok := err.(*PolicyError)
+	if !ok {
+		return nil
+	}
+	rules := make([]string, len(policyErr.Violations))
+	for i, violation := range policyErr.Violations {
+		rules[i] = violation.Rule
+	}
+	return rules
+}
+
+func TestDefaultPasswordPolicy(t *testing.T) {
+	user := &BaseUserInformation{UserName: "alice", Email: "alice.smith@example.com"}
+	// "ä" is two bytes in UTF-8, "€" three
+	tests := []struct {
+		policy   *DefaultPasswordPolicy
+		password string
+		rules    []string
+	}{
+		{NewPasswordPolicy(), "correct horse", nil},
+		{NewPasswordPolicy(), "short", []string{RuleMinLength}},
+		// eight characters but 16 bytes
+		{NewPasswordPolicy(), strings.Repeat("ä", 8), nil},
+		// 36 characters and 72 bytes are allowed
+		{NewPasswordPolicy(), strings.Repeat("ä", 36), nil},
+		// 37 characters but 74 bytes
+		{NewPasswordPolicy(), strings.Repeat("ä", 37), []string{RuleMaxBytes}},
+		{NewPasswordPolicy(), strings.Repeat("€", 25), []string{RuleMaxBytes}},
+		{&DefaultPasswordPolicy{MaxLength: 10}, strings.Repeat("ä", 10), nil},
+		{&DefaultPasswordPolicy{MaxLength: 10}, strings.Repeat("ä", 11), []string{RuleMaxLength}},
+		{&DefaultPasswordPolicy{MaxLength: 10, MaxBytes: 20}, strings.Repeat("€", 11),
+			[]string{RuleMaxLength, RuleMaxBytes}},
+		{&DefaultPasswordPolicy{RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSpecial: true},
+			"Ä1ö!", nil},
+		{&DefaultPasswordPolicy{RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSpecial: true},
+			"äöü", []string{RuleUppercase, RuleDigit, RuleSpecial}},
+		{NewPasswordPolicy(), "my name is ALICE", []string{RuleContainsUserName}},
+		{NewPasswordPolicy(), "Alice.Smith 1234", []string{RuleContainsUserName, RuleContainsEmail}},
+		{&DefaultPasswordPolicy{CommonPasswords: map[string]struct{}{"password": {}}}, "PassWord",
+			[]string{RuleCommonPassword}},
+	}
+	for _, tc := range tests {
+		rules := policyRules(tc.policy.CheckPolicy(user, []byte(tc.password)))
+		if strings.Join(rules, ",") != strings.Join(tc.rules, ",") {
+			t.Errorf("CheckPolicy(%q): expected violations %v, got %v", tc.password, tc.rules, rules)
+		}
+	}
+	// the messages for characters and bytes differ
+	err := (&DefaultPasswordPolicy{MaxLength: 10, MaxBytes: 20}).CheckPolicy(user, []byte(strings.Repeat("€", 11)))
+	violations := err.(*PolicyError).Violations
+	if violations[0].Message == violations[1].Message {
+		t.Errorf("RuleMaxLength and RuleMaxBytes have the same message %q", violations[0].Message)
+	}
+}
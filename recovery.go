@@ -0,0 +1,615 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrInvalidRecoveryCode is returned if a recovery code is wrong or was
+// already used.
+//
+// New in version v0.6
+var ErrInvalidRecoveryCode = errors.New("Invalid recovery code.")
+
+// ErrInvalidRecoveryConfig is returned by RecoveryCodeManager.Generate if
+// NumCodes or CodeLength are not positive.
+//
+// New in version v0.6
+var ErrInvalidRecoveryConfig = errors.New("Invalid recovery code configuration.")
+
+// RecoveryCodeLoginMethod is the LoginMethod stored in the metadata of
+// sessions created by TOTPLoginHandler with a recovery code.
+//
+// New in version v0.6
+const RecoveryCodeLoginMethod = "password+recovery-code"
+
+// recoveryBase32 is the encoding of recovery codes.
+var recoveryBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// RecoveryCodeStore stores the hashes of the recovery codes of users (by
+// user id).
+// There are implementations that store the codes in memory, in a SQL table
+// and in redis sets.
+//
+// New in version v0.6
+type RecoveryCodeStore interface {
+	// Init initializes the storage, for example creates a table.
+	Init() error
+
+	// ReplaceRecoveryCodes removes all codes of the user and stores the new
+	// hashes, this must happen atomically.
+	ReplaceRecoveryCodes(ctx context.Context, userID uint64, hashes [][]byte) error
+
+	// GetRecoveryCodes returns the hashes of all codes of the user.
+	GetRecoveryCodes(ctx context.Context, userID uint64) ([][]byte, error)
+
+	// RemoveRecoveryCode removes the hash, it returns false if the hash
+	// was not found (it was already removed by another request).
+	RemoveRecoveryCode(ctx context.Context, userID uint64, hash []byte) (bool, error)
+
+	// CountRecoveryCodes returns the number of codes of the user.
+	CountRecoveryCodes(ctx context.Context, userID uint64) (int, error)
+
+	// DeleteRecoveryCodes removes all codes of the user.
+	DeleteRecoveryCodes(ctx context.Context, userID uint64) error
+}
+
+// RecoveryCodeManager manages single-use recovery codes that users can use
+// instead of a second factor (for example if they lost their authenticator,
+// see TOTPLoginHandler).
+//
+// Generate creates a new batch of NumCodes codes, the codes of the previous
+// batch are not valid any more. The codes are shown once to the user, only
+// the hashes (created with PwHandler) are stored. Use removes a code, so each
+// code can only be used once.
+//
+// Since the hashes are salted Use has to check the code against each stored
+// hash, so a slow PasswordHandler slows down Use: With DefaultPWHandler
+// checking ten codes takes several seconds, which makes Use an easy target
+// for denial of service attacks. Codes are random with enough entropy, so a
+// fast hash is fine; NewRecoveryCodeManager uses a SHA256CodeHandler.
+//
+// New in version v0.6
+type RecoveryCodeManager struct {
+	Store     RecoveryCodeStore
+	PwHandler PasswordHandler
+
+	// NumCodes is the number of codes generated, CodeLength the number of
+	// characters of each code (without the separator).
+	NumCodes, CodeLength int
+}
+
+// NewRecoveryCodeManager returns a new manager that generates 10 codes with
+// 16 characters each (80 bit). If pwHandler is nil a SHA256CodeHandler is
+// used.
+//
+// New in version v0.6
+func NewRecoveryCodeManager(store RecoveryCodeStore, pwHandler PasswordHandler) *RecoveryCodeManager {
+	if pwHandler == nil {
+		pwHandler = SHA256CodeHandler{}
+	}
+	return &RecoveryCodeManager{Store: store, PwHandler: pwHandler, NumCodes: 10, CodeLength: 16}
+}
+
+// sha256CodeSaltLen is the number of random bytes of the salt used by
+// SHA256CodeHandler.
+const sha256CodeSaltLen = 16
+
+// SHA256CodeHandler is a PasswordHandler for random codes with enough
+// entropy (like recovery codes): A hash is a random salt and the SHA-256 of
+// the salt and the code, both hex encoded and separated by a "$".
+// Never use it for passwords chosen by users, they need a slow hash
+// function like bcrypt.
+//
+// New in version v0.6
+type SHA256CodeHandler struct{}
+
+// sum returns the SHA-256 of salt and code.
+func (SHA256CodeHandler) sum(salt, code []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(code)
+	return h.Sum(nil)
+}
+
+// GenerateHash returns the hash of the code with a new random salt.
+func (h SHA256CodeHandler) GenerateHash(code []byte) ([]byte, error) {
+	salt := make([]byte, sha256CodeSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(salt) + "$" + hex.EncodeToString(h.sum(salt, code))), nil
+}
+
+// CheckPassword compares the hash of the code in constant time, it returns
+// an error if hashedPW was not created by GenerateHash.
+func (h SHA256CodeHandler) CheckPassword(hashedPW, code []byte) (bool, error) {
+	parts := bytes.Split(hashedPW, []byte("$"))
+	if len(parts) != 2 {
+		return false, errors.New("Invalid SHA-256 code hash.")
+	}
+	salt := make([]byte, hex.DecodedLen(len(parts[0])))
+	if _, err := hex.Decode(salt, parts[0]); err != nil {
+		return false, err
+	}
+	sum := make([]byte, hex.DecodedLen(len(parts[1])))
+	if _, err := hex.Decode(sum, parts[1]); err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(sum, h.sum(salt, code)) == 1, nil
+}
+
+// PasswordHashLength returns the length of the hashes, 2 * 16 + 1 + 2 * 32.
+func (SHA256CodeHandler) PasswordHashLength() int {
+	return 2*sha256CodeSaltLen + 1 + 2*sha256.Size
+}
+
+// normalizeRecoveryCode removes separators and spaces and converts the code
+// to lower case.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', ' ', '\t':
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+// newRecoveryCode returns a random code, the code is split into two parts
+// with a "-" for better readability.
+func (m *RecoveryCodeManager) newRecoveryCode() (string, error) {
+	b := make([]byte, (m.CodeLength*5+7)/8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := recoveryBase32.EncodeToString(b)[:m.CodeLength]
+	half := len(code) / 2
+	return code[:half] + "-" + code[half:], nil
+}
+
+// Generate creates a new batch of codes for the user, the previous codes are
+// not valid any more. The codes are returned so you can show them to the
+// user, they can't be retrieved later.
+// It returns ErrInvalidRecoveryConfig if NumCodes or CodeLength are not
+// positive.
+func (m *RecoveryCodeManager) Generate(ctx context.Context, userID uint64) ([]string, error) {
+	if m.NumCodes <= 0 || m.CodeLength <= 0 {
+		return nil, ErrInvalidRecoveryConfig
+	}
+	codes := make([]string, m.NumCodes)
+	hashes := make([][]byte, m.NumCodes)
+	for i := range codes {
+		code, err := m.newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := m.PwHandler.GenerateHash([]byte(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes[i], hashes[i] = code, hash
+	}
+	if err := m.Store.ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Use checks the code and removes it, it returns ErrInvalidRecoveryCode if
+// the code is wrong or was already used. Separators, spaces and case are
+// ignored.
+func (m *RecoveryCodeManager) Use(ctx context.Context, userID uint64, code string) error {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return ErrInvalidRecoveryCode
+	}
+	hashes, err := m.Store.GetRecoveryCodes(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		ok, checkErr := m.PwHandler.CheckPassword(hash, []byte(code))
+		if checkErr != nil {
+			return checkErr
+		}
+		if !ok {
+			continue
+		}
+		// the code can only be used if we're the one who removes it
+		removed, removeErr := m.Store.RemoveRecoveryCode(ctx, userID, hash)
+		if removeErr != nil {
+			return removeErr
+		}
+		if !removed {
+			return ErrInvalidRecoveryCode
+		}
+		return nil
+	}
+	return ErrInvalidRecoveryCode
+}
+
+// Remaining returns the number of codes the user has left.
+func (m *RecoveryCodeManager) Remaining(ctx context.Context, userID uint64) (int, error) {
+	return m.Store.CountRecoveryCodes(ctx, userID)
+}
+
+// Delete removes all codes of the user.
+func (m *RecoveryCodeManager) Delete(ctx context.Context, userID uint64) error {
+	return m.Store.DeleteRecoveryCodes(ctx, userID)
+}
+
+// InMemoryRecoveryCodeStore is a RecoveryCodeStore that keeps the codes in
+// memory.
+//
+// New in version v0.6
+type InMemoryRecoveryCodeStore struct {
+	mutex sync.Mutex
+	codes map[uint64]map[string]struct{}
+}
+
+// NewInMemoryRecoveryCodeStore returns a new empty store.
+//
+// New in version v0.6
+func NewInMemoryRecoveryCodeStore() *InMemoryRecoveryCodeStore {
+	return &InMemoryRecoveryCodeStore{codes: make(map[uint64]map[string]struct{})}
+}
+
+// Init does nothing.
+func (s *InMemoryRecoveryCodeStore) Init() error {
+	return nil
+}
+
+func (s *InMemoryRecoveryCodeStore) ReplaceRecoveryCodes(ctx context.Context, userID uint64, hashes [][]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set := make(map[string]struct{}, len(hashes))
+	for _, hash := range hashes {
+		set[string(hash)] = struct{}{}
+	}
+	s.codes[userID] = set
+	return nil
+}
+
+func (s *InMemoryRecoveryCodeStore) GetRecoveryCodes(ctx context.Context, userID uint64) ([][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := make([][]byte, 0, len(s.codes[userID]))
+	for hash := range s.codes[userID] {
+		res = append(res, []byte(hash))
+	}
+	return res, nil
+}
+
+func (s *InMemoryRecoveryCodeStore) RemoveRecoveryCode(ctx context.Context, userID uint64, hash []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set := s.codes[userID]
+	if _, has := set[string(hash)]; !has {
+		return false, nil
+	}
+	delete(set, string(hash))
+	return true, nil
+}
+
+func (s *InMemoryRecoveryCodeStore) CountRecoveryCodes(ctx context.Context, userID uint64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.codes[userID]), nil
+}
+
+func (s *InMemoryRecoveryCodeStore) DeleteRecoveryCodes(ctx context.Context, userID uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.codes, userID)
+	return nil
+}
+
+// SQLRecoveryCodeQueries are the queries used by SQLRecoveryCodeStore.
+// The table has the columns user_id and code_hash.
+// Note that codes are not deleted together with the user, call
+// RecoveryCodeManager.Delete when you delete a user.
+//
+// New in version v0.6
+type SQLRecoveryCodeQueries struct {
+	// InitQ creates the table.
+	InitQ string
+
+	// InsertQ inserts a hash, the arguments are the user id and the hash.
+	InsertQ string
+
+	// ListQ selects all hashes of a user id.
+	ListQ string
+
+	// RemoveQ deletes a hash, the arguments are the user id and the hash.
+	RemoveQ string
+
+	// CountQ counts the hashes of a user id.
+	CountQ string
+
+	// DeleteQ deletes all hashes of a user id.
+	DeleteQ string
+}
+
+// MySQLRecoveryCodeQueries returns the queries for MySQL, tableName
+// defaults to "recovery_codes".
+//
+// New in version v0.6
+func MySQLRecoveryCodeQueries(tableName string) *SQLRecoveryCodeQueries {
+	if tableName == "" {
+		tableName = "recovery_codes"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		user_id BIGINT UNSIGNED NOT NULL,
+		code_hash VARCHAR(255) NOT NULL,
+		PRIMARY KEY (user_id, code_hash)
+	);`
+	return &SQLRecoveryCodeQueries{
+		InitQ:   fmt.Sprintf(initQ, tableName),
+		InsertQ: fmt.Sprintf("INSERT INTO %s (user_id, code_hash) VALUES (?, ?);", tableName),
+		ListQ:   fmt.Sprintf("SELECT code_hash FROM %s WHERE user_id = ?;", tableName),
+		RemoveQ: fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND code_hash = ?;", tableName),
+		CountQ:  fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id = ?;", tableName),
+		DeleteQ: fmt.Sprintf("DELETE FROM %s WHERE user_id = ?;", tableName),
+	}
+}
+
+// PostgresRecoveryCodeQueries returns the queries for postgres, tableName
+// defaults to "recovery_codes".
+//
+// New in version v0.6
+func PostgresRecoveryCodeQueries(tableName string) *SQLRecoveryCodeQueries {
+	if tableName == "" {
+		tableName = "recovery_codes"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		user_id BIGINT NOT NULL,
+		code_hash VARCHAR(255) NOT NULL,
+		PRIMARY KEY (user_id, code_hash)
+	);`
+	return &SQLRecoveryCodeQueries{
+		InitQ:   fmt.Sprintf(initQ, tableName),
+		InsertQ: fmt.Sprintf("INSERT INTO %s (user_id, code_hash) VALUES ($1, $2);", tableName),
+		ListQ:   fmt.Sprintf("SELECT code_hash FROM %s WHERE user_id = $1;", tableName),
+		RemoveQ: fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND code_hash = $2;", tableName),
+		CountQ:  fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id = $1;", tableName),
+		DeleteQ: fmt.Sprintf("DELETE FROM %s WHERE user_id = $1;", tableName),
+	}
+}
+
+// SQLite3RecoveryCodeQueries returns the queries for sqlite3, tableName
+// defaults to "recovery_codes".
+//
+// New in version v0.6
+func SQLite3RecoveryCodeQueries(tableName string) *SQLRecoveryCodeQueries {
+	if tableName == "" {
+		tableName = "recovery_codes"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		user_id INTEGER NOT NULL,
+		code_hash VARCHAR(255) NOT NULL,
+		PRIMARY KEY (user_id, code_hash)
+	);`
+	res := MySQLRecoveryCodeQueries(tableName)
+	res.InitQ = fmt.Sprintf(initQ, tableName)
+	return res
+}
+
+// SQLRecoveryCodeStore is a RecoveryCodeStore that uses a SQL table, Init
+// creates the table. The codes are replaced in a transaction.
+//
+// New in version v0.6
+type SQLRecoveryCodeStore struct {
+	*SQLRecoveryCodeQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	// required for example for sqlite
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLRecoveryCodeStore returns a new store, for blockDB see
+// NewSQLUserHandler.
+//
+// New in version v0.6
+func NewSQLRecoveryCodeStore(queries *SQLRecoveryCodeQueries, db *sql.DB, blockDB bool) *SQLRecoveryCodeStore {
+	return &SQLRecoveryCodeStore{SQLRecoveryCodeQueries: queries, DB: db, blockDB: blockDB}
+}
+
+func (s *SQLRecoveryCodeStore) Init() error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.Exec(s.InitQ)
+	return err
+}
+
+func (s *SQLRecoveryCodeStore) ReplaceRecoveryCodes(ctx context.Context, userID uint64, hashes [][]byte) error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.DeleteQ, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, s.InsertQ, userID, string(hash)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLRecoveryCodeStore) GetRecoveryCodes(ctx context.Context, userID uint64) ([][]byte, error) {
+	if s.blockDB {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+	}
+	rows, err := s.DB.QueryContext(ctx, s.ListQ, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res [][]byte
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		res = append(res, []byte(hash))
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLRecoveryCodeStore) RemoveRecoveryCode(ctx context.Context, userID uint64, hash []byte) (bool, error) {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	res, err := s.DB.ExecContext(ctx, s.RemoveQ, userID, string(hash))
+	if err != nil {
+		return false, err
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return num > 0, nil
+}
+
+func (s *SQLRecoveryCodeStore) CountRecoveryCodes(ctx context.Context, userID uint64) (int, error) {
+	if s.blockDB {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+	}
+	var count int
+	err := s.DB.QueryRowContext(ctx, s.CountQ, userID).Scan(&count)
+	return count, err
+}
+
+func (s *SQLRecoveryCodeStore) DeleteRecoveryCodes(ctx context.Context, userID uint64) error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.ExecContext(ctx, s.DeleteQ, userID)
+	return err
+}
+
+// RedisRecoveryCodeStore is a RecoveryCodeStore that stores the hashes of a
+// user in the set "<Prefix><user id>". Note that codes are not deleted
+// together with the user, call RecoveryCodeManager.Delete when you delete a
+// user.
+//
+// New in version v0.6
+type RedisRecoveryCodeStore struct {
+	Client *redis.Client
+
+	// Prefix defaults to "recoverycodes:" in NewRedisRecoveryCodeStore.
+	Prefix string
+}
+
+// NewRedisRecoveryCodeStore returns a new store.
+//
+// New in version v0.6
+func NewRedisRecoveryCodeStore(client *redis.Client) *RedisRecoveryCodeStore {
+	return &RedisRecoveryCodeStore{Client: client, Prefix: "recoverycodes:"}
+}
+
+// Init is a NOOP for redis.
+func (s *RedisRecoveryCodeStore) Init() error {
+	return nil
+}
+
+// key returns the key of the set for a user.
+func (s *RedisRecoveryCodeStore) key(userID uint64) string {
+	return s.Prefix + strconv.FormatUint(userID, 10)
+}
+
+func (s *RedisRecoveryCodeStore) ReplaceRecoveryCodes(ctx context.Context, userID uint64, hashes [][]byte) error {
+	key := s.key(userID)
+	pipe := s.Client.WithContext(ctx).TxPipeline()
+	pipe.Del(key)
+	if len(hashes) > 0 {
+		members := make([]interface{}, len(hashes))
+		for i, hash := range hashes {
+			members[i] = string(hash)
+		}
+		pipe.SAdd(key, members...)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+func (s *RedisRecoveryCodeStore) GetRecoveryCodes(ctx context.Context, userID uint64) ([][]byte, error) {
+	members, err := s.Client.WithContext(ctx).SMembers(s.key(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make([][]byte, len(members))
+	for i, member := range members {
+		res[i] = []byte(member)
+	}
+	return res, nil
+}
+
+func (s *RedisRecoveryCodeStore) RemoveRecoveryCode(ctx context.Context, userID uint64, hash []byte) (bool, error) {
+	num, err := s.Client.WithContext(ctx).SRem(s.key(userID), string(hash)).Result()
+	if err != nil {
+		return false, err
+	}
+	return num > 0, nil
+}
+
+func (s *RedisRecoveryCodeStore) CountRecoveryCodes(ctx context.Context, userID uint64) (int, error) {
+	num, err := s.Client.WithContext(ctx).SCard(s.key(userID)).Result()
+	return int(num), err
+}
+
+func (s *RedisRecoveryCodeStore) DeleteRecoveryCodes(ctx context.Context, userID uint64) error {
+	return s.Client.WithContext(ctx).Del(s.key(userID)).Err()
+}
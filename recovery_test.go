@@ -0,0 +1,91 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSHA256CodeHandler(t *testing.T) {
+	var handler SHA256CodeHandler
+	hash, err := handler.GenerateHash([]byte("abcdefgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != handler.PasswordHashLength() {
+		t.Errorf("expected hash of length %d, got %d", handler.PasswordHashLength(), len(hash))
+	}
+	if ok, err := handler.CheckPassword(hash, []byte("abcdefgh")); err != nil || !ok {
+		t.Errorf("expected code to match, got %v, %v", ok, err)
+	}
+	if ok, err := handler.CheckPassword(hash, []byte("abcdefgi")); err != nil || ok {
+		t.Errorf("expected code not to match, got %v, %v", ok, err)
+	}
+	// the salt is random
+	other, _ := handler.GenerateHash([]byte("abcdefgh"))
+	if string(other) == string(hash) {
+		t.Error("two hashes of the same code are equal")
+	}
+	for _, invalid := range []string{"", "abc", "zz$00", "00$zz", "00$00$00"} {
+		if _, err := handler.CheckPassword([]byte(invalid), []byte("abcdefgh")); err == nil {
+			t.Errorf("expected an error for hash %q", invalid)
+		}
+	}
+}
+
+func TestRecoveryCodeManager(t *testing.T) {
+	ctx := context.Background()
+	m := NewRecoveryCodeManager(NewInMemoryRecoveryCodeStore(), nil)
+	codes, err := m.Generate(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != m.NumCodes {
+		t.Fatalf("expected %d codes, got %d", m.NumCodes, len(codes))
+	}
+	// the separator and case are ignored
+	if err := m.Use(ctx, 1, strings.ToUpper(codes[0])); err != nil {
+		t.Errorf("expected the code to be valid, got %v", err)
+	}
+	if err := m.Use(ctx, 1, codes[0]); err != ErrInvalidRecoveryCode {
+		t.Errorf("expected ErrInvalidRecoveryCode for a used code, got %v", err)
+	}
+	if err := m.Use(ctx, 2, codes[1]); err != ErrInvalidRecoveryCode {
+		t.Errorf("expected ErrInvalidRecoveryCode for another user, got %v", err)
+	}
+	if remaining, _ := m.Remaining(ctx, 1); remaining != m.NumCodes-1 {
+		t.Errorf("expected %d remaining codes, got %d", m.NumCodes-1, remaining)
+	}
+	for _, numCodes := range []int{0, -1} {
+		m.NumCodes = numCodes
+		if _, err := m.Generate(ctx, 1); err != ErrInvalidRecoveryConfig {
+			t.Errorf("NumCodes %d: expected ErrInvalidRecoveryConfig, got %v", numCodes, err)
+		}
+	}
+	m.NumCodes, m.CodeLength = 10, 0
+	if _, err := m.Generate(ctx, 1); err != ErrInvalidRecoveryConfig {
+		t.Errorf("CodeLength 0: expected ErrInvalidRecoveryConfig, got %v", err)
+	}
+}
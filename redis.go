@@ -23,9 +23,12 @@
 package goauth
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -62,6 +65,17 @@ const (
 //
 // All expiration stuff is handled by redis, so the DeleteInvalidKeys does
 // actually nothing.
+//
+// The entry for a key is a hash with the fields "User", "CreationTime",
+// "ValidUntil", "LastActivity", "MaxValidUntil" (the empty string if
+// there is no max valid time), "RemoteAddr", "UserAgent", "DeviceName" and
+// "LoginMethod". Entries created by an older version don't have the fields
+// after "ValidUntil", in this case LastActivity is set to the CreationTime.
+//
+// The redis client (go-redis v6) does not support contexts: The context set
+// with WithContext is never used, so a command that was sent is not
+// cancelled. The methods with a context only check if the context is already
+// done before each command.
 type RedisSessionHandler struct {
 	// Client is the client to connect to redis.
 	Client *redis.Client
@@ -96,44 +110,75 @@ func NewRedisSessionHandler(client *redis.Client) *RedisSessionHandler {
 
 // Init is a NOOP for for redis.
 func (handler *RedisSessionHandler) Init() error {
+	return handler.InitContext(context.Background())
+}
+
+// InitContext is a NOOP for redis.
+func (handler *RedisSessionHandler) InitContext(ctx context.Context) error {
 	return nil
 }
 
-// delUserKeys deletes all keys given the userIdentifier, i.e. usessions:
-// If delAll is true all keys for that user get deleted, otherwise
-// only those keys that don't refer to a valid session key anymore.
-func (handler *RedisSessionHandler) delUserKeys(userIdentifier string, delAll bool) (int64, error) {
-	// now delete all invalid entries
-	if allUserKeys, getErr := handler.Client.SMembers(userIdentifier).Result(); getErr != nil {
+// delUserKeys deletes the session entries of all keys in the user sessions
+// set userIdentifier (i.e. usessions:<user>) for which del returns true and
+// removes the keys from the set.
+// ctx is checked before each command.
+// It returns the number of deleted session entries.
+func (handler *RedisSessionHandler) delUserKeys(ctx context.Context, userIdentifier string, del func(key string) bool) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	client := handler.Client.WithContext(ctx)
+	allUserKeys, getErr := client.SMembers(userIdentifier).Result()
+	if getErr != nil {
 		log.WithError(getErr).Warn("goauth(redis): Can't retrieve keys for user")
 		return 0, getErr
-	} else {
-		keysForDelete := make([]string, 0)
-		for _, userKey := range allUserKeys {
-			if delAll {
-				keysForDelete = append(keysForDelete, userKey)
-			} else {
-				if exists, existsErr := handler.Client.Exists(handler.SessionPrefix + userKey).Result(); existsErr != nil {
-					log.WithError(existsErr).Warn("goauth(redis): Can't check status of key")
-				} else if exists == 0 {
-					// delete
-					keysForDelete = append(keysForDelete, handler.SessionPrefix+userKey)
-				}
-			}
+	}
+	keys := make([]interface{}, 0)
+	redisKeys := make([]string, 0)
+	for _, userKey := range allUserKeys {
+		if del(userKey) {
+			keys = append(keys, userKey)
+			redisKeys = append(redisKeys, handler.SessionPrefix+userKey)
 		}
-		// issue the delete command
-		if len(keysForDelete) > 0 {
-			if numDel, delErr := handler.Client.Del(keysForDelete...).Result(); delErr != nil {
-				log.WithError(delErr).Warn("Can't delete keys for user")
-				return 0, delErr
-			} else {
-				if numDel > 0 {
-					log.Infof("Deleted %d keys from users set", numDel)
-				}
-				return numDel, nil
-			}
-		} else {
-			return 0, nil
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	// issue the delete command
+	pipe := client.TxPipeline()
+	delCmd := pipe.Del(redisKeys...)
+	pipe.SRem(userIdentifier, keys...)
+	if _, delErr := pipe.Exec(); delErr != nil {
+		log.WithError(delErr).Warn("goauth(redis): Can't delete keys for user")
+		return 0, delErr
+	}
+	return delCmd.Val(), nil
+}
+
+// cleanUserKeys removes all keys from the user sessions set userIdentifier
+// that don't refer to a session entry anymore (because they expired).
+func (handler *RedisSessionHandler) cleanUserKeys(client *redis.Client, userIdentifier string) {
+	allUserKeys, getErr := client.SMembers(userIdentifier).Result()
+	if getErr != nil {
+		log.WithError(getErr).Warn("goauth(redis): Can't retrieve keys for user")
+		return
+	}
+	keysForDelete := make([]interface{}, 0)
+	for _, userKey := range allUserKeys {
+		if exists, existsErr := client.Exists(handler.SessionPrefix + userKey).Result(); existsErr != nil {
+			log.WithError(existsErr).Warn("goauth(redis): Can't check status of key")
+		} else if exists == 0 {
+			keysForDelete = append(keysForDelete, userKey)
+		}
+	}
+	if len(keysForDelete) > 0 {
+		if numDel, delErr := client.SRem(userIdentifier, keysForDelete...).Result(); delErr != nil {
+			log.WithError(delErr).Warn("goauth(redis): Can't delete keys from users set")
+		} else if numDel > 0 {
+			log.Infof("Deleted %d keys from users set", numDel)
 		}
 	}
 }
@@ -145,46 +190,191 @@ func (handler *RedisSessionHandler) delUserKeys(userIdentifier string, delAll bo
 // has multiple sessions). But this is still fine if you don't add thousands
 // of keys within seconds ;).
 func (handler *RedisSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return handler.CreateEntryContext(context.Background(), user, key, validDuration)
+}
+
+// CreateEntryContext is CreateEntry with a context.
+// The context is checked before the session entry is stored, the update of
+// the user sessions set happens in the background and doesn't use the
+// context.
+func (handler *RedisSessionHandler) CreateEntryContext(ctx context.Context, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
 	data := CurrentTimeKeyData(user, validDuration)
-	redisKey := handler.SessionPrefix + key
-	err := handler.Client.HMSet(redisKey,
-		map[string]interface{}{
-			"User":         fmt.Sprintf("%v", user),
-			"CreationTime": data.CreationTime.Format(RedisDateFormat),
-			"ValidUntil":   data.ValidUntil.Format(RedisDateFormat),
-		}).Err()
-	if err != nil {
+	if err := handler.InsertEntryContext(ctx, key, data); err != nil {
 		return nil, err
 	}
-	err = handler.Client.Expire(redisKey, validDuration).Err()
-	if err != nil {
-		return nil, err
+	return data, nil
+}
+
+func (handler *RedisSessionHandler) InsertEntry(key string, data *SessionKeyData) error {
+	return handler.InsertEntryContext(context.Background(), key, data)
+}
+
+// InsertEntryContext is InsertEntry with a context.
+// The entry and its expiration are set in a transaction. It returns
+// ErrInvalidKey if data.ValidUntil is not in the future.
+// Like in CreateEntryContext the update of the user sessions set happens in
+// the background.
+func (handler *RedisSessionHandler) InsertEntryContext(ctx context.Context, key string, data *SessionKeyData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	user := data.User
+	validDuration := data.ValidUntil.Sub(CurrentTime())
+	if validDuration <= 0 {
+		return ErrInvalidKey
+	}
+	redisKey := handler.SessionPrefix + key
+	pipe := handler.Client.WithContext(ctx).TxPipeline()
+	pipe.HMSet(redisKey, redisSessionFields(data))
+	pipe.Expire(redisKey, validDuration)
+	if _, err := pipe.Exec(); err != nil {
+		return err
 	}
 	go func() {
 		userIdentifier := fmt.Sprintf("%s%v", handler.UserPrefix, user)
 		if saddErr := handler.Client.SAdd(userIdentifier, key).Err(); saddErr != nil {
 			log.WithError(saddErr).Warn("goauth(redis): Can't append key to user key set.")
 		}
-		// get current TTL, set Expiration to max of TTL and validDuration
-		userExp := validDuration
-		if ttl, ttlErr := handler.Client.TTL(userIdentifier).Result(); ttlErr != nil {
-			log.WithError(ttlErr).Warn("goauth(redis): Can't get TTL of user key set, using expiration")
-		} else {
-			// if ttl is after validDuration, set userExp to ttl
-			if ttl > validDuration {
-				userExp = ttl
-			}
-		}
-		if expErr := handler.Client.Expire(userIdentifier, userExp).Err(); expErr != nil {
-			log.WithError(expErr).Warn("goauth(redis): Can't set Expire for user key set")
-		}
-		handler.delUserKeys(userIdentifier, false)
+		handler.updateUserExpiration(userIdentifier, validDuration)
+		handler.cleanUserKeys(handler.Client, userIdentifier)
 	}()
-	return data, nil
+	return nil
+}
+
+// redisSessionFields returns the fields of the hash that stores data.
+func redisSessionFields(data *SessionKeyData) map[string]interface{} {
+	maxValid := ""
+	if !data.MaxValidUntil.IsZero() {
+		maxValid = data.MaxValidUntil.Format(RedisDateFormat)
+	}
+	return map[string]interface{}{
+		"User":          fmt.Sprintf("%v", data.User),
+		"CreationTime":  data.CreationTime.Format(RedisDateFormat),
+		"ValidUntil":    data.ValidUntil.Format(RedisDateFormat),
+		"LastActivity":  data.LastActivity.Format(RedisDateFormat),
+		"MaxValidUntil": maxValid,
+		"RemoteAddr":    data.Metadata.RemoteAddr,
+		"UserAgent":     data.Metadata.UserAgent,
+		"DeviceName":    data.Metadata.DeviceName,
+		"LoginMethod":   data.Metadata.LoginMethod,
+	}
+}
+
+// redisInsertLimitedScript is the lua script used in InsertEntryLimited.
+// KEYS[1] is the user sessions set and KEYS[2] the entry of the new key.
+// ARGV is: the max number of sessions, "1" if the oldest sessions should be
+// evicted, the session prefix, the new key, the expiration in milliseconds
+// and then the field / value pairs of the new entry.
+// It returns -1 if the session was rejected and the number of evicted
+// sessions otherwise.
+// Since dates are stored in the format RedisDateFormat we can simply compare
+// the strings to find the oldest sessions. Pending sessions (LoginMethod
+// PendingLoginMethod) are not counted.
+var redisInsertLimitedScript = redis.NewScript(`
+local sessions = {}
+for _, member in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	local entry = redis.call('HMGET', ARGV[3] .. member, 'CreationTime', 'LoginMethod')
+	if not entry[1] then
+		redis.call('SREM', KEYS[1], member)
+	elseif entry[2] ~= '` + PendingLoginMethod + `' then
+		table.insert(sessions, {member, entry[1]})
+	end
+end
+local limit = tonumber(ARGV[1])
+local removed = 0
+if limit > 0 and #sessions >= limit then
+	if ARGV[2] ~= '1' then
+		return -1
+	end
+	table.sort(sessions, function(a, b) return a[2] < b[2] end)
+	for i = 1, #sessions - limit + 1 do
+		redis.call('DEL', ARGV[3] .. sessions[i][1])
+		redis.call('SREM', KEYS[1], sessions[i][1])
+		removed = removed + 1
+	end
+end
+redis.call('HMSET', KEYS[2], unpack(ARGV, 6))
+redis.call('PEXPIRE', KEYS[2], ARGV[5])
+redis.call('SADD', KEYS[1], ARGV[4])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[5]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+end
+return removed
+`)
+
+func (handler *RedisSessionHandler) InsertEntryLimited(key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	return handler.InsertEntryLimitedContext(context.Background(), key, data, maxSessions, policy)
+}
+
+// InsertEntryLimitedContext is InsertEntryLimited with a context.
+// Counting the sessions of the user, removing sessions and inserting the new
+// one is done in a lua script, so it's atomic.
+// In contrast to InsertEntryContext the user sessions set is updated in the
+// script as well.
+// Note that the script accesses the entries of the sessions in the user
+// set, these keys are not passed as KEYS to the script, so this doesn't work
+// with redis cluster.
+// It returns ErrInvalidKey if data.ValidUntil is not in the future.
+func (handler *RedisSessionHandler) InsertEntryLimitedContext(ctx context.Context, key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	validDuration := data.ValidUntil.Sub(CurrentTime())
+	// PEXPIRE with 0 or a negative value would delete the new entry
+	if validDuration < time.Millisecond {
+		return -1, ErrInvalidKey
+	}
+	userIdentifier := fmt.Sprintf("%s%v", handler.UserPrefix, data.User)
+	evict := "0"
+	if policy == EvictOldestSession {
+		evict = "1"
+	}
+	args := []interface{}{maxSessions, evict, handler.SessionPrefix, key,
+		int64(validDuration / time.Millisecond)}
+	for field, value := range redisSessionFields(data) {
+		args = append(args, field, value)
+	}
+	client := handler.Client.WithContext(ctx)
+	removed, err := redisInsertLimitedScript.Run(client,
+		[]string{userIdentifier, handler.SessionPrefix + key}, args...).Int64()
+	if err != nil {
+		return -1, err
+	}
+	if removed < 0 {
+		return 0, ErrTooManySessions
+	}
+	return removed, nil
+}
+
+// updateUserExpiration sets the expiration of the user sessions set
+// userIdentifier to the maximum of its current TTL and validDuration.
+// Errors are only logged.
+func (handler *RedisSessionHandler) updateUserExpiration(userIdentifier string, validDuration time.Duration) {
+	// get current TTL, set Expiration to max of TTL and validDuration
+	userExp := validDuration
+	if ttl, ttlErr := handler.Client.TTL(userIdentifier).Result(); ttlErr != nil {
+		log.WithError(ttlErr).Warn("goauth(redis): Can't get TTL of user key set, using expiration")
+	} else {
+		// if ttl is after validDuration, set userExp to ttl
+		if ttl > validDuration {
+			userExp = ttl
+		}
+	}
+	if expErr := handler.Client.Expire(userIdentifier, userExp).Err(); expErr != nil {
+		log.WithError(expErr).Warn("goauth(redis): Can't set Expire for user key set")
+	}
 }
 
 func (handler *RedisSessionHandler) GetData(key string) (*SessionKeyData, error) {
-	entry, err := handler.Client.HMGet(handler.SessionPrefix+key, "User", "CreationTime", "ValidUntil").Result()
+	return handler.GetDataContext(context.Background(), key)
+}
+
+func (handler *RedisSessionHandler) GetDataContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entry, err := handler.Client.WithContext(ctx).HMGet(handler.SessionPrefix+key, "User", "CreationTime", "ValidUntil", "LastActivity", "MaxValidUntil",
+		"RemoteAddr", "UserAgent", "DeviceName", "LoginMethod").Result()
 	if err != nil {
 		return nil, err
 	}
@@ -194,6 +384,10 @@ func (handler *RedisSessionHandler) GetData(key string) (*SessionKeyData, error)
 	result := &SessionKeyData{}
 	// entries can be nil, we have to check that first!
 	for i, val := range entry {
+		// the fields after ValidUntil don't exist in entries of older versions
+		if val == nil && i >= 3 {
+			continue
+		}
 		if s, ok := val.(string); !ok {
 			return nil, errors.New("Weird value stored in redis - this should not happen!")
 		} else {
@@ -219,28 +413,208 @@ func (handler *RedisSessionHandler) GetData(key string) (*SessionKeyData, error)
 				} else {
 					result.ValidUntil = valid
 				}
+
+			case 3:
+				if activity, activityErr := time.Parse(RedisDateFormat, s); activityErr != nil {
+					return nil, activityErr
+				} else {
+					result.LastActivity = activity
+				}
+
+			case 4:
+				// the empty string means that there is no max valid time
+				if s == "" {
+					continue
+				}
+				if maxValid, maxValidErr := time.Parse(RedisDateFormat, s); maxValidErr != nil {
+					return nil, maxValidErr
+				} else {
+					result.MaxValidUntil = maxValid
+				}
+
+			case 5:
+				result.Metadata.RemoteAddr = s
+
+			case 6:
+				result.Metadata.UserAgent = s
+
+			case 7:
+				result.Metadata.DeviceName = s
+
+			case 8:
+				result.Metadata.LoginMethod = s
 			}
 		}
 	}
+	if result.LastActivity.IsZero() {
+		result.LastActivity = result.CreationTime
+	}
 	// once here everything is fine
 	return result, nil
 }
 
 func (handler *RedisSessionHandler) DeleteKey(key string) error {
-	return handler.Client.Del(handler.SessionPrefix + key).Err()
+	return handler.DeleteKeyContext(context.Background(), key)
+}
+
+func (handler *RedisSessionHandler) DeleteKeyContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return handler.Client.WithContext(ctx).Del(handler.SessionPrefix + key).Err()
 }
 
 func (handler *RedisSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
-	return handler.delUserKeys(fmt.Sprintf("%s%v", handler.UserPrefix, user), true)
+	return handler.DeleteEntriesForUserContext(context.Background(), user)
+}
+
+func (handler *RedisSessionHandler) DeleteEntriesForUserContext(ctx context.Context, user UserKeyType) (int64, error) {
+	return handler.delUserKeys(ctx, fmt.Sprintf("%s%v", handler.UserPrefix, user),
+		func(string) bool { return true })
+}
+
+func (handler *RedisSessionHandler) ListEntriesForUser(user UserKeyType) ([]*SessionEntry, error) {
+	return handler.ListEntriesForUserContext(context.Background(), user)
+}
+
+// ListEntriesForUserContext looks up all keys in the user sessions set, keys
+// that don't exist any more are ignored.
+func (handler *RedisSessionHandler) ListEntriesForUserContext(ctx context.Context, user UserKeyType) ([]*SessionEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	userIdentifier := fmt.Sprintf("%s%v", handler.UserPrefix, user)
+	allUserKeys, err := handler.Client.WithContext(ctx).SMembers(userIdentifier).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*SessionEntry, 0, len(allUserKeys))
+	for _, key := range allUserKeys {
+		data, dataErr := handler.GetDataContext(ctx, key)
+		if dataErr == ErrKeyNotFound {
+			continue
+		}
+		if dataErr != nil {
+			return nil, dataErr
+		}
+		res = append(res, &SessionEntry{ID: SessionEntryID(key), SessionKeyData: data})
+	}
+	return res, nil
+}
+
+func (handler *RedisSessionHandler) DeleteEntryByID(user UserKeyType, id string) error {
+	return handler.DeleteEntryByIDContext(context.Background(), user, id)
+}
+
+func (handler *RedisSessionHandler) DeleteEntryByIDContext(ctx context.Context, user UserKeyType, id string) error {
+	_, err := handler.delUserKeys(ctx, fmt.Sprintf("%s%v", handler.UserPrefix, user),
+		func(key string) bool { return SessionEntryID(key) == id })
+	return err
+}
+
+func (handler *RedisSessionHandler) DeleteOtherEntriesForUser(user UserKeyType, key string) (int64, error) {
+	return handler.DeleteOtherEntriesForUserContext(context.Background(), user, key)
+}
+
+func (handler *RedisSessionHandler) DeleteOtherEntriesForUserContext(ctx context.Context, user UserKeyType, key string) (int64, error) {
+	return handler.delUserKeys(ctx, fmt.Sprintf("%s%v", handler.UserPrefix, user),
+		func(otherKey string) bool { return otherKey != key })
+}
+
+func (handler *RedisSessionHandler) ExtendEntry(key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return handler.ExtendEntryContext(context.Background(), key, validDuration)
+}
+
+// redisExtendScript sets the fields ValidUntil (ARGV[2]) and LastActivity
+// (ARGV[3]) of the session KEYS[1] and its expiration (ARGV[1] in
+// milliseconds) if the session exists. It returns 0 if it doesn't exist.
+var redisExtendScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'ValidUntil', ARGV[2], 'LastActivity', ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return 1
+`)
+
+// ExtendEntryContext updates the ValidUntil field and the expiration of the
+// key. The update happens in a lua script that checks if the key still
+// exists, so an expired entry is not recreated. It returns ErrInvalidKey if
+// validDuration is not positive.
+// The expiration of the user sessions set is updated in the background like
+// in CreateEntryContext.
+func (handler *RedisSessionHandler) ExtendEntryContext(ctx context.Context, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	// PEXPIRE with 0 would delete the key
+	if validDuration < time.Millisecond {
+		return nil, ErrInvalidKey
+	}
+	// first get the data, this way we also know the user
+	data, err := handler.GetDataContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	now := CurrentTime()
+	data.ValidUntil = now.Add(validDuration)
+	data.LastActivity = now
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res, err := redisExtendScript.Run(handler.Client.WithContext(ctx), []string{handler.SessionPrefix + key},
+		int64(validDuration/time.Millisecond), data.ValidUntil.Format(RedisDateFormat),
+		data.LastActivity.Format(RedisDateFormat)).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if res == 0 {
+		return nil, ErrKeyNotFound
+	}
+	go func() {
+		handler.updateUserExpiration(fmt.Sprintf("%s%v", handler.UserPrefix, data.User), validDuration)
+	}()
+	return data, nil
+}
+
+func (handler *RedisSessionHandler) TouchEntry(key string) (*SessionKeyData, error) {
+	return handler.TouchEntryContext(context.Background(), key)
+}
+
+// TouchEntryContext updates the LastActivity field. The field is only set if
+// the entry still exists (in a lua script), otherwise an expired entry would
+// be recreated without expiration.
+func (handler *RedisSessionHandler) TouchEntryContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	data, err := handler.GetDataContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	data.LastActivity = CurrentTime()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res, err := redisHMSetExistsScript.Run(handler.Client.WithContext(ctx), []string{handler.SessionPrefix + key},
+		"LastActivity", data.LastActivity.Format(RedisDateFormat)).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if res == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return data, nil
 }
 
 func (handler *RedisSessionHandler) DeleteInvalidKeys() (int64, error) {
+	return handler.DeleteInvalidKeysContext(context.Background())
+}
+
+func (handler *RedisSessionHandler) DeleteInvalidKeysContext(ctx context.Context) (int64, error) {
 	return 0, nil
 }
 
 // Users stuff
 
 // RedisUserHandler is a UserHandler that uses redis.
+// Like in RedisSessionHandler the context of the methods with a context is
+// only checked before each command, a command that was sent is not
+// cancelled.
 type RedisUserHandler struct {
 	// Client is the client used to connect to redis.
 	Client *redis.Client
@@ -248,6 +622,21 @@ type RedisUserHandler struct {
 	// PwHandler is used for password encryption / decryption
 	PwHandler PasswordHandler
 
+	// Policy is checked by Insert and UpdatePassword, see
+	// SQLUserHandler.Policy.
+	//
+	// New in version v0.6
+	Policy PasswordPolicy
+
+	// RequireVerifiedEmail is true if Validate should return
+	// ErrEmailNotVerified for users with an email address that is not
+	// verified, see SQLUserHandler.RequireVerifiedEmail.
+	// The time the address was verified is stored in the field
+	// "email_verified" of the user entry.
+	//
+	// New in version v0.6
+	RequireVerifiedEmail bool
+
 	// UserPrefix gets appended before the username in the redis key.
 	// Defaults to "user:" in NewRedisUserHandler.
 	// NextIDKey is the ID that was last used to create a user.
@@ -256,6 +645,30 @@ type RedisUserHandler struct {
 
 	// The prefix used to store the mapping id -> user name
 	UserIDPrefix string
+
+	// NameIndexKey, IDIndexKey and LoginIndexKey are the keys of the sorted
+	// sets that contain all usernames, used by ListUsersPage. The score in
+	// NameIndexKey is always 0 (so the set is sorted by name), the score in
+	// IDIndexKey is the id and in LoginIndexKey the unix time of the last
+	// login. Default to "userIndex:name", "userIndex:id" and
+	// "userIndex:lastLogin" in NewRedisUserHandler.
+	// For each of these sets there are two more sets with the same scores
+	// that only contain the active and inactive users, their keys are the
+	// key followed by ":active" and ":inactive".
+	// Users inserted before version v0.6 are not in these sets, see
+	// RebuildUserIndex.
+	//
+	// New in version v0.6
+	NameIndexKey, IDIndexKey, LoginIndexKey string
+
+	// EmailIndexKey is the key of the sorted set that contains the email
+	// address and the username of all users (separated by a 0 byte), used
+	// by ListUsersPage to find the users with an email prefix. All scores
+	// are 0, so the set is sorted by the address. Defaults to
+	// "userIndex:email" in NewRedisUserHandler.
+	//
+	// New in version v0.6
+	EmailIndexKey string
 }
 
 // NewRedisUserHandler returns a new RedisUserHandler.
@@ -264,36 +677,58 @@ func NewRedisUserHandler(client *redis.Client, pwHandler PasswordHandler) *Redis
 		pwHandler = DefaultPWHandler
 	}
 	return &RedisUserHandler{Client: client, PwHandler: pwHandler, UserPrefix: "user:",
-		NextIDKey: "nxtUserid", UserIDPrefix: "userID:"}
+		NextIDKey: "nxtUserid", UserIDPrefix: "userID:", NameIndexKey: "userIndex:name",
+		IDIndexKey: "userIndex:id", LoginIndexKey: "userIndex:lastLogin",
+		EmailIndexKey: "userIndex:email"}
 }
 
 func (handler *RedisUserHandler) Init() error {
+	return handler.InitContext(context.Background())
+}
+
+func (handler *RedisUserHandler) InitContext(ctx context.Context) error {
 	return nil
 }
 
 func (handler *RedisUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	return handler.InsertContext(context.Background(), userName, firstName, lastName, email, plainPW)
+}
+
+func (handler *RedisUserHandler) InsertContext(ctx context.Context, userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	client := handler.Client.WithContext(ctx)
 	now := CurrentTime()
+	user := &BaseUserInformation{UserName: userName, FirstName: firstName,
+		LastName: lastName, Email: email}
+	if policyErr := CheckPasswordPolicy(handler.Policy, user, plainPW); policyErr != nil {
+		return NoUserID, policyErr
+	}
 	// encrypt password
 	encrypted, encErr := handler.PwHandler.GenerateHash(plainPW)
 	if encErr != nil {
 		return NoUserID, encErr
 	}
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	if err := ctx.Err(); err != nil {
+		return NoUserID, err
+	}
 	// check if user already exists
-	if exists, existsErr := handler.Client.Exists(userkey).Result(); existsErr != nil {
+	if exists, existsErr := client.Exists(userkey).Result(); existsErr != nil {
 		return NoUserID, existsErr
 	} else if exists > 0 {
 		// user already exists
-		return NoUserID, errors.New("Username already in use")
+		return NoUserID, ErrUserNameInUse
+	}
+	if err := ctx.Err(); err != nil {
+		return NoUserID, err
 	}
 	// get next id
-	id, idErr := handler.Client.Incr(handler.NextIDKey).Result()
+	id, idErr := client.Incr(handler.NextIDKey).Result()
 	if idErr != nil {
 		return NoUserID, idErr
 	}
 	// insert
 	// we start a transaction for this
-	pipe := handler.Client.TxPipeline()
+	pipe := client.TxPipeline()
 	pipe.HMSet(userkey, map[string]interface{}{
 		"id":         id,
 		"username":   userName,
@@ -306,6 +741,10 @@ func (handler *RedisUserHandler) Insert(userName, firstName, lastName, email str
 	})
 	// insert mapping id -> username
 	pipe.Set(fmt.Sprintf("%s%d", handler.UserIDPrefix, id), userName, 0)
+	handler.addToIndex(pipe, userName, uint64(id), now, true, email)
+	if err := ctx.Err(); err != nil {
+		return NoUserID, err
+	}
 	_, insertErr := pipe.Exec()
 	if insertErr != nil {
 		return NoUserID, insertErr
@@ -315,9 +754,17 @@ func (handler *RedisUserHandler) Insert(userName, firstName, lastName, email str
 }
 
 func (handler *RedisUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	return handler.ValidateContext(context.Background(), userName, cleartextPwCheck)
+}
+
+func (handler *RedisUserHandler) ValidateContext(ctx context.Context, userName string, cleartextPwCheck []byte) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return NoUserID, err
+	}
+	client := handler.Client.WithContext(ctx)
 	// try to get the entry
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
-	entry, getErr := handler.Client.HMGet(userkey, "id", "password").Result()
+	entry, getErr := client.HMGet(userkey, "id", "password", "is_active", "email_verified").Result()
 	if getErr != nil {
 		return NoUserID, getErr
 	}
@@ -343,47 +790,395 @@ func (handler *RedisUserHandler) Validate(userName string, cleartextPwCheck []by
 		if parseErr != nil {
 			return NoUserID, parseErr
 		}
+		// only report inactive users if the password is correct
+		if activeStr, activeOk := entry[2].(string); activeOk {
+			if isActive, activeErr := strconv.ParseBool(activeStr); activeErr != nil {
+				return NoUserID, activeErr
+			} else if !isActive {
+				return NoUserID, ErrUserInactive
+			}
+		}
+		if handler.RequireVerifiedEmail && entry[3] == nil {
+			return NoUserID, ErrEmailNotVerified
+		}
+		// checking the password takes some time
+		if err := ctx.Err(); err != nil {
+			return NoUserID, err
+		}
+		now := CurrentTime()
+		loginKeys := []string{userkey, handler.LoginIndexKey,
+			handler.LoginIndexKey + redisActiveSuffix, handler.LoginIndexKey + redisInactiveSuffix}
+		loginErr := redisLastLoginScript.Run(client, loginKeys, now.Format(RedisDateFormat),
+			now.Unix(), userName).Err()
+		if loginErr != nil {
+			log.WithError(loginErr).Warn("goauth(redis): Can't update last login")
+		}
+		// store a new hash if required, see RehashChecker
+		if NeedsRehash(handler.PwHandler, []byte(pwStr)) {
+			if encrypted, encErr := handler.PwHandler.GenerateHash(cleartextPwCheck); encErr != nil {
+				log.WithError(encErr).Warn("goauth(redis): Can't rehash password")
+			} else if ctxErr := ctx.Err(); ctxErr != nil {
+				log.WithError(ctxErr).Warn("goauth(redis): Can't store rehashed password")
+			} else if setErr := redisRehashScript.Run(client, []string{userkey}, pwStr, string(encrypted)).Err(); setErr != nil {
+				log.WithError(setErr).Warn("goauth(redis): Can't store rehashed password")
+			}
+		}
 		return id, nil
 	} else {
 		return NoUserID, nil
 	}
 }
 
+// KEYS[1] is the user entry and KEYS[2] to KEYS[4] are the last login index
+// sets (all, active and inactive users).
+// ARGV is: the time of the login, the unix time of the login and the
+// username.
+// The user is only updated in the sets that contain it and the entry is not
+// created if the user was deleted in the meantime.
+var redisLastLoginScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'last_login', ARGV[1])
+for i = 2, #KEYS do
+	redis.call('ZADD', KEYS[i], 'XX', ARGV[2], ARGV[3])
+end
+return 1
+`)
+
+// KEYS[1] is the user entry.
+// ARGV is: the verified password hash and the new hash.
+// The new hash is only stored if the user still exists and the password was
+// not changed in the meantime. It returns 1 if the hash was replaced and 0
+// otherwise.
+var redisRehashScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'password') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'password', ARGV[2])
+return 1
+`)
+
 func (handler *RedisUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	return handler.UpdatePasswordContext(context.Background(), userName, plainPW)
+}
+
+// UpdatePasswordContext is UpdatePassword with a context.
+// The password is only set if the user still exists (in a lua script), so
+// a deleted user is not recreated.
+func (handler *RedisUserHandler) UpdatePasswordContext(ctx context.Context, userName string, plainPW []byte) error {
+	if handler.Policy != nil {
+		user, infoErr := handler.GetUserBaseInfoContext(ctx, userName)
+		if infoErr != nil {
+			return infoErr
+		}
+		if policyErr := handler.Policy.CheckPolicy(user, plainPW); policyErr != nil {
+			return policyErr
+		}
+	}
 	// try to encrypt the pw
 	encrypted, encErr := handler.PwHandler.GenerateHash(plainPW)
 	if encErr != nil {
 		return encErr
 	}
-	// try to get the entry
+	return handler.hmsetExists(ctx, userName, "password", string(encrypted))
+}
+
+// SetActive sets is_active for the user, it returns ErrUserNotFound if the
+// user doesn't exist.
+func (handler *RedisUserHandler) SetActive(userName string, active bool) error {
+	return handler.SetActiveContext(context.Background(), userName, active)
+}
+
+// KEYS[1] is the user entry, KEYS[2] to KEYS[4] are the index sets the
+// user is moved from and KEYS[5] to KEYS[7] the index sets the user is moved
+// to (name, id and last login).
+// ARGV is: the new value of is_active and the username.
+// It returns 0 if the user doesn't exist and 1 on success.
+var redisSetActiveScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'is_active', ARGV[1])
+for i = 2, 4 do
+	local score = redis.call('ZSCORE', KEYS[i], ARGV[2])
+	if score then
+		redis.call('ZREM', KEYS[i], ARGV[2])
+		redis.call('ZADD', KEYS[i + 3], score, ARGV[2])
+	end
+end
+return 1
+`)
+
+// SetActiveContext is SetActive with a context.
+// The user is moved to the index sets of the active or inactive users in
+// the same lua script, see NameIndexKey.
+func (handler *RedisUserHandler) SetActiveContext(ctx context.Context, userName string, active bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client := handler.Client.WithContext(ctx)
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	inactive := !active
+	keys := append([]string{userkey}, handler.indexKeys(&inactive)...)
+	keys = append(keys, handler.indexKeys(&active)...)
+	res, err := redisSetActiveScript.Run(client, keys, active, userName).Int64()
+	if err != nil {
+		return err
+	}
+	if res == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// hmsetExists sets the fields of the user entry with redisHMSetExistsScript,
+// so a deleted user is not recreated. It returns ErrUserNotFound if the
+// user doesn't exist.
+func (handler *RedisUserHandler) hmsetExists(ctx context.Context, userName string, fields ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
-	exists, existsErr := handler.Client.Exists(userkey).Result()
+	res, err := redisHMSetExistsScript.Run(handler.Client.WithContext(ctx), []string{userkey}, fields...).Int64()
+	if err != nil {
+		return err
+	}
+	if res == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// SetEmailVerified sets the field email_verified of the user to now or
+// removes it, it returns ErrUserNotFound if the user doesn't exist.
+func (handler *RedisUserHandler) SetEmailVerified(userName string, verified bool) error {
+	return handler.SetEmailVerifiedContext(context.Background(), userName, verified)
+}
+
+func (handler *RedisUserHandler) SetEmailVerifiedContext(ctx context.Context, userName string, verified bool) error {
+	if verified {
+		return handler.hmsetExists(ctx, userName, "email_verified", CurrentTime().Format(RedisDateFormat))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client := handler.Client.WithContext(ctx)
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	exists, existsErr := client.Exists(userkey).Result()
 	if existsErr != nil {
 		return existsErr
 	} else if exists == 0 {
 		return ErrUserNotFound
 	}
-	// update
-	updateErr := handler.Client.HMSet(userkey, map[string]interface{}{
-		"password": string(encrypted),
-	}).Err()
-	return updateErr
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// HDEL doesn't create the entry, so this is safe if the user was deleted
+	// in the meantime
+	return client.HDel(userkey, "email_verified").Err()
+}
+
+// KEYS[1] is the user entry.
+// ARGV is: the email address and the time of the verification.
+// It returns 0 if the user doesn't exist, -1 if the user has a different
+// email address and 1 on success.
+var redisVerifyEmailScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+if redis.call('HGET', KEYS[1], 'email') ~= ARGV[1] then
+	return -1
+end
+redis.call('HSET', KEYS[1], 'email_verified', ARGV[2])
+return 1
+`)
+
+// VerifyEmail sets the field email_verified of the user to now if the email
+// address of the user is still email. It returns ErrUserNotFound if the user
+// doesn't exist and ErrEmailChanged if the user has a different address.
+func (handler *RedisUserHandler) VerifyEmail(userName, email string) error {
+	return handler.VerifyEmailContext(context.Background(), userName, email)
+}
+
+func (handler *RedisUserHandler) VerifyEmailContext(ctx context.Context, userName, email string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client := handler.Client.WithContext(ctx)
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	now := CurrentTime().Format(RedisDateFormat)
+	res, err := redisVerifyEmailScript.Run(client, []string{userkey}, email, now).Int64()
+	if err != nil {
+		return err
+	}
+	switch res {
+	case 0:
+		return ErrUserNotFound
+	case -1:
+		return ErrEmailChanged
+	default:
+		return nil
+	}
+}
+
+// KEYS[1] is the user entry and KEYS[2] is EmailIndexKey.
+// ARGV is: the username followed by the fields and values to set.
+// If the email address changes email_verified is removed and the index is
+// updated. It returns 0 if the user doesn't exist and 1 on success.
+var redisUpdateUserInfoScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local old = redis.call('HGET', KEYS[1], 'email') or ''
+redis.call('HMSET', KEYS[1], unpack(ARGV, 2))
+local new = redis.call('HGET', KEYS[1], 'email') or ''
+if old ~= new then
+	redis.call('HDEL', KEYS[1], 'email_verified')
+	redis.call('ZREM', KEYS[2], old .. '\0' .. ARGV[1])
+	redis.call('ZADD', KEYS[2], 0, new .. '\0' .. ARGV[1])
+end
+return 1
+`)
+
+func (handler *RedisUserHandler) UpdateUserInfo(userName string, update *UserInfoUpdate) error {
+	return handler.UpdateUserInfoContext(context.Background(), userName, update)
+}
+
+// UpdateUserInfoContext is UpdateUserInfo with a context.
+// The fields, email_verified and EmailIndexKey are updated in a lua script.
+func (handler *RedisUserHandler) UpdateUserInfoContext(ctx context.Context, userName string, update *UserInfoUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client := handler.Client.WithContext(ctx)
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	args := []interface{}{userName}
+	if update.FirstName != nil {
+		args = append(args, "firstName", *update.FirstName)
+	}
+	if update.LastName != nil {
+		args = append(args, "lastName", *update.LastName)
+	}
+	if update.Email != nil {
+		args = append(args, "email", *update.Email)
+	}
+	if len(args) == 1 {
+		exists, existsErr := client.Exists(userkey).Result()
+		if existsErr != nil {
+			return existsErr
+		} else if exists == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	}
+	keys := []string{userkey, handler.EmailIndexKey}
+	res, err := redisUpdateUserInfoScript.Run(client, keys, args...).Int64()
+	if err != nil {
+		return err
+	}
+	if res == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// KEYS[1] is the old user entry and KEYS[2] the new one, KEYS[3] to
+// KEYS[11] are the index sets (see userIndexKeys) and KEYS[12] is
+// EmailIndexKey.
+// ARGV is: the user id prefix, the old and the new username.
+// It returns 0 if the user doesn't exist, -1 if the new username is already
+// in use and 1 on success.
+var redisRenameUserScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return -1
+end
+local id = redis.call('HGET', KEYS[1], 'id')
+redis.call('RENAME', KEYS[1], KEYS[2])
+redis.call('HSET', KEYS[2], 'username', ARGV[3])
+redis.call('SET', ARGV[1] .. id, ARGV[3])
+for i = 3, 11 do
+	local score = redis.call('ZSCORE', KEYS[i], ARGV[2])
+	if score then
+		redis.call('ZREM', KEYS[i], ARGV[2])
+		redis.call('ZADD', KEYS[i], score, ARGV[3])
+	end
+end
+local email = redis.call('HGET', KEYS[2], 'email') or ''
+if redis.call('ZREM', KEYS[12], email .. '\0' .. ARGV[2]) == 1 then
+	redis.call('ZADD', KEYS[12], 0, email .. '\0' .. ARGV[3])
+end
+return 1
+`)
+
+func (handler *RedisUserHandler) RenameUser(oldName, newName string) error {
+	return handler.RenameUserContext(context.Background(), oldName, newName)
+}
+
+// RenameUserContext is RenameUser with a context.
+// Moving the user entry and updating the id mapping is done in a lua
+// script, so it's atomic. Note that the id mapping key is not passed as KEYS
+// to the script, so this doesn't work with redis cluster.
+func (handler *RedisUserHandler) RenameUserContext(ctx context.Context, oldName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client := handler.Client.WithContext(ctx)
+	oldKey := fmt.Sprintf("%s%v", handler.UserPrefix, oldName)
+	if oldName == newName {
+		exists, existsErr := client.Exists(oldKey).Result()
+		if existsErr != nil {
+			return existsErr
+		} else if exists == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	}
+	newKey := fmt.Sprintf("%s%v", handler.UserPrefix, newName)
+	keys := append([]string{oldKey, newKey}, handler.userIndexKeys()...)
+	keys = append(keys, handler.EmailIndexKey)
+	res, err := redisRenameUserScript.Run(client, keys, handler.UserIDPrefix, oldName, newName).Int64()
+	if err != nil {
+		return err
+	}
+	switch res {
+	case 0:
+		return ErrUserNotFound
+	case -1:
+		return ErrUserNameInUse
+	default:
+		return nil
+	}
 }
 
 func (handler *RedisUserHandler) ListUsers() (map[uint64]string, error) {
+	return handler.ListUsersContext(context.Background())
+}
+
+func (handler *RedisUserHandler) ListUsersContext(ctx context.Context) (map[uint64]string, error) {
+	client := handler.Client.WithContext(ctx)
 	res := make(map[uint64]string)
 
 	var cursor uint64
 	scanMatch := handler.UserPrefix + "*"
 	for {
-		keys, newCursor, scanErr := handler.Client.Scan(cursor, scanMatch, 0).Result()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		keys, newCursor, scanErr := client.Scan(cursor, scanMatch, 0).Result()
 		cursor = newCursor
 		if scanErr != nil {
 			return nil, scanErr
 		}
 		// add all ids for the given key
 		for _, key := range keys {
-			entry, getErr := handler.Client.HMGet(key, "id", "username").Result()
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			entry, getErr := client.HMGet(key, "id", "username").Result()
 			if getErr != nil {
 				return nil, getErr
 			}
@@ -416,7 +1211,15 @@ func (handler *RedisUserHandler) ListUsers() (map[uint64]string, error) {
 }
 
 func (handler *RedisUserHandler) GetUserName(id uint64) (string, error) {
-	name, err := handler.Client.Get(fmt.Sprintf("%s%d", handler.UserIDPrefix, id)).Result()
+	return handler.GetUserNameContext(context.Background(), id)
+}
+
+func (handler *RedisUserHandler) GetUserNameContext(ctx context.Context, id uint64) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	client := handler.Client.WithContext(ctx)
+	name, err := client.Get(fmt.Sprintf("%s%d", handler.UserIDPrefix, id)).Result()
 	if err != nil {
 		if err == redis.Nil {
 			return "", ErrUserNotFound
@@ -427,9 +1230,17 @@ func (handler *RedisUserHandler) GetUserName(id uint64) (string, error) {
 }
 
 func (handler *RedisUserHandler) DeleteUser(userName string) error {
+	return handler.DeleteUserContext(context.Background(), userName)
+}
+
+func (handler *RedisUserHandler) DeleteUserContext(ctx context.Context, userName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client := handler.Client.WithContext(ctx)
 	// get the id
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
-	entry, getErr := handler.Client.HMGet(userkey, "id").Result()
+	entry, getErr := client.HMGet(userkey, "id", "email").Result()
 	if getErr != nil {
 		return getErr
 	}
@@ -441,23 +1252,53 @@ func (handler *RedisUserHandler) DeleteUser(userName string) error {
 	if !idOk {
 		return errors.New("Weird type in redis, should not happen")
 	}
+	email, _ := entry[1].(string)
 	// start a pipeline and delete both: id entry and user entry
-	pipe := handler.Client.TxPipeline()
+	pipe := client.TxPipeline()
 	pipe.Del(userkey)
 	pipe.Del(fmt.Sprintf("%s%s", handler.UserIDPrefix, idStr))
+	for _, key := range handler.userIndexKeys() {
+		pipe.ZRem(key, userName)
+	}
+	pipe.ZRem(handler.EmailIndexKey, emailIndexMember(email, userName))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	_, delErr := pipe.Exec()
 	return delErr
 }
 
 func (handler *RedisUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
+	return handler.GetUserBaseInfoContext(context.Background(), userName)
+}
+
+func (handler *RedisUserHandler) GetUserBaseInfoContext(ctx context.Context, userName string) (*BaseUserInformation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	client := handler.Client.WithContext(ctx)
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
-	entry, getErr := handler.Client.HMGet(userkey, "id", "firstName", "lastName", "email", "is_active", "last_login").Result()
+	entry, getErr := client.HMGet(userkey, redisUserInfoFields...).Result()
 	if getErr != nil {
 		return nil, getErr
 	}
+	return redisUserInfo(userName, entry)
+}
+
+// redisUserInfoFields are the fields of a user entry that are parsed by
+// redisUserInfo. The last field (email_verified) is optional.
+var redisUserInfoFields = []string{"id", "firstName", "lastName", "email", "is_active", "last_login", "email_verified"}
+
+// redisUserInfo parses the result of a HMGET of redisUserInfoFields.
+// It returns ErrUserNotFound if a required entry is nil.
+func redisUserInfo(userName string, entry []interface{}) (*BaseUserInformation, error) {
 	// check that every entry is not nil and a string
 	strings := make([]string, len(entry))
 	for i, val := range entry {
+		if val == nil && i == 6 {
+			// email_verified is not set
+			continue
+		}
 		if val == nil {
 			return nil, ErrUserNotFound
 		}
@@ -482,12 +1323,27 @@ func (handler *RedisUserHandler) GetUserBaseInfo(userName string) (*BaseUserInfo
 	}
 	res := &BaseUserInformation{ID: id, UserName: userName, FirstName: strings[1],
 		LastName: strings[2], Email: strings[3], LastLogin: lastLogin, IsActive: isActive}
+	if strings[6] != "" {
+		verified, verifiedParseErr := time.Parse(RedisDateFormat, strings[6])
+		if verifiedParseErr != nil {
+			return nil, verifiedParseErr
+		}
+		res.EmailVerified = verified
+	}
 	return res, nil
 }
 
 func (handler *RedisUserHandler) GetUserID(userName string) (uint64, error) {
+	return handler.GetUserIDContext(context.Background(), userName)
+}
+
+func (handler *RedisUserHandler) GetUserIDContext(ctx context.Context, userName string) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return NoUserID, err
+	}
+	client := handler.Client.WithContext(ctx)
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
-	entry, getErr := handler.Client.HMGet(userkey, "id").Result()
+	entry, getErr := client.HMGet(userkey, "id").Result()
 	if getErr != nil {
 		return NoUserID, getErr
 	}
@@ -505,3 +1361,345 @@ func (handler *RedisUserHandler) GetUserID(userName string) (uint64, error) {
 	}
 	return id, nil
 }
+
+// redisIndexBatchSize is the number of users that are read at once from
+// redis while filtering users, see ListUsersPage.
+const redisIndexBatchSize = 1000
+
+// redisActiveSuffix and redisInactiveSuffix are appended to the index keys
+// to get the index sets of the active and inactive users, see NameIndexKey.
+const (
+	redisActiveSuffix   = ":active"
+	redisInactiveSuffix = ":inactive"
+)
+
+// indexKeys returns the keys of the name, id and last login index sets of
+// all users (active is nil) or of the active / inactive users.
+func (handler *RedisUserHandler) indexKeys(active *bool) []string {
+	suffix := ""
+	if active != nil && *active {
+		suffix = redisActiveSuffix
+	} else if active != nil {
+		suffix = redisInactiveSuffix
+	}
+	return []string{handler.NameIndexKey + suffix, handler.IDIndexKey + suffix,
+		handler.LoginIndexKey + suffix}
+}
+
+// userIndexKeys returns the keys of all index sets that contain usernames:
+// the sets of all, the active and the inactive users.
+func (handler *RedisUserHandler) userIndexKeys() []string {
+	active, inactive := true, false
+	res := handler.indexKeys(nil)
+	res = append(res, handler.indexKeys(&active)...)
+	return append(res, handler.indexKeys(&inactive)...)
+}
+
+// emailIndexMember returns the member of the user in EmailIndexKey.
+func emailIndexMember(email, userName string) string {
+	return email + "\x00" + userName
+}
+
+// addToIndex adds the user to the index sets, see NameIndexKey and
+// EmailIndexKey.
+func (handler *RedisUserHandler) addToIndex(pipe redis.Pipeliner, userName string, id uint64, lastLogin time.Time, active bool, email string) {
+	scores := []float64{0, float64(id), float64(lastLogin.Unix())}
+	for _, keys := range [][]string{handler.indexKeys(nil), handler.indexKeys(&active)} {
+		for i, key := range keys {
+			pipe.ZAdd(key, redis.Z{Score: scores[i], Member: userName})
+		}
+	}
+	pipe.ZAdd(handler.EmailIndexKey, redis.Z{Score: 0, Member: emailIndexMember(email, userName)})
+}
+
+// RebuildUserIndex removes the index sets (see NameIndexKey and
+// EmailIndexKey) and adds all users again. Use this once to add the users
+// that were inserted before version v0.6. ListUsersPage doesn't return all
+// users while the index is rebuilt.
+//
+// New in version v0.6
+func (handler *RedisUserHandler) RebuildUserIndex() error {
+	return handler.RebuildUserIndexContext(context.Background())
+}
+
+// RebuildUserIndexContext is RebuildUserIndex with a context.
+//
+// New in version v0.6
+func (handler *RedisUserHandler) RebuildUserIndexContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client := handler.Client.WithContext(ctx)
+	delKeys := append(handler.userIndexKeys(), handler.EmailIndexKey)
+	if err := client.Del(delKeys...).Err(); err != nil {
+		return err
+	}
+	var cursor uint64
+	scanMatch := handler.UserPrefix + "*"
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys, newCursor, scanErr := client.Scan(cursor, scanMatch, 0).Result()
+		cursor = newCursor
+		if scanErr != nil {
+			return scanErr
+		}
+		pipe := client.Pipeline()
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			entry, getErr := client.HMGet(key, "id", "username", "last_login", "is_active", "email").Result()
+			if getErr != nil {
+				return getErr
+			}
+			idStr, idOk := entry[0].(string)
+			nameStr, nameOk := entry[1].(string)
+			if !idOk || !nameOk {
+				return fmt.Errorf("No valid user information stored for key: %v", key)
+			}
+			id, parseErr := strconv.ParseUint(idStr, 10, 64)
+			if parseErr != nil {
+				return parseErr
+			}
+			var lastLogin time.Time
+			if loginStr, loginOk := entry[2].(string); loginOk {
+				if lastLogin, parseErr = time.Parse(RedisDateFormat, loginStr); parseErr != nil {
+					return parseErr
+				}
+			}
+			active := true
+			if activeStr, activeOk := entry[3].(string); activeOk {
+				if active, parseErr = strconv.ParseBool(activeStr); parseErr != nil {
+					return parseErr
+				}
+			}
+			email, _ := entry[4].(string)
+			handler.addToIndex(pipe, nameStr, id, lastLogin, active, email)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if _, execErr := pipe.Exec(); execErr != nil {
+				return execErr
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+// getUsers returns the information for all given users, users that don't
+// exist (deleted after they were read from the index) are skipped.
+func (handler *RedisUserHandler) getUsers(ctx context.Context, userNames []string) ([]*BaseUserInformation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pipe := handler.Client.WithContext(ctx).Pipeline()
+	cmds := make([]*redis.SliceCmd, len(userNames))
+	for i, userName := range userNames {
+		cmds[i] = pipe.HMGet(fmt.Sprintf("%s%v", handler.UserPrefix, userName), redisUserInfoFields...)
+	}
+	if len(userNames) > 0 {
+		if _, err := pipe.Exec(); err != nil {
+			return nil, err
+		}
+	}
+	res := make([]*BaseUserInformation, 0, len(userNames))
+	for i, cmd := range cmds {
+		user, err := redisUserInfo(userNames[i], cmd.Val())
+		if err == ErrUserNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		res = append(res, user)
+	}
+	return res, nil
+}
+
+// ceilUnix returns the unix time of t rounded up to the next second.
+func ceilUnix(t time.Time) int64 {
+	res := t.Unix()
+	if t.Nanosecond() > 0 {
+		res++
+	}
+	return res
+}
+
+// lexPrefixRange returns the range of the members of a set sorted by name
+// that start with prefix (for ZRANGEBYLEX).
+func lexPrefixRange(prefix string) (string, string) {
+	// 0xff never occurs in utf-8
+	return "[" + prefix, "[" + prefix + "\xff"
+}
+
+// loginScoreRange returns the range of the scores in LoginIndexKey for the
+// last login filter, from and to are ignored if they're zero.
+func loginScoreRange(from, to time.Time) (string, string) {
+	min, max := "-inf", "+inf"
+	if !from.IsZero() {
+		min = strconv.FormatInt(ceilUnix(from), 10)
+	}
+	if !to.IsZero() {
+		max = "(" + strconv.FormatInt(ceilUnix(to), 10)
+	}
+	return min, max
+}
+
+// sortRedisUsers sorts the users in the same order as the index sets.
+func sortRedisUsers(users []*BaseUserInformation, userSort UserSort) {
+	sort.Slice(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		if userSort.Descending {
+			a, b = b, a
+		}
+		switch userSort.Field {
+		case SortUsersByName:
+			return a.UserName < b.UserName
+		case SortUsersByLastLogin:
+			// users with the same score are sorted by name
+			if a.LastLogin.Unix() != b.LastLogin.Unix() {
+				return a.LastLogin.Unix() < b.LastLogin.Unix()
+			}
+			return a.UserName < b.UserName
+		default:
+			return a.ID < b.ID
+		}
+	})
+}
+
+func (handler *RedisUserHandler) ListUsersPage(filter *UserFilter, sort UserSort, limit int, cursor string) (*UserPage, error) {
+	return handler.ListUsersPageContext(context.Background(), filter, sort, limit, cursor)
+}
+
+// ListUsersPageContext is ListUsersPage with a context.
+// The index set for the sort field is used (the set of the active or
+// inactive users if the filter contains Active, see NameIndexKey), a
+// username prefix (sorted by name) and a range of the last login (sorted by
+// last login) are directly read from the set.
+// If there are other conditions in the filter the users that match one of
+// them are read from an index set (EmailIndexKey for an email prefix), these
+// users are filtered and sorted in memory. So this is only fast if the
+// condition is selective, a long range of the last login for example reads
+// all users in this range.
+func (handler *RedisUserHandler) ListUsersPageContext(ctx context.Context, filter *UserFilter, sort UserSort, limit int, cursor string) (*UserPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	offset, cursorErr := parsePageCursor(cursor)
+	if cursorErr != nil {
+		return nil, cursorErr
+	}
+	limit = pageLimit(limit)
+	// rest are the conditions that are not handled by the range in the set
+	var rest UserFilter
+	if filter != nil {
+		rest = *filter
+	}
+	client := handler.Client.WithContext(ctx)
+	indexKeys := handler.indexKeys(rest.Active)
+	rest.Active = nil
+	nameKey, idKey, loginKey := indexKeys[0], indexKeys[1], indexKeys[2]
+	key, min, max, lex := idKey, "-inf", "+inf", false
+	switch sort.Field {
+	case SortUsersByName:
+		key, min, max, lex = nameKey, "-", "+", true
+		if rest.UserNamePrefix != "" {
+			min, max = lexPrefixRange(rest.UserNamePrefix)
+			rest.UserNamePrefix = ""
+		}
+	case SortUsersByLastLogin:
+		key = loginKey
+		min, max = loginScoreRange(rest.LastLoginFrom, rest.LastLoginTo)
+		rest.LastLoginFrom, rest.LastLoginTo = time.Time{}, time.Time{}
+	}
+	if rest == (UserFilter{}) {
+		// everything is handled by the set, so just read the page
+		var total int64
+		var countErr error
+		if lex {
+			total, countErr = client.ZLexCount(key, min, max).Result()
+		} else {
+			total, countErr = client.ZCount(key, min, max).Result()
+		}
+		if countErr != nil {
+			return nil, countErr
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		opt := redis.ZRangeBy{Min: min, Max: max, Offset: offset, Count: int64(limit)}
+		var names []string
+		var rangeErr error
+		switch {
+		case lex && sort.Descending:
+			names, rangeErr = client.ZRevRangeByLex(key, opt).Result()
+		case lex:
+			names, rangeErr = client.ZRangeByLex(key, opt).Result()
+		case sort.Descending:
+			names, rangeErr = client.ZRevRangeByScore(key, opt).Result()
+		default:
+			names, rangeErr = client.ZRangeByScore(key, opt).Result()
+		}
+		if rangeErr != nil {
+			return nil, rangeErr
+		}
+		users, getErr := handler.getUsers(ctx, names)
+		if getErr != nil {
+			return nil, getErr
+		}
+		return newUserPage(users, total, offset), nil
+	}
+	// read the users that match one of the other conditions
+	var names []string
+	var rangeErr error
+	switch {
+	case rest.EmailPrefix != "":
+		emailMin, emailMax := lexPrefixRange(rest.EmailPrefix)
+		names, rangeErr = client.ZRangeByLex(handler.EmailIndexKey, redis.ZRangeBy{Min: emailMin, Max: emailMax}).Result()
+		for i, member := range names {
+			names[i] = member[strings.IndexByte(member, 0)+1:]
+		}
+	case rest.UserNamePrefix != "":
+		nameMin, nameMax := lexPrefixRange(rest.UserNamePrefix)
+		names, rangeErr = client.ZRangeByLex(nameKey, redis.ZRangeBy{Min: nameMin, Max: nameMax}).Result()
+	default:
+		loginMin, loginMax := loginScoreRange(rest.LastLoginFrom, rest.LastLoginTo)
+		names, rangeErr = client.ZRangeByScore(loginKey, redis.ZRangeBy{Min: loginMin, Max: loginMax}).Result()
+	}
+	if rangeErr != nil {
+		return nil, rangeErr
+	}
+	var users []*BaseUserInformation
+	for len(names) > 0 {
+		n := len(names)
+		if n > redisIndexBatchSize {
+			n = redisIndexBatchSize
+		}
+		batch, getErr := handler.getUsers(ctx, names[:n])
+		if getErr != nil {
+			return nil, getErr
+		}
+		names = names[n:]
+		for _, user := range batch {
+			if filter.Matches(user) {
+				users = append(users, user)
+			}
+		}
+	}
+	sortRedisUsers(users, sort)
+	total := int64(len(users))
+	if offset > total {
+		offset = total
+	}
+	end := offset + int64(limit)
+	if end > total {
+		end = total
+	}
+	return newUserPage(users[offset:end], total, offset), nil
+}
@@ -0,0 +1,152 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultResetDuration is the default time a password reset token is valid.
+//
+// New in version v0.6
+const DefaultResetDuration = time.Hour
+
+// PasswordResetManager creates and checks password reset tokens.
+//
+// CreateToken creates a new token for a user, you usually send a link
+// containing the token to the email address of the user. The token is only
+// stored hashed in Tokens and is valid for ValidDuration. Only the most
+// recent token of a user is valid.
+//
+// ResetPassword sets the new password and removes the token, so it can't be
+// used again after the password was changed. If Sessions is not nil all sessions of the user are
+// removed after the password was changed (so an attacker that knew the old
+// password gets logged out). Sessions must use the user id as UserKeyType
+// (as LoginHandler does).
+//
+// New in version v0.6
+type PasswordResetManager struct {
+	Tokens        TokenStore
+	Users         UserHandlerContext
+	Sessions      SessionHandlerContext
+	ValidDuration time.Duration
+
+	// TokenBytes is the number of random bytes of a token, see
+	// NewOneTimeToken.
+	TokenBytes int
+}
+
+// NewPasswordResetManager returns a new manager with tokens valid for
+// DefaultResetDuration. sessions may be nil, in this case sessions are not
+// removed when the password is reset.
+//
+// New in version v0.6
+func NewPasswordResetManager(tokens TokenStore, users UserHandler, sessions SessionHandler) *PasswordResetManager {
+	res := &PasswordResetManager{
+		Tokens:        tokens,
+		Users:         AsUserHandlerContext(users),
+		ValidDuration: DefaultResetDuration,
+		TokenBytes:    DefaultTokenBytes,
+	}
+	if sessions != nil {
+		res.Sessions = AsSessionHandlerContext(sessions)
+	}
+	return res
+}
+
+// CreateToken creates a new token for the user, all previous tokens of the
+// user are not valid any more. It returns ErrUserNotFound if the user
+// doesn't exist. Don't tell the client if the user exists, always respond
+// with something like "if the account exists you'll receive an email".
+func (m *PasswordResetManager) CreateToken(ctx context.Context, userName string) (string, error) {
+	userID, err := m.Users.GetUserIDContext(ctx, userName)
+	if err != nil {
+		return "", err
+	}
+	token, err := NewOneTimeToken(m.TokenBytes)
+	if err != nil {
+		return "", err
+	}
+	data := &TokenData{UserID: userID, ValidUntil: CurrentTime().Add(m.ValidDuration)}
+	if err := m.Tokens.ReplaceTokensForUser(ctx, HashToken(token), data); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CheckToken returns the id of the user the token was created for without
+// removing the token, for example to decide if the form for the new
+// password should be shown. It returns ErrInvalidToken if the token is
+// invalid or expired.
+func (m *PasswordResetManager) CheckToken(ctx context.Context, token string) (uint64, error) {
+	data, err := m.Tokens.GetToken(ctx, HashToken(token))
+	if err != nil {
+		return NoUserID, err
+	}
+	if KeyInvalid(CurrentTime(), data.ValidUntil) {
+		return NoUserID, ErrInvalidToken
+	}
+	return data.UserID, nil
+}
+
+// ResetPassword sets the new password of the user, it returns the id of the
+// user. It returns ErrInvalidToken if the token is invalid, expired or was
+// already used.
+//
+// After the password was changed all tokens of the user (including this
+// one) are removed and, if Sessions is not nil, all sessions of the user.
+// So if the new password is rejected (for example with a *PolicyError) the
+// user can try another password with the same token. If the same token is
+// used concurrently the password may be changed more than once.
+func (m *PasswordResetManager) ResetPassword(ctx context.Context, token string, plainPW []byte) (uint64, error) {
+	hash := HashToken(token)
+	data, err := m.Tokens.GetToken(ctx, hash)
+	if err != nil {
+		return NoUserID, err
+	}
+	if KeyInvalid(CurrentTime(), data.ValidUntil) {
+		return NoUserID, ErrInvalidToken
+	}
+	userName, err := m.Users.GetUserNameContext(ctx, data.UserID)
+	if err != nil {
+		return NoUserID, err
+	}
+	if err := m.Users.UpdatePasswordContext(ctx, userName, plainPW); err != nil {
+		return NoUserID, err
+	}
+	if err := m.Tokens.DeleteTokensForUser(ctx, data.UserID); err != nil {
+		return data.UserID, err
+	}
+	if m.Sessions != nil {
+		if _, err := m.Sessions.DeleteEntriesForUserContext(ctx, data.UserID); err != nil {
+			return data.UserID, err
+		}
+	}
+	return data.UserID, nil
+}
+
+// DeleteExpiredTokens removes all expired tokens from Tokens.
+func (m *PasswordResetManager) DeleteExpiredTokens(ctx context.Context) (int64, error) {
+	return m.Tokens.DeleteExpiredTokens(ctx, CurrentTime())
+}
@@ -23,11 +23,15 @@
 package goauth
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // DefaultTimeFromScanType is the default function to return database entries
@@ -58,12 +62,17 @@ type SQLSessionTemplate interface {
 	InitQ() string
 
 	// GetQ is a query to select the user identifiaction, the time the key was
-	// created and the time the until the key is valid from the database given
+	// created, the time the until the key is valid, the time of the last
+	// activity, the maximal valid time (may be NULL), the remote address, the
+	// user agent, the device name and the login method from the database given
 	// the session key.
 	GetQ() string
 
 	// CreateQ inserts the user identifiaction, the key, the time the key was
-	// created and the time until the key is valid (in that order) in the database.
+	// created, the time until the key is valid, the time of the last activity,
+	// the maximal valid time (NULL if there is no such time), the remote
+	// address, the user agent, the device name and the login method
+	// (in that order) in the database.
 	CreateQ() string
 
 	// DeleteForUserQ deletes all entries for a given user identifiaction from the
@@ -76,6 +85,43 @@ type SQLSessionTemplate interface {
 	// DeleteKeyQ deletes the entry for a given key from the database.
 	DeleteKeyQ() string
 
+	// ExtendQ updates the valid_until and last_activity fields of a given key,
+	// the new valid_until, the new last_activity and the key are passed (in
+	// that order).
+	//
+	// New in version v0.6
+	ExtendQ() string
+
+	// TouchQ updates the last_activity field of a given key, the new time and
+	// the key are passed (in that order).
+	//
+	// New in version v0.6
+	TouchQ() string
+
+	// ListForUserQ selects the key and the same fields as GetQ (without the
+	// user identifiaction) for all entries of the given user identification.
+	//
+	// New in version v0.6
+	ListForUserQ() string
+
+	// DeleteOtherQ deletes all entries for a given user identification except
+	// the given key, the user identifiaction and the key are passed (in that
+	// order).
+	//
+	// New in version v0.6
+	DeleteOtherQ() string
+
+	// ListValidForUserQ selects the keys of all entries of the given user
+	// identification that are still valid, ordered by the creation time
+	// (oldest first). Pending sessions (login_method PendingLoginMethod)
+	// must not be selected. The user identification and the current time
+	// are passed (in that order).
+	// The query is executed inside a transaction and should lock the selected
+	// rows if the database supports it (SELECT ... FOR UPDATE).
+	//
+	// New in version v0.6
+	ListValidForUserQ() string
+
 	// TimeFromScanType is a rather odd function, but time fields are handled
 	// differently in different handlers and some handlers even have options to change
 	// that behaviour. Therefor when we get a time field (via the Row.Scan or some
@@ -101,7 +147,8 @@ type SQLSessionHandler struct {
 	DB *sql.DB
 
 	// The queries required by this handler.
-	InitQ, GetQ, CreateQ, DeleteForUserQ, DeleteInvalidQ, DeleteKeyQ string
+	InitQ, GetQ, CreateQ, DeleteForUserQ, DeleteInvalidQ, DeleteKeyQ, ExtendQ, TouchQ,
+	ListForUserQ, DeleteOtherQ, ListValidForUserQ string
 
 	// TableName is the name of the session table, by default user_sessions.
 	TableName string
@@ -157,32 +204,46 @@ func NewSQLSessionHandler(db *sql.DB, t SQLSessionTemplate, tableName, userIDTyp
 	h.DeleteForUserQ = fmt.Sprintf(t.DeleteForUserQ(), h.TableName)
 	h.DeleteInvalidQ = fmt.Sprintf(t.DeleteInvalidQ(), h.TableName)
 	h.DeleteKeyQ = fmt.Sprintf(t.DeleteKeyQ(), h.TableName)
+	h.ExtendQ = fmt.Sprintf(t.ExtendQ(), h.TableName)
+	h.TouchQ = fmt.Sprintf(t.TouchQ(), h.TableName)
+	h.ListForUserQ = fmt.Sprintf(t.ListForUserQ(), h.TableName)
+	h.DeleteOtherQ = fmt.Sprintf(t.DeleteOtherQ(), h.TableName)
+	h.ListValidForUserQ = fmt.Sprintf(t.ListValidForUserQ(), h.TableName)
 	return &h
 }
 
 func (c *SQLSessionHandler) Init() error {
+	return c.InitContext(context.Background())
+}
+
+func (c *SQLSessionHandler) InitContext(ctx context.Context) error {
 	if c.blockDB {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	_, err := c.DB.Exec(c.InitQ)
+	_, err := c.DB.ExecContext(ctx, c.InitQ)
 	return err
 }
 
 func (c *SQLSessionHandler) GetData(key string) (*SessionKeyData, error) {
+	return c.GetDataContext(context.Background(), key)
+}
+
+func (c *SQLSessionHandler) GetDataContext(ctx context.Context, key string) (*SessionKeyData, error) {
 	if c.blockDB {
 		c.mutex.RLock()
 		defer c.mutex.RUnlock()
 	}
-	var uid, createdVal, validUntilVal interface{}
+	var uid interface{}
 	var err error
-	row := c.DB.QueryRow(c.GetQ, key)
+	scan := &sqlKeyDataScan{}
+	row := c.DB.QueryRowContext(ctx, c.GetQ, key)
 	if c.ForceUIDuint {
 		var uidUint uint64
-		err = row.Scan(&uidUint, &createdVal, &validUntilVal)
+		err = row.Scan(append([]interface{}{&uidUint}, scan.dest()...)...)
 		uid = uidUint
 	} else {
-		err = row.Scan(&uid, &createdVal, &validUntilVal)
+		err = row.Scan(append([]interface{}{&uid}, scan.dest()...)...)
 	}
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -190,38 +251,166 @@ func (c *SQLSessionHandler) GetData(key string) (*SessionKeyData, error) {
 		}
 		return nil, err
 	}
-	created, err := c.TimeFromScanType(createdVal)
+	return c.keyDataFromScan(uid, scan)
+}
+
+// sqlKeyDataScan stores the scanned values of a session entry, except the
+// user identification and the key.
+type sqlKeyDataScan struct {
+	createdVal, validUntilVal, lastActivityVal, maxValidVal interface{}
+	meta                                                    SessionMetadata
+}
+
+// dest returns the destinations for Scan in the order of GetQ.
+func (scan *sqlKeyDataScan) dest() []interface{} {
+	return []interface{}{&scan.createdVal, &scan.validUntilVal, &scan.lastActivityVal,
+		&scan.maxValidVal, &scan.meta.RemoteAddr, &scan.meta.UserAgent,
+		&scan.meta.DeviceName, &scan.meta.LoginMethod}
+}
+
+// keyDataFromScan creates the SessionKeyData given the scanned values,
+// time values are converted with TimeFromScanType.
+func (c *SQLSessionHandler) keyDataFromScan(user UserKeyType, scan *sqlKeyDataScan) (*SessionKeyData, error) {
+	created, err := c.TimeFromScanType(scan.createdVal)
 	if err != nil {
 		return nil, err
 	}
-	validUntil, err := c.TimeFromScanType(validUntilVal)
+	validUntil, err := c.TimeFromScanType(scan.validUntilVal)
 	if err != nil {
 		return nil, err
 	}
+	lastActivity, err := c.TimeFromScanType(scan.lastActivityVal)
+	if err != nil {
+		return nil, err
+	}
+	// max_valid_until is NULL if there is no limit
+	var maxValid time.Time
+	if scan.maxValidVal != nil {
+		maxValid, err = c.TimeFromScanType(scan.maxValidVal)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// everything ok
-	val := SessionKeyData{User: uid, CreationTime: created, ValidUntil: validUntil}
+	val := SessionKeyData{User: user, CreationTime: created, ValidUntil: validUntil,
+		LastActivity: lastActivity, MaxValidUntil: maxValid, Metadata: scan.meta}
 	return &val, nil
 }
 
 func (c *SQLSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return c.CreateEntryContext(context.Background(), user, key, validDuration)
+}
+
+func (c *SQLSessionHandler) CreateEntryContext(ctx context.Context, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	data := CurrentTimeKeyData(user, validDuration)
+	if err := c.InsertEntryContext(ctx, key, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *SQLSessionHandler) InsertEntry(key string, data *SessionKeyData) error {
+	return c.InsertEntryContext(context.Background(), key, data)
+}
+
+func (c *SQLSessionHandler) InsertEntryContext(ctx context.Context, key string, data *SessionKeyData) error {
 	if c.blockDB {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	data := CurrentTimeKeyData(user, validDuration)
-	_, err := c.DB.Exec(c.CreateQ, user, key, data.CreationTime, data.ValidUntil)
+	_, err := c.DB.ExecContext(ctx, c.CreateQ, createArgs(key, data)...)
+	return err
+}
+
+// createArgs returns the arguments for CreateQ.
+func createArgs(key string, data *SessionKeyData) []interface{} {
+	// store NULL if there is no max valid time
+	var maxValid interface{}
+	if !data.MaxValidUntil.IsZero() {
+		maxValid = data.MaxValidUntil
+	}
+	meta := data.Metadata
+	return []interface{}{data.User, key, data.CreationTime,
+		data.ValidUntil, data.LastActivity, maxValid,
+		meta.RemoteAddr, meta.UserAgent, meta.DeviceName, meta.LoginMethod}
+}
+
+func (c *SQLSessionHandler) InsertEntryLimited(key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	return c.InsertEntryLimitedContext(context.Background(), key, data, maxSessions, policy)
+}
+
+// InsertEntryLimitedContext checks the number of sessions and inserts the new
+// entry in a single transaction with isolation level serializable.
+// Thus when the same user logs in concurrently one of the transactions may
+// fail and the error of the driver is returned.
+func (c *SQLSessionHandler) InsertEntryLimitedContext(ctx context.Context, key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
-		return nil, err
+		return -1, err
 	}
-	return data, nil
+	removed, err := c.insertLimitedTx(ctx, tx, key, data, maxSessions, policy)
+	if err != nil {
+		tx.Rollback()
+		return removed, err
+	}
+	if err := tx.Commit(); err != nil {
+		return -1, err
+	}
+	return removed, nil
+}
+
+// insertLimitedTx does the actual work of InsertEntryLimitedContext in the
+// given transaction.
+func (c *SQLSessionHandler) insertLimitedTx(ctx context.Context, tx *sql.Tx, key string, data *SessionKeyData, maxSessions int, policy SessionLimitPolicy) (int64, error) {
+	rows, err := tx.QueryContext(ctx, c.ListValidForUserQ, data.User, CurrentTime())
+	if err != nil {
+		return -1, err
+	}
+	userKeys := make([]string, 0)
+	for rows.Next() {
+		var otherKey string
+		if scanErr := rows.Scan(&otherKey); scanErr != nil {
+			rows.Close()
+			return -1, scanErr
+		}
+		userKeys = append(userKeys, otherKey)
+	}
+	if err := rows.Err(); err != nil {
+		return -1, err
+	}
+	rows.Close()
+	var removed int64 = 0
+	if maxSessions > 0 && len(userKeys) >= maxSessions {
+		if policy != EvictOldestSession {
+			return 0, ErrTooManySessions
+		}
+		for _, otherKey := range userKeys[:len(userKeys)-maxSessions+1] {
+			if _, err := tx.ExecContext(ctx, c.DeleteKeyQ, otherKey); err != nil {
+				return -1, err
+			}
+			removed++
+		}
+	}
+	if _, err := tx.ExecContext(ctx, c.CreateQ, createArgs(key, data)...); err != nil {
+		return -1, err
+	}
+	return removed, nil
 }
 
 func (c *SQLSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	return c.DeleteEntriesForUserContext(context.Background(), user)
+}
+
+func (c *SQLSessionHandler) DeleteEntriesForUserContext(ctx context.Context, user UserKeyType) (int64, error) {
 	if c.blockDB {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	res, err := c.DB.Exec(c.DeleteForUserQ, user)
+	res, err := c.DB.ExecContext(ctx, c.DeleteForUserQ, user)
 	if err != nil {
 		return -1, err
 	}
@@ -233,12 +422,16 @@ func (c *SQLSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error
 }
 
 func (c *SQLSessionHandler) DeleteInvalidKeys() (int64, error) {
+	return c.DeleteInvalidKeysContext(context.Background())
+}
+
+func (c *SQLSessionHandler) DeleteInvalidKeysContext(ctx context.Context) (int64, error) {
 	now := CurrentTime()
 	if c.blockDB {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	res, err := c.DB.Exec(c.DeleteInvalidQ, now)
+	res, err := c.DB.ExecContext(ctx, c.DeleteInvalidQ, now)
 	if err != nil {
 		return -1, err
 	}
@@ -250,15 +443,161 @@ func (c *SQLSessionHandler) DeleteInvalidKeys() (int64, error) {
 }
 
 func (c *SQLSessionHandler) DeleteKey(key string) error {
+	return c.DeleteKeyContext(context.Background(), key)
+}
+
+func (c *SQLSessionHandler) DeleteKeyContext(ctx context.Context, key string) error {
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	_, err := c.DB.ExecContext(ctx, c.DeleteKeyQ, key)
+	return err
+}
+
+func (c *SQLSessionHandler) ExtendEntry(key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return c.ExtendEntryContext(context.Background(), key, validDuration)
+}
+
+// ExtendEntryContext updates the entry and then returns the data from
+// GetDataContext, so it requires two queries.
+func (c *SQLSessionHandler) ExtendEntryContext(ctx context.Context, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	now := CurrentTime()
+	if err := c.update(ctx, c.ExtendQ, now.Add(validDuration), now, key); err != nil {
+		return nil, err
+	}
+	// we don't use RowsAffected here: MySQL reports 0 rows if the value didn't
+	// change, so we simply lookup the key which also returns ErrKeyNotFound
+	return c.GetDataContext(ctx, key)
+}
+
+func (c *SQLSessionHandler) TouchEntry(key string) (*SessionKeyData, error) {
+	return c.TouchEntryContext(context.Background(), key)
+}
+
+// TouchEntryContext updates the entry and then returns the data from
+// GetDataContext, so it requires two queries.
+func (c *SQLSessionHandler) TouchEntryContext(ctx context.Context, key string) (*SessionKeyData, error) {
+	if err := c.update(ctx, c.TouchQ, CurrentTime(), key); err != nil {
+		return nil, err
+	}
+	return c.GetDataContext(ctx, key)
+}
+
+func (c *SQLSessionHandler) ListEntriesForUser(user UserKeyType) ([]*SessionEntry, error) {
+	return c.ListEntriesForUserContext(context.Background(), user)
+}
+
+func (c *SQLSessionHandler) ListEntriesForUserContext(ctx context.Context, user UserKeyType) ([]*SessionEntry, error) {
+	if c.blockDB {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+	}
+	rows, err := c.DB.QueryContext(ctx, c.ListForUserQ, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*SessionEntry, 0)
+	for rows.Next() {
+		var key string
+		scan := &sqlKeyDataScan{}
+		if scanErr := rows.Scan(append([]interface{}{&key}, scan.dest()...)...); scanErr != nil {
+			return nil, scanErr
+		}
+		data, dataErr := c.keyDataFromScan(user, scan)
+		if dataErr != nil {
+			return nil, dataErr
+		}
+		res = append(res, &SessionEntry{ID: SessionEntryID(key), SessionKeyData: data})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *SQLSessionHandler) DeleteEntryByID(user UserKeyType, id string) error {
+	return c.DeleteEntryByIDContext(context.Background(), user, id)
+}
+
+// DeleteEntryByIDContext selects all keys of the user and deletes the key
+// with the given id, so it requires two queries.
+func (c *SQLSessionHandler) DeleteEntryByIDContext(ctx context.Context, user UserKeyType, id string) error {
 	if c.blockDB {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	_, err := c.DB.Exec(c.DeleteKeyQ, key)
+	rows, err := c.DB.QueryContext(ctx, c.ListForUserQ, user)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var key string
+	found := false
+	for rows.Next() {
+		scan := &sqlKeyDataScan{}
+		if scanErr := rows.Scan(append([]interface{}{&key}, scan.dest()...)...); scanErr != nil {
+			return scanErr
+		}
+		if SessionEntryID(key) == id {
+			found = true
+			break
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if !found {
+		return nil
+	}
+	_, err = c.DB.ExecContext(ctx, c.DeleteKeyQ, key)
+	return err
+}
+
+func (c *SQLSessionHandler) DeleteOtherEntriesForUser(user UserKeyType, key string) (int64, error) {
+	return c.DeleteOtherEntriesForUserContext(context.Background(), user, key)
+}
+
+func (c *SQLSessionHandler) DeleteOtherEntriesForUserContext(ctx context.Context, user UserKeyType, key string) (int64, error) {
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	res, err := c.DB.ExecContext(ctx, c.DeleteOtherQ, user, key)
+	if err != nil {
+		return -1, err
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
+
+// update executes an update query with the given arguments.
+func (c *SQLSessionHandler) update(ctx context.Context, query string, args ...interface{}) error {
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	_, err := c.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
 // MySQLSessionTemplate implements SQLSessionTemplate with MySQL queries.
+//
+// Since version v0.6 the table has the additional columns last_activity,
+// max_valid_until, remote_addr, user_agent, device_name and login_method.
+// Tables created by an older version must be updated, since sessions are only
+// temporary it's easiest to simply drop the old table.
+// Otherwise you can add the columns like this:
+//
+//	ALTER TABLE user_sessions ADD COLUMN last_activity DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//		ADD COLUMN max_valid_until DATETIME NULL,
+//		ADD COLUMN remote_addr TEXT NOT NULL, ADD COLUMN user_agent TEXT NOT NULL,
+//		ADD COLUMN device_name TEXT NOT NULL, ADD COLUMN login_method TEXT NOT NULL;
 type MySQLSessionTemplate struct {
 }
 
@@ -285,16 +624,22 @@ func (t MySQLSessionTemplate) InitQ() string {
 		session_key CHAR(%d) NOT NULL,
     created DATETIME NOT NULL,
     valid_until DATETIME NOT NULL,
+    last_activity DATETIME NOT NULL,
+    max_valid_until DATETIME NULL,
+    remote_addr TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    device_name TEXT NOT NULL,
+    login_method TEXT NOT NULL,
 		PRIMARY KEY (session_key)
 	);`
 }
 
 func (t MySQLSessionTemplate) GetQ() string {
-	return "SELECT user_id, created, valid_until FROM %s WHERE session_key = ?;"
+	return "SELECT user_id, created, valid_until, last_activity, max_valid_until, remote_addr, user_agent, device_name, login_method FROM %s WHERE session_key = ?;"
 }
 
 func (t MySQLSessionTemplate) CreateQ() string {
-	return "INSERT INTO %s (user_id, session_key, created, valid_until) VALUES (?, ?, ?, ?);"
+	return "INSERT INTO %s (user_id, session_key, created, valid_until, last_activity, max_valid_until, remote_addr, user_agent, device_name, login_method) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
 }
 
 func (t MySQLSessionTemplate) DeleteForUserQ() string {
@@ -309,6 +654,26 @@ func (t MySQLSessionTemplate) DeleteKeyQ() string {
 	return "DELETE FROM %s WHERE session_key = ?"
 }
 
+func (t MySQLSessionTemplate) ExtendQ() string {
+	return "UPDATE %s SET valid_until = ?, last_activity = ? WHERE session_key = ?;"
+}
+
+func (t MySQLSessionTemplate) TouchQ() string {
+	return "UPDATE %s SET last_activity = ? WHERE session_key = ?;"
+}
+
+func (t MySQLSessionTemplate) ListForUserQ() string {
+	return "SELECT session_key, created, valid_until, last_activity, max_valid_until, remote_addr, user_agent, device_name, login_method FROM %s WHERE user_id = ?;"
+}
+
+func (t MySQLSessionTemplate) DeleteOtherQ() string {
+	return "DELETE FROM %s WHERE user_id = ? AND session_key <> ?;"
+}
+
+func (t MySQLSessionTemplate) ListValidForUserQ() string {
+	return "SELECT session_key FROM %s WHERE user_id = ? AND valid_until >= ? AND login_method <> '" + PendingLoginMethod + "' ORDER BY created FOR UPDATE;"
+}
+
 // TimeFromScanType for MySQL first checks if the value is already a time.Time
 // (the driver has an option to enable this).
 // If not it pasres the datetime in the format "2006-01-02 15:04:05".
@@ -336,10 +701,22 @@ func (*SQLite3SessionTemplate) InitQ() string {
 		user_id %s,
 		session_key CHAR(%d) NOT NULL PRIMARY KEY,
     created DATETIME NOT NULL,
-    valid_until DATETIME NOT NULL
+    valid_until DATETIME NOT NULL,
+    last_activity DATETIME NOT NULL,
+    max_valid_until DATETIME NULL,
+    remote_addr TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    device_name TEXT NOT NULL,
+    login_method TEXT NOT NULL
 	);`
 }
 
+// ListValidForUserQ does not lock the rows, sqlite3 does not support
+// SELECT ... FOR UPDATE (and locks the whole database in a transaction anyway).
+func (*SQLite3SessionTemplate) ListValidForUserQ() string {
+	return "SELECT session_key FROM %s WHERE user_id = ? AND valid_until >= ? AND login_method <> '" + PendingLoginMethod + "' ORDER BY created;"
+}
+
 // NewSQLite3SessionHandler returns a new SQLSessionHandler that uses
 // sqlite3.
 func NewSQLite3SessionHandler(db *sql.DB, tableName, userIDType string) *SQLSessionHandler {
@@ -353,6 +730,9 @@ func NewSQLite3SessionController(db *sql.DB, tableName, userIDType string) *Sess
 }
 
 // PostgresSessionTemplate ist an implementation of SQLSessionTemplate for psotgres.
+//
+// See MySQLSessionTemplate for notes about tables created by versions before
+// v0.6, the columns in postgres are of type TIMESTAMP.
 type PostgresSessionTemplate struct{}
 
 // NewPostgresSessionTemplate returns a new PostgresSessionTemplate.
@@ -366,16 +746,22 @@ func (t PostgresSessionTemplate) InitQ() string {
 		session_key CHAR(%d) NOT NULL,
     created TIMESTAMP NOT NULL,
     valid_until TIMESTAMP NOT NULL,
+    last_activity TIMESTAMP NOT NULL,
+    max_valid_until TIMESTAMP NULL,
+    remote_addr TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    device_name TEXT NOT NULL,
+    login_method TEXT NOT NULL,
 		PRIMARY KEY (session_key)
 	);`
 }
 
 func (t PostgresSessionTemplate) GetQ() string {
-	return "SELECT user_id, created, valid_until FROM %s WHERE session_key = $1;"
+	return "SELECT user_id, created, valid_until, last_activity, max_valid_until, remote_addr, user_agent, device_name, login_method FROM %s WHERE session_key = $1;"
 }
 
 func (t PostgresSessionTemplate) CreateQ() string {
-	return "INSERT INTO %s (user_id, session_key, created, valid_until) VALUES ($1, $2, $3, $4);"
+	return "INSERT INTO %s (user_id, session_key, created, valid_until, last_activity, max_valid_until, remote_addr, user_agent, device_name, login_method) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);"
 }
 
 func (t PostgresSessionTemplate) DeleteForUserQ() string {
@@ -390,6 +776,26 @@ func (t PostgresSessionTemplate) DeleteKeyQ() string {
 	return "DELETE FROM %s WHERE session_key = $1"
 }
 
+func (t PostgresSessionTemplate) ExtendQ() string {
+	return "UPDATE %s SET valid_until = $1, last_activity = $2 WHERE session_key = $3;"
+}
+
+func (t PostgresSessionTemplate) TouchQ() string {
+	return "UPDATE %s SET last_activity = $1 WHERE session_key = $2;"
+}
+
+func (t PostgresSessionTemplate) ListForUserQ() string {
+	return "SELECT session_key, created, valid_until, last_activity, max_valid_until, remote_addr, user_agent, device_name, login_method FROM %s WHERE user_id = $1;"
+}
+
+func (t PostgresSessionTemplate) DeleteOtherQ() string {
+	return "DELETE FROM %s WHERE user_id = $1 AND session_key <> $2;"
+}
+
+func (t PostgresSessionTemplate) ListValidForUserQ() string {
+	return "SELECT session_key FROM %s WHERE user_id = $1 AND valid_until >= $2 AND login_method <> '" + PendingLoginMethod + "' ORDER BY created FOR UPDATE;"
+}
+
 func (t PostgresSessionTemplate) TimeFromScanType(val interface{}) (time.Time, error) {
 	return DefaultTimeFromScanType(val)
 }
@@ -435,18 +841,44 @@ func NewPostgresSessionController(db *sql.DB, tableName, userIDType string) *Ses
 // 		password CHAR(<PWLENGTH>),
 // 		is_active BOOL,
 // 		last_login DATETIME,
+// 		email_verified DATETIME,
 // 		PRIMARY KEY(id),
 // 		UNIQUE(username)
 // 	);
 //
 // On the wiki there are more notes on how to alter this
 // scheme: https://github.com/FabianWe/goauth/wiki/Manage-Users#the-default-user-scheme
+//
+// Since version v0.6 there is also a variable-length mode (see for example
+// MySQLVarLengthUserQueries) that uses VARCHAR(<MAXLENGTH>) or TEXT for the
+// password column, this way the hashes don't need to have the same length
+// and the password handler can be changed later (see MultiPasswordHandler).
+// Existing tables can be updated with SQLUserHandler.UpgradePasswordColumn.
+//
+// The column email_verified was added in version v0.6, it can be added to
+// existing tables with SQLUserHandler.AddEmailVerifiedColumn.
 type SQLUserQueries struct {
 	// PwLength is the length of the database hashes stored in
 	// the database, needed to initialize the database with the
 	// correct length.
+	// If VariablePwLength is true it is the maximal length, 0 means
+	// that there is no maximal length.
 	PwLength int
 
+	// VariablePwLength is true if the password column has a variable
+	// length (VARCHAR or TEXT) instead of CHAR.
+	//
+	// New in version v0.6
+	VariablePwLength bool
+
+	// UpgradePasswordColumnQuery alters the password column of an existing
+	// users table to the type used in InitQuery, see
+	// SQLUserHandler.UpgradePasswordColumn. If it is empty there is nothing
+	// to do.
+	//
+	// New in version v0.6
+	UpgradePasswordColumnQuery string
+
 	// InitQuery is the query to generate the "users" table.
 	// It should take care take when executing this command
 	// no error is returned if the table already exists.
@@ -466,16 +898,26 @@ type SQLUserQueries struct {
 	InsertQuery string
 
 	// ValidateQuery must be a query that selects exactly
-	// two values: the id and the password column given
-	// the username.
+	// three values: the id, the password and the is_active column given
+	// the username (is_active was added in version v0.6).
 	// You must use one placeholder that gets replaced by the
 	// username. Example in MySQL:
-	// "SELECT id, password FROM users WHERE username = ?"
+	// "SELECT id, password, is_active FROM users WHERE username = ?"
 	ValidateQuery string
 
 	// UpdatePasswordQuery is the query to update the password for a given username.
 	UpdatePasswordQuery string
 
+	// RehashPasswordQuery replaces the password hash of a user only if it
+	// is still the old hash, the arguments are the new hash, the username
+	// and the old hash. It is used to store a new hash after Validate (see
+	// RehashChecker), the condition makes sure that a password changed in
+	// the meantime is not overwritten. If it is empty no new hashes are
+	// stored.
+	//
+	// New in version v0.6
+	RehashPasswordQuery string
+
 	// ListUsersQuery is the query to select all available users.
 	//
 	// New in version v0.4
@@ -492,7 +934,9 @@ type SQLUserQueries struct {
 	DeleteUserQ string
 
 	// GetUserInfoQuery is the query to get the information for a given username
-	// from the default scheme.
+	// from the default scheme: id, first_name, last_name, email, is_active,
+	// last_login and email_verified (email_verified was added in version
+	// v0.6).
 	//
 	// New in version v0.5
 	GetUserInfoQuery string
@@ -502,6 +946,85 @@ type SQLUserQueries struct {
 	// New in version v0.6
 	GetIDQuery string
 
+	// SetActiveQuery sets is_active for a given username, the arguments are
+	// the new value and the username.
+	//
+	// New in version v0.6
+	SetActiveQuery string
+
+	// UpdateLastLoginQuery sets last_login for a given username, the
+	// arguments are the time and the username.
+	//
+	// New in version v0.6
+	UpdateLastLoginQuery string
+
+	// UpdateUserInfoQuery updates first_name, last_name and email for a
+	// given username. The arguments are the three new values and the
+	// username, a value is NULL if the column should not be changed.
+	//
+	// New in version v0.6
+	UpdateUserInfoQuery string
+
+	// SetEmailVerifiedQuery sets email_verified for a given username, the
+	// arguments are the time (NULL if the address is not verified) and the
+	// username.
+	//
+	// New in version v0.6
+	SetEmailVerifiedQuery string
+
+	// VerifyEmailQuery sets email_verified for a given username if the email
+	// address of the user is unchanged, the arguments are the time, the
+	// username and the address.
+	//
+	// New in version v0.6
+	VerifyEmailQuery string
+
+	// UnverifyEmailQuery sets email_verified to NULL if the email address of
+	// a user is about to change, the arguments are the username and the new
+	// email address. It is executed by UpdateUserInfo before
+	// UpdateUserInfoQuery.
+	//
+	// New in version v0.6
+	UnverifyEmailQuery string
+
+	// GetEmailVerifiedQuery selects email_verified for a given username, it
+	// is used by Validate if RequireVerifiedEmail is true.
+	//
+	// New in version v0.6
+	GetEmailVerifiedQuery string
+
+	// AddEmailVerifiedColumnQuery adds the email_verified column to an
+	// existing users table, see SQLUserHandler.AddEmailVerifiedColumn.
+	//
+	// New in version v0.6
+	AddEmailVerifiedColumnQuery string
+
+	// RenameUserQuery changes the username, the arguments are the new and
+	// the old username.
+	//
+	// New in version v0.6
+	RenameUserQuery string
+
+	// ListUsersPageQuery selects id, username, first_name, last_name, email,
+	// is_active, last_login and email_verified from the users table. ListUsersPage appends
+	// the WHERE, ORDER BY, LIMIT and OFFSET clauses.
+	//
+	// New in version v0.6
+	ListUsersPageQuery string
+
+	// CountUsersQuery counts the rows in the users table, ListUsersPage
+	// appends the WHERE clause.
+	//
+	// New in version v0.6
+	CountUsersQuery string
+
+	// Placeholder returns the placeholder for the i-th argument of a query
+	// (starting with 1), it is used to build the queries in ListUsersPage.
+	// If it is nil ? is used.
+	//
+	// New in version v0.6
+	Placeholder func(i int) string
+
 	// TimeFromScanType is used to transform database time entries to
 	// gos time. See SQLSessionHandler for details.
 	// Defaults to a function that first checks if the value is already a time.Time
@@ -511,8 +1034,36 @@ type SQLUserQueries struct {
 	TimeFromScanType func(val interface{}) (time.Time, error)
 }
 
+// varLengthPwType returns the type of a variable-length password column:
+// TEXT if maxLength is <= 0 and VARCHAR(maxLength) otherwise.
+func varLengthPwType(maxLength int) string {
+	if maxLength <= 0 {
+		return "TEXT"
+	}
+	return fmt.Sprintf("VARCHAR(%d)", maxLength)
+}
+
 // MySQLUserQueries provides queries to use with MySQL.
 func MySQLUserQueries(pwLength int) *SQLUserQueries {
+	return mySQLUserQueries(pwLength, fmt.Sprintf("CHAR(%d)", pwLength))
+}
+
+// MySQLVarLengthUserQueries provides queries to use with MySQL where the
+// password column has a variable length: VARCHAR(maxLength) or TEXT if
+// maxLength is <= 0. See MaxPasswordHashLength.
+//
+// New in version v0.6
+func MySQLVarLengthUserQueries(maxLength int) *SQLUserQueries {
+	pwType := varLengthPwType(maxLength)
+	res := mySQLUserQueries(maxLength, pwType)
+	res.VariablePwLength = true
+	res.UpgradePasswordColumnQuery = fmt.Sprintf("ALTER TABLE users MODIFY password %s;", pwType)
+	return res
+}
+
+// mySQLUserQueries returns the MySQL queries with the given type of the
+// password column.
+func mySQLUserQueries(pwLength int, pwType string) *SQLUserQueries {
 	initQ := `
 	CREATE TABLE IF NOT EXISTS users (
 		id SERIAL,
@@ -520,34 +1071,74 @@ func MySQLUserQueries(pwLength int) *SQLUserQueries {
 		first_name VARCHAR(30) NOT NULL,
 		last_name VARCHAR(30) NOT NULL,
 		email VARCHAR(254),
-		password CHAR(%d),
+		password %s,
 		is_active BOOL,
 		last_login DATETIME,
+		email_verified DATETIME,
 		PRIMARY KEY(id),
 		UNIQUE(username)
 	);
 	`
-	initQ = fmt.Sprintf(initQ, pwLength)
+	initQ = fmt.Sprintf(initQ, pwType)
 	insertQ := `
 	INSERT INTO users (username, first_name, last_name, email, password, is_active, last_login)
 		VALUES(?, ?, ?, ?, ?, ?, ?);
 	`
-	validateQ := "SELECT id, password FROM users WHERE username = ?"
+	validateQ := "SELECT id, password, is_active FROM users WHERE username = ?"
 	updateQ := "UPDATE users SET password=? WHERE username=?"
+	rehashQ := "UPDATE users SET password=? WHERE username=? AND password=?"
 	listUsersQ := "SELECT id, username FROM users"
 	getUsernameQ := "SELECT username FROM users WHERE id=?"
 	deleteQ := "DELETE FROM users WHERE username=?"
-	getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login FROM users WHERE username=?"
+	getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login, email_verified FROM users WHERE username=?"
 	getIDQuery := "SELECT id FROM users WHERE username=?"
+	setActiveQ := "UPDATE users SET is_active=? WHERE username=?"
+	lastLoginQ := "UPDATE users SET last_login=? WHERE username=?"
+	updateInfoQ := "UPDATE users SET first_name=COALESCE(?, first_name), last_name=COALESCE(?, last_name), email=COALESCE(?, email) WHERE username=?"
+	setVerifiedQ := "UPDATE users SET email_verified=? WHERE username=?"
+	verifyQ := "UPDATE users SET email_verified=? WHERE username=? AND email=?"
+	unverifyQ := "UPDATE users SET email_verified=NULL WHERE username=? AND (email IS NULL OR email<>?)"
+	getVerifiedQ := "SELECT email_verified FROM users WHERE username=?"
+	addVerifiedQ := "ALTER TABLE users ADD COLUMN email_verified DATETIME"
+	renameQ := "UPDATE users SET username=? WHERE username=?"
+	listPageQ := "SELECT id, username, first_name, last_name, email, is_active, last_login, email_verified FROM users"
+	countQ := "SELECT COUNT(*) FROM users"
 	return &SQLUserQueries{PwLength: pwLength, InitQuery: initQ,
 		InsertQuery: insertQ, ValidateQuery: validateQ, UpdatePasswordQuery: updateQ,
+		RehashPasswordQuery: rehashQ,
 		ListUsersQuery: listUsersQ, GetUsernameQ: getUsernameQ,
 		DeleteUserQ: deleteQ, GetUserInfoQuery: getUserInfoQ,
-		GetIDQuery: getIDQuery, TimeFromScanType: DefaultTimeFromScanType}
+		GetIDQuery: getIDQuery, SetActiveQuery: setActiveQ,
+		UpdateLastLoginQuery: lastLoginQ, UpdateUserInfoQuery: updateInfoQ,
+		SetEmailVerifiedQuery: setVerifiedQ, VerifyEmailQuery: verifyQ,
+		UnverifyEmailQuery: unverifyQ,
+		GetEmailVerifiedQuery: getVerifiedQ, AddEmailVerifiedColumnQuery: addVerifiedQ,
+		RenameUserQuery: renameQ, ListUsersPageQuery: listPageQ,
+		CountUsersQuery: countQ, TimeFromScanType: DefaultTimeFromScanType}
 }
 
 // PostgresUserQueries provides queries to use with postgres.
 func PostgresUserQueries(pwLength int) *SQLUserQueries {
+	return postgresUserQueries(pwLength, fmt.Sprintf("char(%d)", pwLength))
+}
+
+// PostgresVarLengthUserQueries provides queries to use with postgres where
+// the password column has a variable length: VARCHAR(maxLength) or TEXT if
+// maxLength is <= 0. See MaxPasswordHashLength.
+//
+// New in version v0.6
+func PostgresVarLengthUserQueries(maxLength int) *SQLUserQueries {
+	pwType := varLengthPwType(maxLength)
+	res := postgresUserQueries(maxLength, pwType)
+	res.VariablePwLength = true
+	// char values are padded with spaces, so remove them
+	res.UpgradePasswordColumnQuery = fmt.Sprintf("ALTER TABLE users ALTER COLUMN password TYPE %s USING rtrim(password);", pwType)
+	return res
+}
+
+// postgresUserQueries returns the postgres queries with the given type of
+// the password column.
+func postgresUserQueries(pwLength int, pwType string) *SQLUserQueries {
 	initQ := `
 	CREATE TABLE IF NOT EXISTS users (
 		id bigserial,
@@ -555,35 +1146,80 @@ func PostgresUserQueries(pwLength int) *SQLUserQueries {
 		first_name varchar(30) NOT NULL,
 		last_name varchar(30) NOT NULL,
 		email varchar(254),
-		password char(%d),
+		password %s,
 		is_active bool NOT NULL,
 		last_login timestamp NOT NULL,
+		email_verified timestamp,
 		unique (username)
 	);
 	`
-	initQ = fmt.Sprintf(initQ, pwLength)
+	initQ = fmt.Sprintf(initQ, pwType)
 	insertQ := `
 	INSERT INTO users (username, first_name, last_name, email, password, is_active, last_login)
 		VALUES ($1, $2, $3, $4, $5, $6, $7);
 	`
-	validateQ := "SELECT id, password FROM users WHERE username = $1"
+	validateQ := "SELECT id, password, is_active FROM users WHERE username = $1"
 	updateQ := "UPDATE users SET password=$1 WHERE username = $2"
+	rehashQ := "UPDATE users SET password=$1 WHERE username = $2 AND password = $3"
 	listUsersQ := "SELECT id, username FROM users"
 	getUsernameQ := "SELECT username FROM users WHERE id = $1"
 	deleteQ := "DELETE FROM users WHERE username = $1"
-	getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login FROM users WHERE username = $1"
+	getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login, email_verified FROM users WHERE username = $1"
 	getIDQuery := "SELECT id FROM users WHERE username = $1"
+	setActiveQ := "UPDATE users SET is_active=$1 WHERE username = $2"
+	lastLoginQ := "UPDATE users SET last_login=$1 WHERE username = $2"
+	updateInfoQ := "UPDATE users SET first_name=COALESCE($1, first_name), last_name=COALESCE($2, last_name), email=COALESCE($3, email) WHERE username = $4"
+	setVerifiedQ := "UPDATE users SET email_verified=$1 WHERE username = $2"
+	verifyQ := "UPDATE users SET email_verified=$1 WHERE username = $2 AND email = $3"
+	unverifyQ := "UPDATE users SET email_verified=NULL WHERE username = $1 AND (email IS NULL OR email <> $2)"
+	getVerifiedQ := "SELECT email_verified FROM users WHERE username = $1"
+	addVerifiedQ := "ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified timestamp"
+	renameQ := "UPDATE users SET username=$1 WHERE username = $2"
+	listPageQ := "SELECT id, username, first_name, last_name, email, is_active, last_login, email_verified FROM users"
+	countQ := "SELECT COUNT(*) FROM users"
 	return &SQLUserQueries{PwLength: pwLength, InitQuery: initQ,
 		InsertQuery: insertQ, ValidateQuery: validateQ, UpdatePasswordQuery: updateQ,
+		RehashPasswordQuery: rehashQ,
 		ListUsersQuery: listUsersQ, GetUsernameQ: getUsernameQ,
 		DeleteUserQ: deleteQ, GetUserInfoQuery: getUserInfoQ,
-		GetIDQuery: getIDQuery, TimeFromScanType: DefaultTimeFromScanType}
+		GetIDQuery: getIDQuery, SetActiveQuery: setActiveQ,
+		UpdateLastLoginQuery: lastLoginQ, UpdateUserInfoQuery: updateInfoQ,
+		SetEmailVerifiedQuery: setVerifiedQ, VerifyEmailQuery: verifyQ,
+		UnverifyEmailQuery: unverifyQ,
+		GetEmailVerifiedQuery: getVerifiedQ, AddEmailVerifiedColumnQuery: addVerifiedQ,
+		RenameUserQuery: renameQ, ListUsersPageQuery: listPageQ,
+		CountUsersQuery: countQ, Placeholder: postgresPlaceholder,
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// postgresPlaceholder returns $i.
+func postgresPlaceholder(i int) string {
+	return fmt.Sprintf("$%d", i)
 }
 
 // SQLite3UserQueries provides queries to use with sqlite3.
 func SQLite3UserQueries(pwLength int) *SQLUserQueries {
+	return sqlite3UserQueries(pwLength, fmt.Sprintf("CHAR(%d)", pwLength))
+}
+
+// SQLite3VarLengthUserQueries provides queries to use with sqlite3 where the
+// password column has a variable length: VARCHAR(maxLength) or TEXT if
+// maxLength is <= 0.
+// sqlite3 doesn't enforce the length of a column and doesn't pad values, so
+// there is no UpgradePasswordColumnQuery.
+//
+// New in version v0.6
+func SQLite3VarLengthUserQueries(maxLength int) *SQLUserQueries {
+	res := sqlite3UserQueries(maxLength, varLengthPwType(maxLength))
+	res.VariablePwLength = true
+	return res
+}
+
+// sqlite3UserQueries returns the sqlite3 queries with the given type of the
+// password column.
+func sqlite3UserQueries(pwLength int, pwType string) *SQLUserQueries {
 	// nearly everything is the same as for mysql
-	res := MySQLUserQueries(pwLength)
+	res := mySQLUserQueries(pwLength, pwType)
 	initQ := `
 	CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY,
@@ -591,13 +1227,14 @@ func SQLite3UserQueries(pwLength int) *SQLUserQueries {
 		first_name VARCHAR(30) NOT NULL,
 		last_name VARCHAR(30) NOT NULL,
 		email VARCHAR(254),
-		password CHAR(%d),
+		password %s,
 		is_active BOOL,
 		last_login DATETIME,
+		email_verified DATETIME,
 		UNIQUE(username)
 	);
 	`
-	initQ = fmt.Sprintf(initQ, pwLength)
+	initQ = fmt.Sprintf(initQ, pwType)
 	res.InitQuery = initQ
 	return res
 }
@@ -614,6 +1251,20 @@ type SQLUserHandler struct {
 	// PwHandler is used to encrypt / validate passwords.
 	PwHandler PasswordHandler
 
+	// Policy is checked by Insert and UpdatePassword, if the password
+	// violates the policy a *PolicyError is returned. nil means that all
+	// passwords are allowed.
+	//
+	// New in version v0.6
+	Policy PasswordPolicy
+
+	// RequireVerifiedEmail is true if Validate should return
+	// ErrEmailNotVerified for users with an email address that is not
+	// verified, see EmailVerificationManager.
+	//
+	// New in version v0.6
+	RequireVerifiedEmail bool
+
 	// required for example for sqlite
 	blockDB bool
 	mutex   sync.RWMutex
@@ -676,16 +1327,75 @@ func NewPostgresUserHandler(db *sql.DB, pwHandler PasswordHandler) *SQLUserHandl
 }
 
 func (handler *SQLUserHandler) Init() error {
+	return handler.InitContext(context.Background())
+}
+
+func (handler *SQLUserHandler) InitContext(ctx context.Context) error {
 	if handler.blockDB {
 		handler.mutex.Lock()
 		defer handler.mutex.Unlock()
 	}
-	_, err := handler.DB.Exec(handler.InitQuery)
+	_, err := handler.DB.ExecContext(ctx, handler.InitQuery)
+	return err
+}
+
+// UpgradePasswordColumn alters the password column of an existing users
+// table, for example from CHAR(60) to VARCHAR or TEXT if the handler uses
+// variable-length queries like MySQLVarLengthUserQueries.
+// If UpgradePasswordColumnQuery is empty it does nothing.
+//
+// New in version v0.6
+func (handler *SQLUserHandler) UpgradePasswordColumn() error {
+	return handler.UpgradePasswordColumnContext(context.Background())
+}
+
+// UpgradePasswordColumnContext is UpgradePasswordColumn with a context.
+//
+// New in version v0.6
+func (handler *SQLUserHandler) UpgradePasswordColumnContext(ctx context.Context) error {
+	if handler.UpgradePasswordColumnQuery == "" {
+		return nil
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.ExecContext(ctx, handler.UpgradePasswordColumnQuery)
+	return err
+}
+
+// AddEmailVerifiedColumn adds the email_verified column (new in version
+// v0.6) to an existing users table. For MySQL and sqlite3 it returns an
+// error if the column already exists. If AddEmailVerifiedColumnQuery is
+// empty it does nothing.
+//
+// New in version v0.6
+func (handler *SQLUserHandler) AddEmailVerifiedColumn() error {
+	return handler.AddEmailVerifiedColumnContext(context.Background())
+}
+
+// AddEmailVerifiedColumnContext is AddEmailVerifiedColumn with a context.
+//
+// New in version v0.6
+func (handler *SQLUserHandler) AddEmailVerifiedColumnContext(ctx context.Context) error {
+	if handler.AddEmailVerifiedColumnQuery == "" {
+		return nil
+	}
+	_, err := handler.exec(ctx, handler.AddEmailVerifiedColumnQuery)
 	return err
 }
 
 func (handler *SQLUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	return handler.InsertContext(context.Background(), userName, firstName, lastName, email, plainPW)
+}
+
+func (handler *SQLUserHandler) InsertContext(ctx context.Context, userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
 	now := CurrentTime()
+	user := &BaseUserInformation{UserName: userName, FirstName: firstName,
+		LastName: lastName, Email: email}
+	if policyErr := CheckPasswordPolicy(handler.Policy, user, plainPW); policyErr != nil {
+		return NoUserID, policyErr
+	}
 	// try to encrypt the pw
 	encrypted, encErr := handler.PwHandler.GenerateHash(plainPW)
 	if encErr != nil {
@@ -696,7 +1406,7 @@ func (handler *SQLUserHandler) Insert(userName, firstName, lastName, email strin
 		handler.mutex.Lock()
 		defer handler.mutex.Unlock()
 	}
-	res, err := handler.DB.Exec(handler.InsertQuery, userName, firstName, lastName, email, encrypted, true, now)
+	res, err := handler.DB.ExecContext(ctx, handler.InsertQuery, userName, firstName, lastName, email, encrypted, true, now)
 	if err != nil {
 		return NoUserID, err
 	}
@@ -716,18 +1426,13 @@ func (handler *SQLUserHandler) Insert(userName, firstName, lastName, email strin
 }
 
 func (handler *SQLUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
-	if handler.blockDB {
-		handler.mutex.RLock()
-		defer handler.mutex.RUnlock()
-	}
+	return handler.ValidateContext(context.Background(), userName, cleartextPwCheck)
+}
+
+func (handler *SQLUserHandler) ValidateContext(ctx context.Context, userName string, cleartextPwCheck []byte) (uint64, error) {
 	// first try to get the id and the password
-	row := handler.DB.QueryRow(handler.ValidateQuery, userName)
-	var userId uint64
-	var hashPw []byte
-	if err := row.Scan(&userId, &hashPw); err != nil {
-		if err == sql.ErrNoRows {
-			return NoUserID, ErrUserNotFound
-		}
+	userId, hashPw, isActive, err := handler.getPassword(ctx, userName)
+	if err != nil {
 		return NoUserID, err
 	}
 	// validate the password
@@ -737,13 +1442,274 @@ func (handler *SQLUserHandler) Validate(userName string, cleartextPwCheck []byte
 	}
 	// no error, check if passwords did match
 	if test {
+		// only report inactive users if the password is correct
+		if !isActive {
+			return NoUserID, ErrUserInactive
+		}
+		if handler.RequireVerifiedEmail {
+			verified, verifiedErr := handler.emailVerified(ctx, userName)
+			if verifiedErr != nil {
+				return NoUserID, verifiedErr
+			}
+			if !verified {
+				return NoUserID, ErrEmailNotVerified
+			}
+		}
+		handler.rehash(ctx, userName, hashPw, cleartextPwCheck)
+		handler.updateLastLogin(ctx, userName)
 		return userId, nil
 	} else {
 		return NoUserID, nil
 	}
 }
 
+// getPassword returns the id, the password hash and is_active of the user.
+func (handler *SQLUserHandler) getPassword(ctx context.Context, userName string) (uint64, []byte, bool, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	row := handler.DB.QueryRowContext(ctx, handler.ValidateQuery, userName)
+	var userId uint64
+	var hashPw []byte
+	var isActive sql.NullBool
+	if err := row.Scan(&userId, &hashPw, &isActive); err != nil {
+		if err == sql.ErrNoRows {
+			return NoUserID, nil, false, ErrUserNotFound
+		}
+		return NoUserID, nil, false, err
+	}
+	// is_active can be NULL in MySQL, in this case the user is active
+	return userId, hashPw, !isActive.Valid || isActive.Bool, nil
+}
+
+// emailVerified returns true if email_verified is set for the user.
+func (handler *SQLUserHandler) emailVerified(ctx context.Context, userName string) (bool, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var verified interface{}
+	if err := handler.DB.QueryRowContext(ctx, handler.GetEmailVerifiedQuery, userName).Scan(&verified); err != nil {
+		if err == sql.ErrNoRows {
+			return false, ErrUserNotFound
+		}
+		return false, err
+	}
+	return verified != nil, nil
+}
+
+// updateLastLogin sets the last login of the user to now, errors are only
+// logged since the user was validated successfully.
+func (handler *SQLUserHandler) updateLastLogin(ctx context.Context, userName string) {
+	if handler.UpdateLastLoginQuery == "" {
+		return
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	if _, err := handler.DB.ExecContext(ctx, handler.UpdateLastLoginQuery, CurrentTime(), userName); err != nil {
+		log.WithError(err).Warn("goauth: Can't update last login")
+	}
+}
+
+// SetActive sets is_active for the user, it returns ErrUserNotFound if the
+// user doesn't exist.
+func (handler *SQLUserHandler) SetActive(userName string, active bool) error {
+	return handler.SetActiveContext(context.Background(), userName, active)
+}
+
+func (handler *SQLUserHandler) SetActiveContext(ctx context.Context, userName string, active bool) error {
+	res, err := handler.exec(ctx, handler.SetActiveQuery, active, userName)
+	if err != nil {
+		return err
+	}
+	return handler.checkUpdated(ctx, res, userName)
+}
+
+// SetEmailVerified sets email_verified to now or NULL, it returns
+// ErrUserNotFound if the user doesn't exist.
+func (handler *SQLUserHandler) SetEmailVerified(userName string, verified bool) error {
+	return handler.SetEmailVerifiedContext(context.Background(), userName, verified)
+}
+
+func (handler *SQLUserHandler) SetEmailVerifiedContext(ctx context.Context, userName string, verified bool) error {
+	var value interface{}
+	if verified {
+		value = CurrentTime()
+	}
+	res, err := handler.exec(ctx, handler.SetEmailVerifiedQuery, value, userName)
+	if err != nil {
+		return err
+	}
+	return handler.checkUpdated(ctx, res, userName)
+}
+
+// VerifyEmail sets email_verified to now if the email address of the user
+// is still email, it returns ErrUserNotFound if the user doesn't exist and
+// ErrEmailChanged if the user has a different address.
+func (handler *SQLUserHandler) VerifyEmail(userName, email string) error {
+	return handler.VerifyEmailContext(context.Background(), userName, email)
+}
+
+func (handler *SQLUserHandler) VerifyEmailContext(ctx context.Context, userName, email string) error {
+	res, err := handler.exec(ctx, handler.VerifyEmailQuery, CurrentTime(), userName, email)
+	if err != nil {
+		return err
+	}
+	if num, err := res.RowsAffected(); err == nil && num > 0 {
+		return nil
+	}
+	// no row affected: either the user doesn't exist, the address changed
+	// or (MySQL) email_verified already has this value
+	user, err := handler.GetUserBaseInfoContext(ctx, userName)
+	if err != nil {
+		return err
+	}
+	if user.Email != email || user.EmailVerified.IsZero() {
+		return ErrEmailChanged
+	}
+	return nil
+}
+
+// nullString returns nil for a nil pointer (NULL in the database) and the
+// string otherwise.
+func nullString(s *string) interface{} {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
+
+// checkUpdated returns ErrUserNotFound if no row was affected by an update
+// and the user doesn't exist. Some drivers (MySQL) report 0 affected rows if
+// the values didn't change, so in this case we have to check if the user
+// exists.
+func (handler *SQLUserHandler) checkUpdated(ctx context.Context, res sql.Result, userName string) error {
+	if num, err := res.RowsAffected(); err == nil && num > 0 {
+		return nil
+	}
+	_, err := handler.GetUserIDContext(ctx, userName)
+	return err
+}
+
+func (handler *SQLUserHandler) UpdateUserInfo(userName string, update *UserInfoUpdate) error {
+	return handler.UpdateUserInfoContext(context.Background(), userName, update)
+}
+
+func (handler *SQLUserHandler) UpdateUserInfoContext(ctx context.Context, userName string, update *UserInfoUpdate) error {
+	if update.Email == nil || handler.UnverifyEmailQuery == "" {
+		res, err := handler.exec(ctx, handler.UpdateUserInfoQuery, nullString(update.FirstName),
+			nullString(update.LastName), nullString(update.Email), userName)
+		if err != nil {
+			return err
+		}
+		return handler.checkUpdated(ctx, res, userName)
+	}
+	// the address is unverified and changed in one transaction, otherwise
+	// a verification between both queries would verify the new address
+	res, err := handler.updateUserInfoTx(ctx, userName, update)
+	if err != nil {
+		return err
+	}
+	return handler.checkUpdated(ctx, res, userName)
+}
+
+// updateUserInfoTx executes UnverifyEmailQuery and UpdateUserInfoQuery in a
+// transaction and returns the result of UpdateUserInfoQuery.
+func (handler *SQLUserHandler) updateUserInfoTx(ctx context.Context, userName string, update *UserInfoUpdate) (sql.Result, error) {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	tx, err := handler.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, handler.UnverifyEmailQuery, userName, *update.Email); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, handler.UpdateUserInfoQuery, nullString(update.FirstName),
+		nullString(update.LastName), nullString(update.Email), userName)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (handler *SQLUserHandler) RenameUser(oldName, newName string) error {
+	return handler.RenameUserContext(context.Background(), oldName, newName)
+}
+
+func (handler *SQLUserHandler) RenameUserContext(ctx context.Context, oldName, newName string) error {
+	if oldName == newName {
+		_, err := handler.GetUserIDContext(ctx, oldName)
+		return err
+	}
+	res, err := handler.exec(ctx, handler.RenameUserQuery, newName, oldName)
+	if err != nil {
+		// the error of the unique constraint depends on the driver, so check
+		// if the new name is in use
+		if _, idErr := handler.GetUserIDContext(ctx, newName); idErr == nil {
+			return ErrUserNameInUse
+		}
+		return err
+	}
+	return handler.checkUpdated(ctx, res, oldName)
+}
+
+// exec executes a query with the given arguments.
+func (handler *SQLUserHandler) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	return handler.DB.ExecContext(ctx, query, args...)
+}
+
+// rehash stores a new hash of the password if the PwHandler reports that the
+// old hash needs a rehash, see RehashChecker. Errors are only logged since
+// the user was validated successfully.
+func (handler *SQLUserHandler) rehash(ctx context.Context, userName string, hashPw, plainPW []byte) {
+	if handler.RehashPasswordQuery == "" || !NeedsRehash(handler.PwHandler, hashPw) {
+		return
+	}
+	encrypted, encErr := handler.PwHandler.GenerateHash(plainPW)
+	if encErr != nil {
+		log.WithError(encErr).Warn("goauth: Can't rehash password")
+		return
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	// only replace the hash that was just verified, the password may have
+	// been changed in the meantime
+	if _, err := handler.DB.ExecContext(ctx, handler.RehashPasswordQuery, encrypted, userName, hashPw); err != nil {
+		log.WithError(err).Warn("goauth: Can't store rehashed password")
+	}
+}
+
 func (handler *SQLUserHandler) UpdatePassword(username string, plainPW []byte) error {
+	return handler.UpdatePasswordContext(context.Background(), username, plainPW)
+}
+
+func (handler *SQLUserHandler) UpdatePasswordContext(ctx context.Context, username string, plainPW []byte) error {
+	if handler.Policy != nil {
+		user, infoErr := handler.GetUserBaseInfoContext(ctx, username)
+		if infoErr != nil {
+			return infoErr
+		}
+		if policyErr := handler.Policy.CheckPolicy(user, plainPW); policyErr != nil {
+			return policyErr
+		}
+	}
 	// try to encrypt the pw
 	encrypted, encErr := handler.PwHandler.GenerateHash(plainPW)
 	if encErr != nil {
@@ -756,18 +1722,22 @@ func (handler *SQLUserHandler) UpdatePassword(username string, plainPW []byte) e
 	}
 
 	// now try to update the password
-	_, err := handler.DB.Exec(handler.UpdatePasswordQuery, encrypted, username)
+	_, err := handler.DB.ExecContext(ctx, handler.UpdatePasswordQuery, encrypted, username)
 	return err
 }
 
 func (handler *SQLUserHandler) ListUsers() (map[uint64]string, error) {
+	return handler.ListUsersContext(context.Background())
+}
+
+func (handler *SQLUserHandler) ListUsersContext(ctx context.Context) (map[uint64]string, error) {
 	if handler.blockDB {
 		handler.mutex.RLock()
 		defer handler.mutex.RUnlock()
 	}
 
 	// try to get the results
-	rows, err := handler.DB.Query(handler.ListUsersQuery)
+	rows, err := handler.DB.QueryContext(ctx, handler.ListUsersQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -790,11 +1760,15 @@ func (handler *SQLUserHandler) ListUsers() (map[uint64]string, error) {
 }
 
 func (handler *SQLUserHandler) GetUserName(id uint64) (string, error) {
+	return handler.GetUserNameContext(context.Background(), id)
+}
+
+func (handler *SQLUserHandler) GetUserNameContext(ctx context.Context, id uint64) (string, error) {
 	if handler.blockDB {
 		handler.mutex.RLock()
 		defer handler.mutex.RUnlock()
 	}
-	row := handler.DB.QueryRow(handler.GetUsernameQ, id)
+	row := handler.DB.QueryRowContext(ctx, handler.GetUsernameQ, id)
 	var username string
 	if err := row.Scan(&username); err != nil {
 		if err == sql.ErrNoRows {
@@ -806,20 +1780,28 @@ func (handler *SQLUserHandler) GetUserName(id uint64) (string, error) {
 }
 
 func (handler *SQLUserHandler) DeleteUser(username string) error {
+	return handler.DeleteUserContext(context.Background(), username)
+}
+
+func (handler *SQLUserHandler) DeleteUserContext(ctx context.Context, username string) error {
 	if handler.blockDB {
 		handler.mutex.Lock()
 		defer handler.mutex.Unlock()
 	}
-	_, err := handler.DB.Exec(handler.DeleteUserQ, username)
+	_, err := handler.DB.ExecContext(ctx, handler.DeleteUserQ, username)
 	return err
 }
 
 func (handler *SQLUserHandler) GetUserID(userName string) (uint64, error) {
+	return handler.GetUserIDContext(context.Background(), userName)
+}
+
+func (handler *SQLUserHandler) GetUserIDContext(ctx context.Context, userName string) (uint64, error) {
 	if handler.blockDB {
 		handler.mutex.RLock()
 		defer handler.mutex.RUnlock()
 	}
-	row := handler.DB.QueryRow(handler.GetIDQuery, userName)
+	row := handler.DB.QueryRowContext(ctx, handler.GetIDQuery, userName)
 	var id uint64
 	if err := row.Scan(&id); err != nil {
 		if err == sql.ErrNoRows {
@@ -830,24 +1812,175 @@ func (handler *SQLUserHandler) GetUserID(userName string) (uint64, error) {
 	return id, nil
 }
 
-// getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login FROM users WHERE id=?"
+// getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login, email_verified FROM users WHERE id=?"
 func (handler *SQLUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
-	row := handler.DB.QueryRow(handler.GetUserInfoQuery, userName)
+	return handler.GetUserBaseInfoContext(context.Background(), userName)
+}
+
+func (handler *SQLUserHandler) GetUserBaseInfoContext(ctx context.Context, userName string) (*BaseUserInformation, error) {
+	row := handler.DB.QueryRowContext(ctx, handler.GetUserInfoQuery, userName)
 	var id uint64
-	var firstName, lastName, email string
-	var isActive bool
-	var lastLoginVal interface{}
-	if err := row.Scan(&id, &firstName, &lastName, &email, &isActive, &lastLoginVal); err != nil {
+	var firstName, lastName string
+	var email sql.NullString
+	var isActive sql.NullBool
+	var lastLoginVal, verifiedVal interface{}
+	if err := row.Scan(&id, &firstName, &lastName, &email, &isActive, &lastLoginVal, &verifiedVal); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
-	lastLogin, loginParseErr := handler.TimeFromScanType(lastLoginVal)
-	if loginParseErr != nil {
-		return nil, loginParseErr
-	}
+	// email and is_active can be NULL in MySQL, a NULL is_active means that
+	// the user is active (like in Validate)
 	res := &BaseUserInformation{ID: id, UserName: userName, FirstName: firstName,
-		LastName: lastName, Email: email, LastLogin: lastLogin, IsActive: isActive}
+		LastName: lastName, Email: email.String, IsActive: !isActive.Valid || isActive.Bool}
+	if lastLoginVal != nil {
+		lastLogin, loginParseErr := handler.TimeFromScanType(lastLoginVal)
+		if loginParseErr != nil {
+			return nil, loginParseErr
+		}
+		res.LastLogin = lastLogin
+	}
+	if verifiedVal != nil {
+		verified, verifiedParseErr := handler.TimeFromScanType(verifiedVal)
+		if verifiedParseErr != nil {
+			return nil, verifiedParseErr
+		}
+		res.EmailVerified = verified
+	}
 	return res, nil
 }
+
+// placeholder returns the placeholder for the i-th argument.
+func (handler *SQLUserHandler) placeholder(i int) string {
+	if handler.Placeholder == nil {
+		return "?"
+	}
+	return handler.Placeholder(i)
+}
+
+// likePrefix returns a LIKE pattern that matches all strings with the given
+// prefix, ! is used as escape character.
+func likePrefix(prefix string) string {
+	replacer := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return replacer.Replace(prefix) + "%"
+}
+
+// userFilterWhere returns the WHERE clause (empty if there is no condition)
+// and its arguments for a filter.
+func (handler *SQLUserHandler) userFilterWhere(filter *UserFilter) (string, []interface{}) {
+	if filter == nil {
+		return "", nil
+	}
+	var conds []string
+	var args []interface{}
+	// add adds a condition, each %s in cond is replaced by the placeholder
+	// of the next value
+	add := func(cond string, values ...interface{}) {
+		placeholders := make([]interface{}, len(values))
+		for i, value := range values {
+			args = append(args, value)
+			placeholders[i] = handler.placeholder(len(args))
+		}
+		conds = append(conds, fmt.Sprintf(cond, placeholders...))
+	}
+	if filter.Active != nil {
+		// NULL means active, see Validate
+		add("COALESCE(is_active, %s) = %s", true, *filter.Active)
+	}
+	if filter.UserNamePrefix != "" {
+		add("username LIKE %s ESCAPE '!'", likePrefix(filter.UserNamePrefix))
+	}
+	if filter.EmailPrefix != "" {
+		add("email LIKE %s ESCAPE '!'", likePrefix(filter.EmailPrefix))
+	}
+	if !filter.LastLoginFrom.IsZero() {
+		add("last_login >= %s", filter.LastLoginFrom.UTC())
+	}
+	if !filter.LastLoginTo.IsZero() {
+		add("last_login < %s", filter.LastLoginTo.UTC())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// userOrderBy returns the ORDER BY clause for sort.
+func userOrderBy(sort UserSort) string {
+	dir := "ASC"
+	if sort.Descending {
+		dir = "DESC"
+	}
+	switch sort.Field {
+	case SortUsersByName:
+		return fmt.Sprintf(" ORDER BY username %s", dir)
+	case SortUsersByLastLogin:
+		return fmt.Sprintf(" ORDER BY last_login %s, id %s", dir, dir)
+	default:
+		return fmt.Sprintf(" ORDER BY id %s", dir)
+	}
+}
+
+func (handler *SQLUserHandler) ListUsersPage(filter *UserFilter, sort UserSort, limit int, cursor string) (*UserPage, error) {
+	return handler.ListUsersPageContext(context.Background(), filter, sort, limit, cursor)
+}
+
+// ListUsersPageContext is ListUsersPage with a context.
+// It uses LIMIT and OFFSET, so you should create indexes on the columns you
+// filter and sort by (username is already unique).
+func (handler *SQLUserHandler) ListUsersPageContext(ctx context.Context, filter *UserFilter, sort UserSort, limit int, cursor string) (*UserPage, error) {
+	offset, cursorErr := parsePageCursor(cursor)
+	if cursorErr != nil {
+		return nil, cursorErr
+	}
+	limit = pageLimit(limit)
+	where, args := handler.userFilterWhere(filter)
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var total int64
+	if err := handler.DB.QueryRowContext(ctx, handler.CountUsersQuery+where, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("%s%s%s LIMIT %s OFFSET %s", handler.ListUsersPageQuery, where,
+		userOrderBy(sort), handler.placeholder(len(args)+1), handler.placeholder(len(args)+2))
+	rows, err := handler.DB.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]*BaseUserInformation, 0, limit)
+	for rows.Next() {
+		user := new(BaseUserInformation)
+		var email sql.NullString
+		var isActive sql.NullBool
+		var lastLoginVal, verifiedVal interface{}
+		if scanErr := rows.Scan(&user.ID, &user.UserName, &user.FirstName, &user.LastName,
+			&email, &isActive, &lastLoginVal, &verifiedVal); scanErr != nil {
+			return nil, scanErr
+		}
+		user.Email = email.String
+		user.IsActive = !isActive.Valid || isActive.Bool
+		if lastLoginVal != nil {
+			lastLogin, loginParseErr := handler.TimeFromScanType(lastLoginVal)
+			if loginParseErr != nil {
+				return nil, loginParseErr
+			}
+			user.LastLogin = lastLogin
+		}
+		if verifiedVal != nil {
+			verified, verifiedParseErr := handler.TimeFromScanType(verifiedVal)
+			if verifiedParseErr != nil {
+				return nil, verifiedParseErr
+			}
+			user.EmailVerified = verified
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newUserPage(users, total, offset), nil
+}
@@ -0,0 +1,647 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrAccountLocked is returned (wrapped in a *ThrottleError) if there were
+// too many failed logins for a user name and the account is temporarily
+// locked.
+//
+// New in version v0.6
+var ErrAccountLocked = errors.New("The account is temporarily locked.")
+
+// ErrTooManyAttempts is returned (wrapped in a *ThrottleError) if the next
+// login attempt is not allowed yet (exponential backoff) or if there were
+// too many failed logins from an IP address.
+//
+// New in version v0.6
+var ErrTooManyAttempts = errors.New("Too many login attempts.")
+
+// ThrottleError is returned by LoginThrottler if a login attempt is not
+// allowed. Err is either ErrAccountLocked or ErrTooManyAttempts, RetryAfter
+// is the duration after which the next attempt is allowed.
+//
+// New in version v0.6
+type ThrottleError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (err *ThrottleError) Error() string {
+	return fmt.Sprintf("%s Retry after %s.", err.Err.Error(), err.RetryAfter)
+}
+
+// Unwrap returns ErrAccountLocked or ErrTooManyAttempts.
+func (err *ThrottleError) Unwrap() error {
+	return err.Err
+}
+
+// AttemptInfo stores the number of failed login attempts and the time of the
+// last failure.
+//
+// New in version v0.6
+type AttemptInfo struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// AttemptStore stores failed login attempts for keys (user names or IP
+// addresses, see LoginThrottler).
+// There are implementations that store the attempts in memory, in a SQL
+// database and in redis.
+//
+// New in version v0.6
+type AttemptStore interface {
+	// Init initializes the storage, for example creates a table.
+	Init() error
+
+	// GetAttempts returns the attempts for key. If there are no attempts
+	// it must return an AttemptInfo with Failures = 0.
+	GetAttempts(ctx context.Context, key string) (*AttemptInfo, error)
+
+	// AddFailure adds a failed attempt for key at time now and returns the
+	// updated information. All failures before resetBefore must be
+	// forgotten, i.e. if the last failure was before resetBefore the count
+	// starts again with 1. This must happen atomically.
+	AddFailure(ctx context.Context, key string, now, resetBefore time.Time) (*AttemptInfo, error)
+
+	// ResetAttempts removes all attempts for key.
+	ResetAttempts(ctx context.Context, key string) error
+}
+
+// LoginThrottler limits the number of failed logins per user name and per
+// IP address.
+//
+// For a user name the first FreeAttempts failures are free, after that the
+// user has to wait BaseDelay * 2^(failures - FreeAttempts) (at most MaxDelay)
+// after the last failure before the next attempt (ErrTooManyAttempts).
+// After MaxFailures failures the account is locked for LockoutDuration
+// (ErrAccountLocked).
+// Failures from an IP address are counted as well, after MaxIPFailures
+// failures no logins from that address are allowed for LockoutDuration
+// (ErrTooManyAttempts).
+// Failures are forgotten after ResetAfter without a failure, a successful
+// login resets the failures of the user name (not of the address).
+//
+// Each of the limits is disabled if it is <= 0.
+//
+// New in version v0.6
+type LoginThrottler struct {
+	Store AttemptStore
+
+	FreeAttempts        int
+	BaseDelay, MaxDelay time.Duration
+
+	MaxFailures     int
+	LockoutDuration time.Duration
+
+	MaxIPFailures int
+
+	ResetAfter time.Duration
+}
+
+// NewLoginThrottler returns a new throttler with the following defaults:
+// 3 free attempts, a base delay of one second with a maximum of 5 minutes,
+// a lockout of 15 minutes after 10 failures for a user and after 100 failures
+// for an IP address, failures are reset after 24 hours.
+//
+// New in version v0.6
+func NewLoginThrottler(store AttemptStore) *LoginThrottler {
+	return &LoginThrottler{Store: store, FreeAttempts: 3,
+		BaseDelay: time.Second, MaxDelay: 5 * time.Minute,
+		MaxFailures: 10, LockoutDuration: 15 * time.Minute,
+		MaxIPFailures: 100, ResetAfter: 24 * time.Hour}
+}
+
+// userKey and ipKey return the keys in the store.
+func userKey(userName string) string { return "user:" + userName }
+func ipKey(addr string) string       { return "ip:" + addr }
+
+// resetBefore returns the time before which failures are forgotten.
+func (t *LoginThrottler) resetBefore(now time.Time) time.Time {
+	if t.ResetAfter <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-t.ResetAfter)
+}
+
+// userWait returns the error if the user is not allowed to login now.
+func (t *LoginThrottler) userWait(info *AttemptInfo, now time.Time) error {
+	if t.MaxFailures > 0 && info.Failures >= t.MaxFailures {
+		if wait := info.LastFailure.Add(t.LockoutDuration).Sub(now); wait > 0 {
+			return &ThrottleError{Err: ErrAccountLocked, RetryAfter: wait}
+		}
+	}
+	if t.BaseDelay > 0 && info.Failures >= t.FreeAttempts {
+		delay := t.BaseDelay
+		for i := t.FreeAttempts; i < info.Failures; i++ {
+			delay *= 2
+			if t.MaxDelay > 0 && delay >= t.MaxDelay {
+				delay = t.MaxDelay
+				break
+			}
+		}
+		if wait := info.LastFailure.Add(delay).Sub(now); wait > 0 {
+			return &ThrottleError{Err: ErrTooManyAttempts, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// ipWait returns the error if logins from the address are not allowed now.
+func (t *LoginThrottler) ipWait(info *AttemptInfo, now time.Time) error {
+	if t.MaxIPFailures > 0 && info.Failures >= t.MaxIPFailures {
+		if wait := info.LastFailure.Add(t.LockoutDuration).Sub(now); wait > 0 {
+			return &ThrottleError{Err: ErrTooManyAttempts, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// Allow returns a *ThrottleError if a login attempt for the user name from
+// the address is not allowed now. remoteAddr can be empty, in this case only
+// the user name is checked.
+//
+// Allow only reads the failures, so concurrent attempts that are checked
+// before one of them failed are all allowed. Use Attempt to prevent this.
+func (t *LoginThrottler) Allow(ctx context.Context, userName, remoteAddr string) error {
+	now := CurrentTime()
+	resetBefore := t.resetBefore(now)
+	if err := t.allowAddress(ctx, remoteAddr, now, resetBefore); err != nil {
+		return err
+	}
+	_, err := t.userAttempts(ctx, userName, now, resetBefore)
+	return err
+}
+
+// allowAddress returns a *ThrottleError if logins from the address are not
+// allowed now.
+func (t *LoginThrottler) allowAddress(ctx context.Context, remoteAddr string, now, resetBefore time.Time) error {
+	if remoteAddr == "" || t.MaxIPFailures <= 0 {
+		return nil
+	}
+	info, err := t.Store.GetAttempts(ctx, ipKey(remoteAddr))
+	if err != nil {
+		return err
+	}
+	if info.LastFailure.After(resetBefore) {
+		return t.ipWait(info, now)
+	}
+	return nil
+}
+
+// userAttempts returns the failures of the user name (without the failures
+// before resetBefore) and a *ThrottleError if the user is not allowed to
+// login now.
+func (t *LoginThrottler) userAttempts(ctx context.Context, userName string, now, resetBefore time.Time) (*AttemptInfo, error) {
+	info, err := t.Store.GetAttempts(ctx, userKey(userName))
+	if err != nil {
+		return nil, err
+	}
+	if !info.LastFailure.After(resetBefore) {
+		return &AttemptInfo{}, nil
+	}
+	return info, t.userWait(info, now)
+}
+
+// Attempt checks if a login attempt for the user name from the address is
+// allowed (like Allow) and registers the attempt as a failure of the user
+// name before the credentials are checked, it returns a *ThrottleError if
+// the attempt is not allowed. Call Success if the attempt was successful
+// (this removes the failure) and AddressFailure if it failed.
+//
+// The failure is added atomically by the AttemptStore, so concurrent
+// attempts see each other: If other attempts were registered since the
+// failures were read the attempt is only allowed if the free attempts are
+// not used up yet. An attempt that is refused this way still counts as a
+// failure.
+//
+// New in version v0.6
+func (t *LoginThrottler) Attempt(ctx context.Context, userName, remoteAddr string) error {
+	now := CurrentTime()
+	resetBefore := t.resetBefore(now)
+	if err := t.allowAddress(ctx, remoteAddr, now, resetBefore); err != nil {
+		return err
+	}
+	before, err := t.userAttempts(ctx, userName, now, resetBefore)
+	if err != nil {
+		return err
+	}
+	info, err := t.Store.AddFailure(ctx, userKey(userName), now, resetBefore)
+	if err != nil {
+		return err
+	}
+	if info.Failures > before.Failures+1 {
+		// the last of the other attempts was registered just now
+		return t.userWait(&AttemptInfo{Failures: info.Failures - 1, LastFailure: now}, now)
+	}
+	return nil
+}
+
+// AddressFailure registers a failed login from the address, see Attempt.
+// It does nothing if remoteAddr is empty.
+//
+// New in version v0.6
+func (t *LoginThrottler) AddressFailure(ctx context.Context, remoteAddr string) error {
+	if remoteAddr == "" || t.MaxIPFailures <= 0 {
+		return nil
+	}
+	now := CurrentTime()
+	_, err := t.Store.AddFailure(ctx, ipKey(remoteAddr), now, t.resetBefore(now))
+	return err
+}
+
+// Failure registers a failed login for the user name and the address.
+func (t *LoginThrottler) Failure(ctx context.Context, userName, remoteAddr string) error {
+	now := CurrentTime()
+	resetBefore := t.resetBefore(now)
+	if remoteAddr != "" && t.MaxIPFailures > 0 {
+		if _, err := t.Store.AddFailure(ctx, ipKey(remoteAddr), now, resetBefore); err != nil {
+			return err
+		}
+	}
+	_, err := t.Store.AddFailure(ctx, userKey(userName), now, resetBefore)
+	return err
+}
+
+// Success resets the failures of the user name.
+func (t *LoginThrottler) Success(ctx context.Context, userName string) error {
+	return t.Store.ResetAttempts(ctx, userKey(userName))
+}
+
+// Validate is a throttled version of UserHandler.Validate: It first
+// registers the attempt (see Attempt) and returns NoUserID and a
+// *ThrottleError if it is not allowed. Otherwise it validates the password
+// with the handler and registers the failure / success. Attempts for user
+// names that don't exist count as failures as well.
+func (t *LoginThrottler) Validate(ctx context.Context, handler UserHandler, userName, remoteAddr string, cleartextPwCheck []byte) (uint64, error) {
+	if err := t.Attempt(ctx, userName, remoteAddr); err != nil {
+		return NoUserID, err
+	}
+	id, err := AsUserHandlerContext(handler).ValidateContext(ctx, userName, cleartextPwCheck)
+	switch {
+	case err == ErrUserNotFound || (err == nil && id == NoUserID):
+		if failErr := t.AddressFailure(ctx, remoteAddr); failErr != nil {
+			return NoUserID, failErr
+		}
+	case err == nil:
+		if successErr := t.Success(ctx, userName); successErr != nil {
+			return NoUserID, successErr
+		}
+	}
+	return id, err
+}
+
+// InMemoryAttemptStore is an AttemptStore that keeps the attempts in memory.
+// Entries are only removed by ResetAttempts and DeleteExpired, so you
+// should call DeleteExpired from time to time.
+//
+// New in version v0.6
+type InMemoryAttemptStore struct {
+	mutex    sync.Mutex
+	attempts map[string]AttemptInfo
+}
+
+// NewInMemoryAttemptStore returns a new empty store.
+//
+// New in version v0.6
+func NewInMemoryAttemptStore() *InMemoryAttemptStore {
+	return &InMemoryAttemptStore{attempts: make(map[string]AttemptInfo)}
+}
+
+// Init does nothing.
+func (s *InMemoryAttemptStore) Init() error {
+	return nil
+}
+
+func (s *InMemoryAttemptStore) GetAttempts(ctx context.Context, key string) (*AttemptInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := s.attempts[key]
+	return &info, nil
+}
+
+func (s *InMemoryAttemptStore) AddFailure(ctx context.Context, key string, now, resetBefore time.Time) (*AttemptInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := s.attempts[key]
+	if info.LastFailure.Before(resetBefore) {
+		info.Failures = 0
+	}
+	info.Failures++
+	info.LastFailure = now
+	s.attempts[key] = info
+	return &info, nil
+}
+
+func (s *InMemoryAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// DeleteExpired removes all entries with a last failure before resetBefore
+// (for example CurrentTime() - ResetAfter).
+func (s *InMemoryAttemptStore) DeleteExpired(resetBefore time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, info := range s.attempts {
+		if info.LastFailure.Before(resetBefore) {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+// SQLAttemptQueries are the queries used by SQLAttemptStore.
+// The table has the columns attempt_key, failures and last_failure.
+//
+// New in version v0.6
+type SQLAttemptQueries struct {
+	// InitQ creates the table.
+	InitQ string
+
+	// GetQ selects failures and last_failure for a key.
+	GetQ string
+
+	// AddQ inserts a new entry or increments the failures of the existing
+	// entry (or sets it to 1 if the last failure was before resetBefore).
+	// The arguments are the key, now and resetBefore.
+	AddQ string
+
+	// ResetQ deletes the entry for a key.
+	ResetQ string
+
+	// TimeFromScanType is used to parse last_failure.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLAttemptQueries returns the queries for MySQL, tableName defaults to
+// "login_attempts".
+//
+// New in version v0.6
+func MySQLAttemptQueries(tableName string) *SQLAttemptQueries {
+	if tableName == "" {
+		tableName = "login_attempts"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		attempt_key VARCHAR(255) NOT NULL,
+		failures INT NOT NULL,
+		last_failure DATETIME NOT NULL,
+		PRIMARY KEY (attempt_key)
+	);`
+	return &SQLAttemptQueries{
+		InitQ: fmt.Sprintf(initQ, tableName),
+		GetQ:  fmt.Sprintf("SELECT failures, last_failure FROM %s WHERE attempt_key = ?;", tableName),
+		AddQ: fmt.Sprintf(`INSERT INTO %s (attempt_key, failures, last_failure) VALUES (?, 1, ?)
+		ON DUPLICATE KEY UPDATE failures = IF(last_failure < ?, 1, failures + 1), last_failure = VALUES(last_failure);`, tableName),
+		ResetQ:           fmt.Sprintf("DELETE FROM %s WHERE attempt_key = ?;", tableName),
+		TimeFromScanType: DefaultTimeFromScanType,
+	}
+}
+
+// PostgresAttemptQueries returns the queries for postgres, tableName
+// defaults to "login_attempts".
+//
+// New in version v0.6
+func PostgresAttemptQueries(tableName string) *SQLAttemptQueries {
+	if tableName == "" {
+		tableName = "login_attempts"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		attempt_key VARCHAR(255) NOT NULL PRIMARY KEY,
+		failures INT NOT NULL,
+		last_failure TIMESTAMP NOT NULL
+	);`
+	return &SQLAttemptQueries{
+		InitQ: fmt.Sprintf(initQ, tableName),
+		GetQ:  fmt.Sprintf("SELECT failures, last_failure FROM %s WHERE attempt_key = $1;", tableName),
+		AddQ: fmt.Sprintf(`INSERT INTO %[1]s (attempt_key, failures, last_failure) VALUES ($1, 1, $2)
+		ON CONFLICT (attempt_key) DO UPDATE SET
+		failures = CASE WHEN %[1]s.last_failure < $3 THEN 1 ELSE %[1]s.failures + 1 END,
+		last_failure = EXCLUDED.last_failure;`, tableName),
+		ResetQ:           fmt.Sprintf("DELETE FROM %s WHERE attempt_key = $1;", tableName),
+		TimeFromScanType: DefaultTimeFromScanType,
+	}
+}
+
+// SQLite3AttemptQueries returns the queries for sqlite3 (requires sqlite
+// version 3.24 or newer), tableName defaults to "login_attempts".
+//
+// New in version v0.6
+func SQLite3AttemptQueries(tableName string) *SQLAttemptQueries {
+	if tableName == "" {
+		tableName = "login_attempts"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		attempt_key VARCHAR(255) NOT NULL PRIMARY KEY,
+		failures INT NOT NULL,
+		last_failure DATETIME NOT NULL
+	);`
+	return &SQLAttemptQueries{
+		InitQ: fmt.Sprintf(initQ, tableName),
+		GetQ:  fmt.Sprintf("SELECT failures, last_failure FROM %s WHERE attempt_key = ?;", tableName),
+		AddQ: fmt.Sprintf(`INSERT INTO %[1]s (attempt_key, failures, last_failure) VALUES (?1, 1, ?2)
+		ON CONFLICT (attempt_key) DO UPDATE SET
+		failures = CASE WHEN %[1]s.last_failure < ?3 THEN 1 ELSE %[1]s.failures + 1 END,
+		last_failure = excluded.last_failure;`, tableName),
+		ResetQ:           fmt.Sprintf("DELETE FROM %s WHERE attempt_key = ?;", tableName),
+		TimeFromScanType: DefaultTimeFromScanType,
+	}
+}
+
+// SQLAttemptStore is an AttemptStore that uses a SQL table, Init creates
+// the table.
+//
+// New in version v0.6
+type SQLAttemptStore struct {
+	*SQLAttemptQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	// required for example for sqlite
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLAttemptStore returns a new store, for blockDB see NewSQLUserHandler.
+//
+// New in version v0.6
+func NewSQLAttemptStore(queries *SQLAttemptQueries, db *sql.DB, blockDB bool) *SQLAttemptStore {
+	return &SQLAttemptStore{SQLAttemptQueries: queries, DB: db, blockDB: blockDB}
+}
+
+func (s *SQLAttemptStore) Init() error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.Exec(s.InitQ)
+	return err
+}
+
+func (s *SQLAttemptStore) GetAttempts(ctx context.Context, key string) (*AttemptInfo, error) {
+	if s.blockDB {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+	}
+	return s.get(ctx, key)
+}
+
+// get does the actual work of GetAttempts without locking.
+func (s *SQLAttemptStore) get(ctx context.Context, key string) (*AttemptInfo, error) {
+	var failures int
+	var lastFailureVal interface{}
+	if err := s.DB.QueryRowContext(ctx, s.GetQ, key).Scan(&failures, &lastFailureVal); err != nil {
+		if err == sql.ErrNoRows {
+			return &AttemptInfo{}, nil
+		}
+		return nil, err
+	}
+	lastFailure, err := s.TimeFromScanType(lastFailureVal)
+	if err != nil {
+		return nil, err
+	}
+	return &AttemptInfo{Failures: failures, LastFailure: lastFailure}, nil
+}
+
+func (s *SQLAttemptStore) AddFailure(ctx context.Context, key string, now, resetBefore time.Time) (*AttemptInfo, error) {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	if _, err := s.DB.ExecContext(ctx, s.AddQ, key, now, resetBefore); err != nil {
+		return nil, err
+	}
+	return s.get(ctx, key)
+}
+
+func (s *SQLAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.ExecContext(ctx, s.ResetQ, key)
+	return err
+}
+
+// RedisAttemptStore is an AttemptStore that uses redis. The attempts for a key
+// are stored in a hash "<Prefix><key>" with the fields "failures" and
+// "last_failure", the hash expires after ResetAfter of the throttler.
+//
+// New in version v0.6
+type RedisAttemptStore struct {
+	Client *redis.Client
+
+	// Prefix defaults to "loginattempts:" in NewRedisAttemptStore.
+	Prefix string
+}
+
+// NewRedisAttemptStore returns a new store.
+//
+// New in version v0.6
+func NewRedisAttemptStore(client *redis.Client) *RedisAttemptStore {
+	return &RedisAttemptStore{Client: client, Prefix: "loginattempts:"}
+}
+
+// Init is a NOOP for redis.
+func (s *RedisAttemptStore) Init() error {
+	return nil
+}
+
+func (s *RedisAttemptStore) GetAttempts(ctx context.Context, key string) (*AttemptInfo, error) {
+	client := s.Client.WithContext(ctx)
+	values, err := client.HMGet(s.Prefix+key, "failures", "last_failure").Result()
+	if err != nil {
+		return nil, err
+	}
+	return redisAttemptInfo(values)
+}
+
+// redisAttemptInfo parses the result of HMGET.
+func redisAttemptInfo(values []interface{}) (*AttemptInfo, error) {
+	failuresStr, ok1 := values[0].(string)
+	lastStr, ok2 := values[1].(string)
+	if !ok1 || !ok2 {
+		return &AttemptInfo{}, nil
+	}
+	failures, err := strconv.Atoi(failuresStr)
+	if err != nil {
+		return nil, err
+	}
+	lastFailure, err := time.Parse(RedisDateFormat, lastStr)
+	if err != nil {
+		return nil, err
+	}
+	return &AttemptInfo{Failures: failures, LastFailure: lastFailure}, nil
+}
+
+// redisAddFailureScript increments the failures, KEYS[1] is the hash, ARGV is
+// now, resetBefore (both in the format RedisDateFormat) and the expiration
+// in milliseconds (0 means no expiration).
+var redisAddFailureScript = redis.NewScript(`
+local last = redis.call('HGET', KEYS[1], 'last_failure')
+if last and last < ARGV[2] then
+	redis.call('HSET', KEYS[1], 'failures', 0)
+end
+redis.call('HINCRBY', KEYS[1], 'failures', 1)
+redis.call('HSET', KEYS[1], 'last_failure', ARGV[1])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return redis.call('HMGET', KEYS[1], 'failures', 'last_failure')
+`)
+
+func (s *RedisAttemptStore) AddFailure(ctx context.Context, key string, now, resetBefore time.Time) (*AttemptInfo, error) {
+	client := s.Client.WithContext(ctx)
+	var expire int64
+	if !resetBefore.IsZero() {
+		expire = int64(now.Sub(resetBefore) / time.Millisecond)
+	}
+	res, err := redisAddFailureScript.Run(client, []string{s.Prefix + key},
+		now.Format(RedisDateFormat), resetBefore.Format(RedisDateFormat), expire).Result()
+	if err != nil {
+		return nil, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, errors.New("Weird type in redis, should not happen")
+	}
+	return redisAttemptInfo(values)
+}
+
+func (s *RedisAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	return s.Client.WithContext(ctx).Del(s.Prefix + key).Err()
+}
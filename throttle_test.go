@@ -0,0 +1,135 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// throttleErr returns the Err of a *ThrottleError and err otherwise.
+func throttleErr(err error) error {
+	if tErr, ok := err.(*ThrottleError); ok {
+		return tErr.Err
+	}
+	return err
+}
+
+func TestLoginThrottlerUserWait(t *testing.T) {
+	now := CurrentTime()
+	throttler := NewLoginThrottler(nil)
+	throttler.MaxDelay = 10 * time.Second
+	tests := []struct {
+		name        string
+		failures    int
+		lastFailure time.Duration
+		err         error
+		retryAfter  time.Duration
+	}{
+		{name: "no failures"},
+		{name: "free attempts", failures: 2},
+		{name: "first delay", failures: 3, err: ErrTooManyAttempts, retryAfter: time.Second},
+		{name: "first delay over", failures: 3, lastFailure: -time.Second},
+		{name: "doubling", failures: 5, err: ErrTooManyAttempts, retryAfter: 4 * time.Second},
+		{name: "doubling partly waited", failures: 5, lastFailure: -3 * time.Second,
+			err: ErrTooManyAttempts, retryAfter: time.Second},
+		{name: "max delay", failures: 7, err: ErrTooManyAttempts, retryAfter: 10 * time.Second},
+		{name: "max delay partly waited", failures: 9, lastFailure: -4 * time.Second,
+			err: ErrTooManyAttempts, retryAfter: 6 * time.Second},
+		{name: "lockout", failures: 10, err: ErrAccountLocked, retryAfter: 15 * time.Minute},
+		{name: "lockout partly waited", failures: 12, lastFailure: -10 * time.Minute,
+			err: ErrAccountLocked, retryAfter: 5 * time.Minute},
+		{name: "lockout over", failures: 10, lastFailure: -15 * time.Minute},
+	}
+	for _, tc := range tests {
+		err := throttler.userWait(&AttemptInfo{Failures: tc.failures, LastFailure: now.Add(tc.lastFailure)}, now)
+		if throttleErr(err) != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if err != nil && err.(*ThrottleError).RetryAfter != tc.retryAfter {
+			t.Errorf("%s: expected RetryAfter %v, got %v", tc.name, tc.retryAfter, err.(*ThrottleError).RetryAfter)
+		}
+	}
+}
+
+func TestLoginThrottlerAttempt(t *testing.T) {
+	now := CurrentTime()
+	tests := []struct {
+		name                 string
+		failures, ipFailures int
+		lastFailure, lastIP  time.Duration
+		err                  error
+		// expected failures of the user after the attempt
+		expFailures int
+	}{
+		{name: "first attempt", expFailures: 1},
+		{name: "free attempts", failures: 2, lastFailure: -time.Second, expFailures: 3},
+		{name: "delay", failures: 3, err: ErrTooManyAttempts, expFailures: 3},
+		{name: "delay over", failures: 3, lastFailure: -2 * time.Second, expFailures: 4},
+		{name: "lockout", failures: 10, lastFailure: -time.Minute, err: ErrAccountLocked, expFailures: 10},
+		{name: "reset after ResetAfter", failures: 10, lastFailure: -25 * time.Hour, expFailures: 1},
+		{name: "ip limit", ipFailures: 100, lastIP: -time.Minute, err: ErrTooManyAttempts},
+		{name: "below ip limit", ipFailures: 99, lastIP: -time.Minute, expFailures: 1},
+		{name: "ip lockout over", ipFailures: 100, lastIP: -16 * time.Minute, expFailures: 1},
+		{name: "ip reset after ResetAfter", ipFailures: 100, lastIP: -25 * time.Hour, expFailures: 1},
+	}
+	ctx := context.Background()
+	for _, tc := range tests {
+		store := NewInMemoryAttemptStore()
+		throttler := NewLoginThrottler(store)
+		if tc.failures > 0 {
+			store.attempts[userKey("alice")] = AttemptInfo{Failures: tc.failures, LastFailure: now.Add(tc.lastFailure)}
+		}
+		if tc.ipFailures > 0 {
+			store.attempts[ipKey("127.0.0.1")] = AttemptInfo{Failures: tc.ipFailures, LastFailure: now.Add(tc.lastIP)}
+		}
+		err := throttler.Attempt(ctx, "alice", "127.0.0.1")
+		if throttleErr(err) != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+		// the attempt is registered as a failure if it is allowed
+		if info := store.attempts[userKey("alice")]; info.Failures != tc.expFailures {
+			t.Errorf("%s: expected %d failures, got %d", tc.name, tc.expFailures, info.Failures)
+		}
+	}
+	// Success removes the failure, AddressFailure counts for the address
+	store := NewInMemoryAttemptStore()
+	throttler := NewLoginThrottler(store)
+	if err := throttler.Attempt(ctx, "alice", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := throttler.Success(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if info := store.attempts[userKey("alice")]; info.Failures != 0 {
+		t.Errorf("expected no failures after Success, got %d", info.Failures)
+	}
+	if err := throttler.AddressFailure(ctx, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if info := store.attempts[ipKey("127.0.0.1")]; info.Failures != 1 {
+		t.Errorf("expected one failure of the address, got %d", info.Failures)
+	}
+}
@@ -0,0 +1,605 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrInvalidToken is returned if a one-time token doesn't exist, was
+// already used or is expired.
+//
+// New in version v0.6
+var ErrInvalidToken = errors.New("The token is invalid or expired.")
+
+// DefaultTokenBytes is the number of random bytes of a one-time token.
+//
+// New in version v0.6
+const DefaultTokenBytes = 32
+
+// NewOneTimeToken returns a new random token of n bytes (DefaultTokenBytes if
+// n <= 0) encoded with URL safe base64, so it can be used in links.
+//
+// New in version v0.6
+func NewOneTimeToken(n int) (string, error) {
+	if n <= 0 {
+		n = DefaultTokenBytes
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hash of a token that is stored in a TokenStore
+// (hex encoded SHA-256). Tokens are random, so there is no need for a salt
+// or a slow hash function.
+//
+// New in version v0.6
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenURL adds the token as query parameter "token" to the URL.
+func tokenURL(rawURL, token string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// TokenData is the information stored for a one-time token: The user it
+// was created for, the time it expires and optional data (for example an
+// email address).
+//
+// New in version v0.6
+type TokenData struct {
+	UserID     uint64
+	ValidUntil time.Time
+	Data       string
+}
+
+// TokenStore stores one-time tokens (for example password reset tokens) by
+// their hash, see HashToken. The token itself is never stored.
+// There are implementations that store the tokens in memory, in a SQL table
+// and in redis (with a TTL).
+// Use a different store (table or prefix) for each kind of token.
+//
+// New in version v0.6
+type TokenStore interface {
+	// Init initializes the storage, for example creates a table.
+	Init() error
+
+	// InsertToken stores the data for the hash.
+	InsertToken(ctx context.Context, hash string, data *TokenData) error
+
+	// GetToken returns the data for the hash or ErrInvalidToken if it
+	// doesn't exist. It doesn't check if the token is expired.
+	GetToken(ctx context.Context, hash string) (*TokenData, error)
+
+	// ConsumeToken returns the data for the hash and removes it, this must
+	// happen atomically: If two requests consume the same token only one
+	// of them gets the data, the other one gets ErrInvalidToken. It doesn't
+	// check if the token is expired.
+	ConsumeToken(ctx context.Context, hash string) (*TokenData, error)
+
+	// DeleteTokensForUser removes all tokens of the user.
+	DeleteTokensForUser(ctx context.Context, userID uint64) error
+
+	// ReplaceTokensForUser removes all tokens of the user data.UserID and
+	// stores the data for the hash, this must happen atomically: If two
+	// requests replace the tokens of the same user only one of the new
+	// tokens is stored afterwards (or one of the requests fails).
+	ReplaceTokensForUser(ctx context.Context, hash string, data *TokenData) error
+
+	// DeleteExpiredTokens removes all tokens that expired before now and
+	// returns the number of removed tokens (if supported, otherwise -1).
+	DeleteExpiredTokens(ctx context.Context, now time.Time) (int64, error)
+}
+
+// InMemoryTokenStore is a TokenStore that keeps the tokens in memory.
+// Expired tokens are only removed by DeleteExpiredTokens.
+//
+// New in version v0.6
+type InMemoryTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]TokenData
+}
+
+// NewInMemoryTokenStore returns a new empty store.
+//
+// New in version v0.6
+func NewInMemoryTokenStore() *InMemoryTokenStore {
+	return &InMemoryTokenStore{tokens: make(map[string]TokenData)}
+}
+
+// Init does nothing.
+func (s *InMemoryTokenStore) Init() error {
+	return nil
+}
+
+func (s *InMemoryTokenStore) InsertToken(ctx context.Context, hash string, data *TokenData) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[hash] = *data
+	return nil
+}
+
+func (s *InMemoryTokenStore) GetToken(ctx context.Context, hash string) (*TokenData, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, has := s.tokens[hash]
+	if !has {
+		return nil, ErrInvalidToken
+	}
+	return &data, nil
+}
+
+func (s *InMemoryTokenStore) ConsumeToken(ctx context.Context, hash string) (*TokenData, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, has := s.tokens[hash]
+	if !has {
+		return nil, ErrInvalidToken
+	}
+	delete(s.tokens, hash)
+	return &data, nil
+}
+
+func (s *InMemoryTokenStore) DeleteTokensForUser(ctx context.Context, userID uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for hash, data := range s.tokens {
+		if data.UserID == userID {
+			delete(s.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryTokenStore) ReplaceTokensForUser(ctx context.Context, hash string, data *TokenData) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for otherHash, otherData := range s.tokens {
+		if otherData.UserID == data.UserID {
+			delete(s.tokens, otherHash)
+		}
+	}
+	s.tokens[hash] = *data
+	return nil
+}
+
+func (s *InMemoryTokenStore) DeleteExpiredTokens(ctx context.Context, now time.Time) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var num int64
+	for hash, data := range s.tokens {
+		if KeyInvalid(now, data.ValidUntil) {
+			delete(s.tokens, hash)
+			num++
+		}
+	}
+	return num, nil
+}
+
+// SQLTokenQueries are the queries used by SQLTokenStore.
+// The table has the columns token_hash, user_id, valid_until and data.
+//
+// New in version v0.6
+type SQLTokenQueries struct {
+	// InitQ creates the table.
+	InitQ string
+
+	// InsertQ inserts a token, the arguments are the hash, the user id, the
+	// time the token expires and the data.
+	InsertQ string
+
+	// GetQ selects user_id, valid_until and data for a hash.
+	GetQ string
+
+	// DeleteQ deletes the token with the given hash.
+	DeleteQ string
+
+	// DeleteForUserQ deletes all tokens of a user id.
+	DeleteForUserQ string
+
+	// DeleteExpiredQ deletes all tokens with valid_until before the argument.
+	DeleteExpiredQ string
+
+	// TimeFromScanType is used to parse valid_until.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLTokenQueries returns the queries for MySQL, the table name is
+// required (for example "password_resets").
+//
+// New in version v0.6
+func MySQLTokenQueries(tableName string) *SQLTokenQueries {
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		token_hash CHAR(64) NOT NULL,
+		user_id BIGINT UNSIGNED NOT NULL,
+		valid_until DATETIME NOT NULL,
+		data VARCHAR(255) NOT NULL,
+		PRIMARY KEY (token_hash),
+		INDEX (user_id)
+	);`
+	return &SQLTokenQueries{
+		InitQ:            fmt.Sprintf(initQ, tableName),
+		InsertQ:          fmt.Sprintf("INSERT INTO %s (token_hash, user_id, valid_until, data) VALUES (?, ?, ?, ?);", tableName),
+		GetQ:             fmt.Sprintf("SELECT user_id, valid_until, data FROM %s WHERE token_hash = ?;", tableName),
+		DeleteQ:          fmt.Sprintf("DELETE FROM %s WHERE token_hash = ?;", tableName),
+		DeleteForUserQ:   fmt.Sprintf("DELETE FROM %s WHERE user_id = ?;", tableName),
+		DeleteExpiredQ:   fmt.Sprintf("DELETE FROM %s WHERE valid_until < ?;", tableName),
+		TimeFromScanType: DefaultTimeFromScanType,
+	}
+}
+
+// PostgresTokenQueries returns the queries for postgres, the table name is
+// required (for example "password_resets").
+//
+// New in version v0.6
+func PostgresTokenQueries(tableName string) *SQLTokenQueries {
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		token_hash CHAR(64) NOT NULL PRIMARY KEY,
+		user_id BIGINT NOT NULL,
+		valid_until TIMESTAMP NOT NULL,
+		data VARCHAR(255) NOT NULL
+	);`
+	return &SQLTokenQueries{
+		InitQ:            fmt.Sprintf(initQ, tableName),
+		InsertQ:          fmt.Sprintf("INSERT INTO %s (token_hash, user_id, valid_until, data) VALUES ($1, $2, $3, $4);", tableName),
+		GetQ:             fmt.Sprintf("SELECT user_id, valid_until, data FROM %s WHERE token_hash = $1;", tableName),
+		DeleteQ:          fmt.Sprintf("DELETE FROM %s WHERE token_hash = $1;", tableName),
+		DeleteForUserQ:   fmt.Sprintf("DELETE FROM %s WHERE user_id = $1;", tableName),
+		DeleteExpiredQ:   fmt.Sprintf("DELETE FROM %s WHERE valid_until < $1;", tableName),
+		TimeFromScanType: DefaultTimeFromScanType,
+	}
+}
+
+// SQLite3TokenQueries returns the queries for sqlite3, the table name is
+// required (for example "password_resets").
+//
+// New in version v0.6
+func SQLite3TokenQueries(tableName string) *SQLTokenQueries {
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		token_hash CHAR(64) NOT NULL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		valid_until DATETIME NOT NULL,
+		data VARCHAR(255) NOT NULL
+	);`
+	res := MySQLTokenQueries(tableName)
+	res.InitQ = fmt.Sprintf(initQ, tableName)
+	return res
+}
+
+// SQLTokenStore is a TokenStore that uses a SQL table, Init creates the
+// table. Expired tokens are only removed by DeleteExpiredTokens.
+//
+// New in version v0.6
+type SQLTokenStore struct {
+	*SQLTokenQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	// required for example for sqlite
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLTokenStore returns a new store, for blockDB see NewSQLUserHandler.
+//
+// New in version v0.6
+func NewSQLTokenStore(queries *SQLTokenQueries, db *sql.DB, blockDB bool) *SQLTokenStore {
+	return &SQLTokenStore{SQLTokenQueries: queries, DB: db, blockDB: blockDB}
+}
+
+func (s *SQLTokenStore) Init() error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.Exec(s.InitQ)
+	return err
+}
+
+func (s *SQLTokenStore) InsertToken(ctx context.Context, hash string, data *TokenData) error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.ExecContext(ctx, s.InsertQ, hash, data.UserID, data.ValidUntil, data.Data)
+	return err
+}
+
+func (s *SQLTokenStore) GetToken(ctx context.Context, hash string) (*TokenData, error) {
+	if s.blockDB {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+	}
+	return s.get(ctx, hash)
+}
+
+// get does the actual work of GetToken without locking.
+func (s *SQLTokenStore) get(ctx context.Context, hash string) (*TokenData, error) {
+	var data TokenData
+	var validUntilVal interface{}
+	if err := s.DB.QueryRowContext(ctx, s.GetQ, hash).Scan(&data.UserID, &validUntilVal, &data.Data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	validUntil, err := s.TimeFromScanType(validUntilVal)
+	if err != nil {
+		return nil, err
+	}
+	data.ValidUntil = validUntil
+	return &data, nil
+}
+
+// ConsumeToken reads the token and deletes it. Only the request that
+// actually deleted the row gets the data.
+func (s *SQLTokenStore) ConsumeToken(ctx context.Context, hash string) (*TokenData, error) {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	data, err := s.get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.DB.ExecContext(ctx, s.DeleteQ, hash)
+	if err != nil {
+		return nil, err
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if num == 0 {
+		return nil, ErrInvalidToken
+	}
+	return data, nil
+}
+
+func (s *SQLTokenStore) DeleteTokensForUser(ctx context.Context, userID uint64) error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.ExecContext(ctx, s.DeleteForUserQ, userID)
+	return err
+}
+
+// ReplaceTokensForUser deletes the tokens of the user and inserts the new
+// one in a single transaction with isolation level serializable, like
+// SQLSessionHandler.InsertEntryLimited. Thus if new tokens for the same user
+// are created concurrently one of the transactions may fail and the error
+// of the driver is returned.
+func (s *SQLTokenStore) ReplaceTokensForUser(ctx context.Context, hash string, data *TokenData) error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.DeleteForUserQ, data.UserID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.InsertQ, hash, data.UserID, data.ValidUntil, data.Data); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLTokenStore) DeleteExpiredTokens(ctx context.Context, now time.Time) (int64, error) {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	res, err := s.DB.ExecContext(ctx, s.DeleteExpiredQ, now)
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
+// RedisTokenStore is a TokenStore that uses redis. A token is stored in the
+// hash "<Prefix><token hash>" with the fields "user", "valid_until" and
+// "data", it expires when the token expires. The hashes of the tokens of a
+// user are stored in the set "<Prefix>user:<user id>".
+//
+// New in version v0.6
+type RedisTokenStore struct {
+	Client *redis.Client
+	Prefix string
+}
+
+// NewRedisTokenStore returns a new store, the prefix is required (for
+// example "passwordreset:").
+//
+// New in version v0.6
+func NewRedisTokenStore(client *redis.Client, prefix string) *RedisTokenStore {
+	return &RedisTokenStore{Client: client, Prefix: prefix}
+}
+
+// Init is a NOOP for redis.
+func (s *RedisTokenStore) Init() error {
+	return nil
+}
+
+// userKey returns the key of the set of tokens of a user.
+func (s *RedisTokenStore) userKey(userID uint64) string {
+	return s.Prefix + "user:" + strconv.FormatUint(userID, 10)
+}
+
+func (s *RedisTokenStore) InsertToken(ctx context.Context, hash string, data *TokenData) error {
+	validDuration := data.ValidUntil.Sub(CurrentTime())
+	if validDuration <= 0 {
+		return nil
+	}
+	pipe := s.Client.WithContext(ctx).TxPipeline()
+	key, userKey := s.Prefix+hash, s.userKey(data.UserID)
+	pipe.HMSet(key, map[string]interface{}{
+		"user":        data.UserID,
+		"valid_until": data.ValidUntil.Format(RedisDateFormat),
+		"data":        data.Data,
+	})
+	pipe.Expire(key, validDuration)
+	pipe.SAdd(userKey, hash)
+	pipe.Expire(userKey, validDuration)
+	_, err := pipe.Exec()
+	return err
+}
+
+// redisTokenData parses the result of HMGET user, valid_until, data.
+func redisTokenData(values []interface{}) (*TokenData, error) {
+	userStr, ok1 := values[0].(string)
+	validStr, ok2 := values[1].(string)
+	dataStr, ok3 := values[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, ErrInvalidToken
+	}
+	userID, err := strconv.ParseUint(userStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	validUntil, err := time.Parse(RedisDateFormat, validStr)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenData{UserID: userID, ValidUntil: validUntil, Data: dataStr}, nil
+}
+
+func (s *RedisTokenStore) GetToken(ctx context.Context, hash string) (*TokenData, error) {
+	values, err := s.Client.WithContext(ctx).HMGet(s.Prefix+hash, "user", "valid_until", "data").Result()
+	if err != nil {
+		return nil, err
+	}
+	return redisTokenData(values)
+}
+
+// redisConsumeTokenScript returns the fields user, valid_until and data of
+// the hash KEYS[1] and deletes it. ARGV is the prefix and the token hash,
+// the token hash is removed from the set of the user.
+var redisConsumeTokenScript = redis.NewScript(`
+local values = redis.call('HMGET', KEYS[1], 'user', 'valid_until', 'data')
+if not values[1] then
+	return values
+end
+redis.call('DEL', KEYS[1])
+redis.call('SREM', ARGV[1] .. 'user:' .. values[1], ARGV[2])
+return values
+`)
+
+// ConsumeToken is ConsumeToken of TokenStore. The token is read and deleted
+// in a lua script. Note that the set of the user is not passed as KEYS to
+// the script, so this doesn't work with redis cluster.
+func (s *RedisTokenStore) ConsumeToken(ctx context.Context, hash string) (*TokenData, error) {
+	res, err := redisConsumeTokenScript.Run(s.Client.WithContext(ctx), []string{s.Prefix + hash}, s.Prefix, hash).Result()
+	if err != nil {
+		return nil, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 3 {
+		return nil, errors.New("Weird type in redis, should not happen")
+	}
+	return redisTokenData(values)
+}
+
+func (s *RedisTokenStore) DeleteTokensForUser(ctx context.Context, userID uint64) error {
+	client := s.Client.WithContext(ctx)
+	userKey := s.userKey(userID)
+	hashes, err := client.SMembers(userKey).Result()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(hashes)+1)
+	for _, hash := range hashes {
+		keys = append(keys, s.Prefix+hash)
+	}
+	keys = append(keys, userKey)
+	return client.Del(keys...).Err()
+}
+
+// redisReplaceTokensScript deletes all tokens in the set of the user
+// KEYS[1] and stores the new token KEYS[2]. ARGV is: the prefix, the token
+// hash, the expiration in milliseconds and then the field / value pairs of
+// the new token.
+var redisReplaceTokensScript = redis.NewScript(`
+for _, hash in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	redis.call('DEL', ARGV[1] .. hash)
+end
+redis.call('DEL', KEYS[1])
+redis.call('HMSET', KEYS[2], unpack(ARGV, 4))
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+redis.call('SADD', KEYS[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// ReplaceTokensForUser is ReplaceTokensForUser of TokenStore. The tokens
+// are replaced in a lua script. Note that the keys of the old tokens are not
+// passed as KEYS to the script, so this doesn't work with redis cluster.
+// Like InsertToken it doesn't store tokens that are already expired (but it
+// removes the old tokens).
+func (s *RedisTokenStore) ReplaceTokensForUser(ctx context.Context, hash string, data *TokenData) error {
+	validDuration := data.ValidUntil.Sub(CurrentTime())
+	if validDuration < time.Millisecond {
+		return s.DeleteTokensForUser(ctx, data.UserID)
+	}
+	keys := []string{s.userKey(data.UserID), s.Prefix + hash}
+	return redisReplaceTokensScript.Run(s.Client.WithContext(ctx), keys, s.Prefix, hash,
+		int64(validDuration/time.Millisecond), "user", data.UserID,
+		"valid_until", data.ValidUntil.Format(RedisDateFormat), "data", data.Data).Err()
+}
+
+// DeleteExpiredTokens does nothing, redis removes expired tokens. It
+// returns -1.
+func (s *RedisTokenStore) DeleteExpiredTokens(ctx context.Context, now time.Time) (int64, error) {
+	return -1, nil
+}
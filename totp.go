@@ -0,0 +1,825 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrTOTPNotEnrolled is returned if TOTP is not enabled for a user (or the
+// enrolment was not confirmed yet).
+//
+// New in version v0.6
+var ErrTOTPNotEnrolled = errors.New("TOTP is not enabled for the user.")
+
+// ErrTOTPAlreadyEnrolled is returned by TOTPManager.Enroll and Confirm if
+// TOTP is already enabled for the user.
+//
+// New in version v0.6
+var ErrTOTPAlreadyEnrolled = errors.New("TOTP is already enabled for the user.")
+
+// ErrInvalidTOTPCode is returned if a TOTP code is wrong or was already
+// used.
+//
+// New in version v0.6
+var ErrInvalidTOTPCode = errors.New("Invalid TOTP code.")
+
+// ErrInvalidTOTPConfig is returned by the methods of TOTPManager if Digits,
+// Period or Skew are not valid, see TOTPManager.
+//
+// New in version v0.6
+var ErrInvalidTOTPConfig = errors.New("Invalid TOTP configuration.")
+
+// TOTPSecretLength is the length of the secrets generated by
+// TOTPManager.Enroll (160 bit as recommended in RFC 4226).
+//
+// New in version v0.6
+const TOTPSecretLength = 20
+
+// totpBase32 is the encoding of secrets in otpauth URIs.
+var totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// HOTPCode computes the HOTP value (RFC 4226) with HMAC-SHA1 for the
+// counter, the result has the given number of digits.
+//
+// New in version v0.6
+func HOTPCode(secret []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0xf
+	value := int64(binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff)
+	mod := int64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// SecretCipher encrypts the TOTP secrets before they are stored.
+// additionalData is authenticated but not encrypted, TOTPManager passes the
+// user id (see totpAdditionalData). This way a secret copied to the entry of
+// another user can't be decrypted.
+//
+// New in version v0.6
+type SecretCipher interface {
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// AESGCMCipher is a SecretCipher that uses AES in GCM mode, the nonce is
+// stored in front of the ciphertext and the additional data is
+// authenticated by GCM.
+//
+// New in version v0.6
+type AESGCMCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCipher returns a new cipher, the key must have length 16, 24 or
+// 32 (AES-128, AES-192 or AES-256). Keep the key outside of the database.
+//
+// New in version v0.6
+func NewAESGCMCipher(key []byte) (*AESGCMCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMCipher{aead: aead}, nil
+}
+
+func (c *AESGCMCipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (c *AESGCMCipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("Ciphertext is too short.")
+	}
+	return c.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], additionalData)
+}
+
+// TOTPEntry is the TOTP information stored for a user. Secret is the
+// encrypted secret (base64 encoded), Confirmed is true once the user
+// confirmed the enrolment with a valid code and LastCounter is the time
+// step of the last accepted code (-1 if no code was accepted yet).
+//
+// New in version v0.6
+type TOTPEntry struct {
+	Secret      string
+	Confirmed   bool
+	LastCounter int64
+}
+
+// TOTPStore stores the TOTP information for users (by user id).
+// There are implementations that store the entries in memory, in a SQL
+// table and in the redis hash of the user (see RedisUserHandler).
+//
+// New in version v0.6
+type TOTPStore interface {
+	// Init initializes the storage, for example creates a table.
+	Init() error
+
+	// GetTOTP returns the entry for the user or ErrTOTPNotEnrolled.
+	GetTOTP(ctx context.Context, userID uint64) (*TOTPEntry, error)
+
+	// SetTOTP stores a new unconfirmed entry with the secret (and
+	// LastCounter -1), an existing entry is replaced.
+	SetTOTP(ctx context.Context, userID uint64, secret string) error
+
+	// ConfirmTOTP marks the entry as confirmed and sets LastCounter.
+	ConfirmTOTP(ctx context.Context, userID uint64, counter int64) error
+
+	// UseTOTPCounter sets LastCounter of a confirmed entry to counter if it
+	// is greater than LastCounter, this must happen atomically. It returns
+	// false if the counter was not updated.
+	UseTOTPCounter(ctx context.Context, userID uint64, counter int64) (bool, error)
+
+	// DeleteTOTP removes the entry for the user (if any).
+	DeleteTOTP(ctx context.Context, userID uint64) error
+}
+
+// TOTPKey is returned by TOTPManager.Enroll: the secret and the otpauth://
+// URI that can be shown as a QR code.
+//
+// New in version v0.6
+type TOTPKey struct {
+	Secret []byte
+	URI    string
+}
+
+// Base32 returns the secret in base32 (without padding), users can enter
+// this in their app if they can't scan the QR code.
+func (key *TOTPKey) Base32() string {
+	return totpBase32.EncodeToString(key.Secret)
+}
+
+// TOTPManager implements time-based one-time passwords (RFC 6238) with
+// HMAC-SHA1, which is supported by all common authenticator apps.
+//
+// A user enrolls with Enroll, which stores a new unconfirmed secret. The
+// user adds the secret to their app and sends a code, Confirm enables TOTP
+// for the user if the code is valid. After that Verify checks the codes
+// during the login, see TOTPLoginHandler.
+//
+// Codes from Skew time steps before and after the current step are
+// accepted (clock skew between server and app). Each code can only be used
+// once: A code is only accepted if its time step is greater than the time
+// step of the last accepted code.
+//
+// Secrets are encrypted with Cipher before they're stored.
+//
+// New in version v0.6
+type TOTPManager struct {
+	Store  TOTPStore
+	Cipher SecretCipher
+
+	// Issuer is the name of your service shown in the app.
+	Issuer string
+
+	// Digits is the length of the codes (6 to 10), Period the duration of
+	// a time step (whole seconds, at least one second).
+	Digits int
+	Period time.Duration
+
+	// Skew is the number of time steps before and after the current step
+	// that are accepted (>= 0).
+	Skew int
+}
+
+// NewTOTPManager returns a new manager with the defaults used by most apps:
+// 6 digits, 30 seconds and a skew of one time step.
+//
+// New in version v0.6
+func NewTOTPManager(store TOTPStore, c SecretCipher, issuer string) *TOTPManager {
+	return &TOTPManager{Store: store, Cipher: c, Issuer: issuer,
+		Digits: 6, Period: 30 * time.Second, Skew: 1}
+}
+
+// checkConfig returns ErrInvalidTOTPConfig if Digits, Period or Skew are
+// not valid.
+func (m *TOTPManager) checkConfig() error {
+	switch {
+	case m.Digits < 6 || m.Digits > 10:
+		return ErrInvalidTOTPConfig
+	case m.Period < time.Second || m.Period%time.Second != 0:
+		return ErrInvalidTOTPConfig
+	case m.Skew < 0:
+		return ErrInvalidTOTPConfig
+	default:
+		return nil
+	}
+}
+
+// totpAdditionalData returns the additional data for the cipher of the
+// secret of a user: the user id.
+func totpAdditionalData(userID uint64) []byte {
+	var res [8]byte
+	binary.BigEndian.PutUint64(res[:], userID)
+	return res[:]
+}
+
+// counter returns the time step for t.
+func (m *TOTPManager) counter(t time.Time) int64 {
+	return t.Unix() / int64(m.Period/time.Second)
+}
+
+// Code returns the code for the secret at time t.
+// It panics if Period is less than one second.
+func (m *TOTPManager) Code(secret []byte, t time.Time) string {
+	return HOTPCode(secret, uint64(m.counter(t)), m.Digits)
+}
+
+// URI returns the otpauth:// URI for the secret, the label shown in the app
+// is "Issuer:accountName".
+func (m *TOTPManager) URI(secret []byte, accountName string) string {
+	label := url.PathEscape(accountName)
+	if m.Issuer != "" {
+		label = url.PathEscape(m.Issuer) + ":" + label
+	}
+	values := url.Values{}
+	values.Set("secret", totpBase32.EncodeToString(secret))
+	if m.Issuer != "" {
+		values.Set("issuer", m.Issuer)
+	}
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", strconv.Itoa(m.Digits))
+	values.Set("period", strconv.FormatInt(int64(m.Period/time.Second), 10))
+	// some apps show + instead of a space
+	return "otpauth://totp/" + label + "?" + strings.Replace(values.Encode(), "+", "%20", -1)
+}
+
+// match returns the time step of code if it is valid at time now and the
+// step is greater than last.
+func (m *TOTPManager) match(secret []byte, code string, now time.Time, last int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != m.Digits {
+		return -1, false
+	}
+	current := m.counter(now)
+	for step := current - int64(m.Skew); step <= current+int64(m.Skew); step++ {
+		if step <= last || step < 0 {
+			continue
+		}
+		expected := HOTPCode(secret, uint64(step), m.Digits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return -1, false
+}
+
+// secret decrypts the secret of an entry of the user.
+func (m *TOTPManager) secret(userID uint64, entry *TOTPEntry) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(entry.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return m.Cipher.Decrypt(ciphertext, totpAdditionalData(userID))
+}
+
+// Enroll generates a new secret for the user and stores it unconfirmed,
+// an unconfirmed secret from a previous call is replaced. TOTP is not
+// enabled before the user confirmed the secret with Confirm.
+// accountName is shown in the app, usually the username or email.
+// Returns ErrTOTPAlreadyEnrolled if TOTP is already enabled, use Disable
+// first to generate a new secret.
+// Enroll, Confirm and Verify return ErrInvalidTOTPConfig if the settings of
+// the manager are not valid.
+func (m *TOTPManager) Enroll(ctx context.Context, userID uint64, accountName string) (*TOTPKey, error) {
+	if err := m.checkConfig(); err != nil {
+		return nil, err
+	}
+	entry, err := m.Store.GetTOTP(ctx, userID)
+	switch {
+	case err == nil && entry.Confirmed:
+		return nil, ErrTOTPAlreadyEnrolled
+	case err != nil && err != ErrTOTPNotEnrolled:
+		return nil, err
+	}
+	secret := make([]byte, TOTPSecretLength)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	ciphertext, err := m.Cipher.Encrypt(secret, totpAdditionalData(userID))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Store.SetTOTP(ctx, userID, base64.StdEncoding.EncodeToString(ciphertext)); err != nil {
+		return nil, err
+	}
+	return &TOTPKey{Secret: secret, URI: m.URI(secret, accountName)}, nil
+}
+
+// Confirm enables TOTP for the user if the code is valid for the secret
+// from Enroll. It returns ErrInvalidTOTPCode if the code is wrong,
+// ErrTOTPNotEnrolled if there is no secret and ErrTOTPAlreadyEnrolled if
+// TOTP is already enabled.
+func (m *TOTPManager) Confirm(ctx context.Context, userID uint64, code string) error {
+	if err := m.checkConfig(); err != nil {
+		return err
+	}
+	entry, err := m.Store.GetTOTP(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if entry.Confirmed {
+		return ErrTOTPAlreadyEnrolled
+	}
+	secret, err := m.secret(userID, entry)
+	if err != nil {
+		return err
+	}
+	counter, ok := m.match(secret, code, CurrentTime(), -1)
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+	return m.Store.ConfirmTOTP(ctx, userID, counter)
+}
+
+// Verify checks a code of a user with enabled TOTP. It returns
+// ErrInvalidTOTPCode if the code is wrong or was already used and
+// ErrTOTPNotEnrolled if TOTP is not enabled.
+func (m *TOTPManager) Verify(ctx context.Context, userID uint64, code string) error {
+	if err := m.checkConfig(); err != nil {
+		return err
+	}
+	entry, err := m.Store.GetTOTP(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !entry.Confirmed {
+		return ErrTOTPNotEnrolled
+	}
+	secret, err := m.secret(userID, entry)
+	if err != nil {
+		return err
+	}
+	counter, ok := m.match(secret, code, CurrentTime(), entry.LastCounter)
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+	// another request may have used the code in the meantime
+	used, err := m.Store.UseTOTPCounter(ctx, userID, counter)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// Enabled returns true if TOTP is enabled (and confirmed) for the user.
+func (m *TOTPManager) Enabled(ctx context.Context, userID uint64) (bool, error) {
+	entry, err := m.Store.GetTOTP(ctx, userID)
+	switch {
+	case err == ErrTOTPNotEnrolled:
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return entry.Confirmed, nil
+	}
+}
+
+// Disable disables TOTP for the user and removes the secret.
+func (m *TOTPManager) Disable(ctx context.Context, userID uint64) error {
+	return m.Store.DeleteTOTP(ctx, userID)
+}
+
+// InMemoryTOTPStore is a TOTPStore that keeps the entries in memory.
+//
+// New in version v0.6
+type InMemoryTOTPStore struct {
+	mutex   sync.Mutex
+	entries map[uint64]TOTPEntry
+}
+
+// NewInMemoryTOTPStore returns a new empty store.
+//
+// New in version v0.6
+func NewInMemoryTOTPStore() *InMemoryTOTPStore {
+	return &InMemoryTOTPStore{entries: make(map[uint64]TOTPEntry)}
+}
+
+// Init does nothing.
+func (s *InMemoryTOTPStore) Init() error {
+	return nil
+}
+
+func (s *InMemoryTOTPStore) GetTOTP(ctx context.Context, userID uint64) (*TOTPEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, has := s.entries[userID]
+	if !has {
+		return nil, ErrTOTPNotEnrolled
+	}
+	return &entry, nil
+}
+
+func (s *InMemoryTOTPStore) SetTOTP(ctx context.Context, userID uint64, secret string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[userID] = TOTPEntry{Secret: secret, LastCounter: -1}
+	return nil
+}
+
+func (s *InMemoryTOTPStore) ConfirmTOTP(ctx context.Context, userID uint64, counter int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, has := s.entries[userID]
+	if !has {
+		return ErrTOTPNotEnrolled
+	}
+	entry.Confirmed = true
+	entry.LastCounter = counter
+	s.entries[userID] = entry
+	return nil
+}
+
+func (s *InMemoryTOTPStore) UseTOTPCounter(ctx context.Context, userID uint64, counter int64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, has := s.entries[userID]
+	if !has || !entry.Confirmed || counter <= entry.LastCounter {
+		return false, nil
+	}
+	entry.LastCounter = counter
+	s.entries[userID] = entry
+	return true, nil
+}
+
+func (s *InMemoryTOTPStore) DeleteTOTP(ctx context.Context, userID uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, userID)
+	return nil
+}
+
+// SQLTOTPQueries are the queries used by SQLTOTPStore.
+// The table has the columns user_id, secret, confirmed and last_counter.
+// Note that entries are not deleted together with the user, call
+// TOTPManager.Disable when you delete a user.
+//
+// New in version v0.6
+type SQLTOTPQueries struct {
+	// InitQ creates the table.
+	InitQ string
+
+	// GetQ selects secret, confirmed and last_counter for a user id.
+	GetQ string
+
+	// SetQ inserts or replaces an entry, the arguments are the user id and
+	// the secret. confirmed must be set to false and last_counter to -1.
+	SetQ string
+
+	// ConfirmQ sets confirmed and last_counter, the arguments are true, the
+	// counter and the user id.
+	ConfirmQ string
+
+	// UseQ sets last_counter if the entry is confirmed and last_counter is
+	// smaller than the new value. The arguments are the counter, the user
+	// id, true and again the counter.
+	UseQ string
+
+	// DeleteQ deletes the entry for a user id.
+	DeleteQ string
+}
+
+// MySQLTOTPQueries returns the queries for MySQL, tableName defaults to
+// "user_totp".
+//
+// New in version v0.6
+func MySQLTOTPQueries(tableName string) *SQLTOTPQueries {
+	if tableName == "" {
+		tableName = "user_totp"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		user_id BIGINT UNSIGNED NOT NULL,
+		secret VARCHAR(255) NOT NULL,
+		confirmed BOOL NOT NULL,
+		last_counter BIGINT NOT NULL,
+		PRIMARY KEY (user_id)
+	);`
+	return &SQLTOTPQueries{
+		InitQ: fmt.Sprintf(initQ, tableName),
+		GetQ:  fmt.Sprintf("SELECT secret, confirmed, last_counter FROM %s WHERE user_id = ?;", tableName),
+		SetQ: fmt.Sprintf(`INSERT INTO %s (user_id, secret, confirmed, last_counter) VALUES (?, ?, FALSE, -1)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), confirmed = FALSE, last_counter = -1;`, tableName),
+		ConfirmQ: fmt.Sprintf("UPDATE %s SET confirmed = ?, last_counter = ? WHERE user_id = ?;", tableName),
+		UseQ:     fmt.Sprintf("UPDATE %s SET last_counter = ? WHERE user_id = ? AND confirmed = ? AND last_counter < ?;", tableName),
+		DeleteQ:  fmt.Sprintf("DELETE FROM %s WHERE user_id = ?;", tableName),
+	}
+}
+
+// PostgresTOTPQueries returns the queries for postgres, tableName defaults
+// to "user_totp".
+//
+// New in version v0.6
+func PostgresTOTPQueries(tableName string) *SQLTOTPQueries {
+	if tableName == "" {
+		tableName = "user_totp"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		user_id BIGINT NOT NULL PRIMARY KEY,
+		secret VARCHAR(255) NOT NULL,
+		confirmed BOOL NOT NULL,
+		last_counter BIGINT NOT NULL
+	);`
+	return &SQLTOTPQueries{
+		InitQ: fmt.Sprintf(initQ, tableName),
+		GetQ:  fmt.Sprintf("SELECT secret, confirmed, last_counter FROM %s WHERE user_id = $1;", tableName),
+		SetQ: fmt.Sprintf(`INSERT INTO %s (user_id, secret, confirmed, last_counter) VALUES ($1, $2, FALSE, -1)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed = FALSE, last_counter = -1;`, tableName),
+		ConfirmQ: fmt.Sprintf("UPDATE %s SET confirmed = $1, last_counter = $2 WHERE user_id = $3;", tableName),
+		UseQ:     fmt.Sprintf("UPDATE %s SET last_counter = $1 WHERE user_id = $2 AND confirmed = $3 AND last_counter < $4;", tableName),
+		DeleteQ:  fmt.Sprintf("DELETE FROM %s WHERE user_id = $1;", tableName),
+	}
+}
+
+// SQLite3TOTPQueries returns the queries for sqlite3 (requires sqlite
+// version 3.24 or newer), tableName defaults to "user_totp".
+//
+// New in version v0.6
+func SQLite3TOTPQueries(tableName string) *SQLTOTPQueries {
+	if tableName == "" {
+		tableName = "user_totp"
+	}
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		user_id INTEGER NOT NULL PRIMARY KEY,
+		secret VARCHAR(255) NOT NULL,
+		confirmed BOOL NOT NULL,
+		last_counter INTEGER NOT NULL
+	);`
+	res := MySQLTOTPQueries(tableName)
+	res.InitQ = fmt.Sprintf(initQ, tableName)
+	res.SetQ = fmt.Sprintf(`INSERT INTO %s (user_id, secret, confirmed, last_counter) VALUES (?, ?, 0, -1)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, confirmed = 0, last_counter = -1;`, tableName)
+	return res
+}
+
+// SQLTOTPStore is a TOTPStore that uses a SQL table, Init creates the
+// table.
+//
+// New in version v0.6
+type SQLTOTPStore struct {
+	*SQLTOTPQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	// required for example for sqlite
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLTOTPStore returns a new store, for blockDB see NewSQLUserHandler.
+//
+// New in version v0.6
+func NewSQLTOTPStore(queries *SQLTOTPQueries, db *sql.DB, blockDB bool) *SQLTOTPStore {
+	return &SQLTOTPStore{SQLTOTPQueries: queries, DB: db, blockDB: blockDB}
+}
+
+func (s *SQLTOTPStore) Init() error {
+	_, err := s.exec(context.Background(), s.InitQ)
+	return err
+}
+
+// exec executes a query with the given arguments.
+func (s *SQLTOTPStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	return s.DB.ExecContext(ctx, query, args...)
+}
+
+func (s *SQLTOTPStore) GetTOTP(ctx context.Context, userID uint64) (*TOTPEntry, error) {
+	if s.blockDB {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+	}
+	var entry TOTPEntry
+	if err := s.DB.QueryRowContext(ctx, s.GetQ, userID).Scan(&entry.Secret, &entry.Confirmed, &entry.LastCounter); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrTOTPNotEnrolled
+		}
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *SQLTOTPStore) SetTOTP(ctx context.Context, userID uint64, secret string) error {
+	_, err := s.exec(ctx, s.SetQ, userID, secret)
+	return err
+}
+
+func (s *SQLTOTPStore) ConfirmTOTP(ctx context.Context, userID uint64, counter int64) error {
+	res, err := s.exec(ctx, s.ConfirmQ, true, counter, userID)
+	if err != nil {
+		return err
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		return ErrTOTPNotEnrolled
+	}
+	return nil
+}
+
+func (s *SQLTOTPStore) UseTOTPCounter(ctx context.Context, userID uint64, counter int64) (bool, error) {
+	res, err := s.exec(ctx, s.UseQ, counter, userID, true, counter)
+	if err != nil {
+		return false, err
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return num > 0, nil
+}
+
+func (s *SQLTOTPStore) DeleteTOTP(ctx context.Context, userID uint64) error {
+	_, err := s.exec(ctx, s.DeleteQ, userID)
+	return err
+}
+
+// RedisTOTPStore is a TOTPStore that stores the entries in the redis hash
+// of the user (see RedisUserHandler) in the fields "totp_secret",
+// "totp_confirmed" and "totp_last". This way the entry is renamed and
+// deleted together with the user.
+//
+// New in version v0.6
+type RedisTOTPStore struct {
+	Users *RedisUserHandler
+}
+
+// NewRedisTOTPStore returns a new store for the users of the handler.
+//
+// New in version v0.6
+func NewRedisTOTPStore(users *RedisUserHandler) *RedisTOTPStore {
+	return &RedisTOTPStore{Users: users}
+}
+
+// Init is a NOOP for redis.
+func (s *RedisTOTPStore) Init() error {
+	return nil
+}
+
+// userKey returns the key of the user hash, ErrTOTPNotEnrolled is returned
+// if the user doesn't exist.
+func (s *RedisTOTPStore) userKey(ctx context.Context, userID uint64) (string, error) {
+	userName, err := s.Users.GetUserNameContext(ctx, userID)
+	if err == ErrUserNotFound {
+		return "", ErrTOTPNotEnrolled
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%v", s.Users.UserPrefix, userName), nil
+}
+
+func (s *RedisTOTPStore) GetTOTP(ctx context.Context, userID uint64) (*TOTPEntry, error) {
+	key, err := s.userKey(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	values, err := s.Users.Client.WithContext(ctx).HMGet(key, "totp_secret", "totp_confirmed", "totp_last").Result()
+	if err != nil {
+		return nil, err
+	}
+	secret, ok1 := values[0].(string)
+	confirmedStr, ok2 := values[1].(string)
+	lastStr, ok3 := values[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, ErrTOTPNotEnrolled
+	}
+	last, err := strconv.ParseInt(lastStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPEntry{Secret: secret, Confirmed: confirmedStr == "1", LastCounter: last}, nil
+}
+
+// redisHMSetExistsScript sets the fields given in ARGV in the hash KEYS[1]
+// if the hash exists (for example the user was not deleted in the meantime
+// or the session did not expire). It returns 0 if the hash doesn't exist.
+var redisHMSetExistsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HMSET', KEYS[1], unpack(ARGV))
+return 1
+`)
+
+// hmsetExists runs redisHMSetExistsScript.
+func (s *RedisTOTPStore) hmsetExists(ctx context.Context, userID uint64, fields ...interface{}) error {
+	key, err := s.userKey(ctx, userID)
+	if err != nil {
+		return err
+	}
+	res, err := redisHMSetExistsScript.Run(s.Users.Client.WithContext(ctx), []string{key}, fields...).Int64()
+	if err != nil {
+		return err
+	}
+	if res == 0 {
+		return ErrTOTPNotEnrolled
+	}
+	return nil
+}
+
+func (s *RedisTOTPStore) SetTOTP(ctx context.Context, userID uint64, secret string) error {
+	return s.hmsetExists(ctx, userID, "totp_secret", secret, "totp_confirmed", "0", "totp_last", "-1")
+}
+
+func (s *RedisTOTPStore) ConfirmTOTP(ctx context.Context, userID uint64, counter int64) error {
+	return s.hmsetExists(ctx, userID, "totp_confirmed", "1", "totp_last", counter)
+}
+
+// redisUseTOTPScript sets totp_last in KEYS[1] to ARGV[1] if the entry is
+// confirmed and the counter is greater. It returns 1 if the counter was set.
+var redisUseTOTPScript = redis.NewScript(`
+local last = redis.call('HGET', KEYS[1], 'totp_last')
+if not last or redis.call('HGET', KEYS[1], 'totp_confirmed') ~= '1' then
+	return 0
+end
+if tonumber(ARGV[1]) <= tonumber(last) then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'totp_last', ARGV[1])
+return 1
+`)
+
+func (s *RedisTOTPStore) UseTOTPCounter(ctx context.Context, userID uint64, counter int64) (bool, error) {
+	key, err := s.userKey(ctx, userID)
+	if err == ErrTOTPNotEnrolled {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	res, err := redisUseTOTPScript.Run(s.Users.Client.WithContext(ctx), []string{key}, counter).Int64()
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+func (s *RedisTOTPStore) DeleteTOTP(ctx context.Context, userID uint64) error {
+	key, err := s.userKey(ctx, userID)
+	if err == ErrTOTPNotEnrolled {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.Users.Client.WithContext(ctx).HDel(key, "totp_secret", "totp_confirmed", "totp_last").Err()
+}
@@ -0,0 +1,160 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the secret of the test vectors in RFC 4226 and RFC 6238.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestHOTPCode(t *testing.T) {
+	// RFC 4226, Appendix D
+	expected := []string{"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range expected {
+		if got := HOTPCode(rfcSecret, uint64(counter), 6); got != code {
+			t.Errorf("HOTPCode for counter %d: expected %s, got %s", counter, code, got)
+		}
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238, Appendix B (SHA1)
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	m := &TOTPManager{Digits: 8, Period: 30 * time.Second}
+	for _, tc := range tests {
+		if got := m.Code(rfcSecret, time.Unix(tc.unix, 0)); got != tc.code {
+			t.Errorf("Code at %d: expected %s, got %s", tc.unix, tc.code, got)
+		}
+	}
+}
+
+func TestTOTPManagerCheckConfig(t *testing.T) {
+	tests := []struct {
+		digits int
+		period time.Duration
+		skew   int
+		valid  bool
+	}{
+		{6, 30 * time.Second, 1, true},
+		{8, time.Second, 0, true},
+		{10, time.Minute, 2, true},
+		{5, 30 * time.Second, 1, false},
+		{11, 30 * time.Second, 1, false},
+		{6, 0, 1, false},
+		{6, 500 * time.Millisecond, 1, false},
+		{6, 1500 * time.Millisecond, 1, false},
+		{6, 30 * time.Second, -1, false},
+	}
+	for _, tc := range tests {
+		m := &TOTPManager{Digits: tc.digits, Period: tc.period, Skew: tc.skew}
+		err := m.checkConfig()
+		if tc.valid && err != nil {
+			t.Errorf("digits %d, period %v, skew %d: expected valid config, got %v",
+				tc.digits, tc.period, tc.skew, err)
+		} else if !tc.valid && err != ErrInvalidTOTPConfig {
+			t.Errorf("digits %d, period %v, skew %d: expected ErrInvalidTOTPConfig, got %v",
+				tc.digits, tc.period, tc.skew, err)
+		}
+	}
+}
+
+func TestAESGCMCipher(t *testing.T) {
+	c, err := NewAESGCMCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := c.Encrypt(rfcSecret, totpAdditionalData(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := c.Decrypt(ciphertext, totpAdditionalData(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != string(rfcSecret) {
+		t.Errorf("expected %q, got %q", rfcSecret, plaintext)
+	}
+	// the secret of user 1 can't be used for user 2
+	if _, err := c.Decrypt(ciphertext, totpAdditionalData(2)); err == nil {
+		t.Error("expected an error for different additional data")
+	}
+	if _, err := c.Decrypt(ciphertext[:4], totpAdditionalData(1)); err == nil {
+		t.Error("expected an error for a short ciphertext")
+	}
+}
+
+func TestTOTPManager(t *testing.T) {
+	ctx := context.Background()
+	c, err := NewAESGCMCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewTOTPManager(NewInMemoryTOTPStore(), c, "goauth")
+	if err := m.Verify(ctx, 1, "123456"); err != ErrTOTPNotEnrolled {
+		t.Errorf("expected ErrTOTPNotEnrolled, got %v", err)
+	}
+	key, err := m.Enroll(ctx, 1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := m.Enabled(ctx, 1); enabled {
+		t.Error("TOTP is enabled before the confirmation")
+	}
+	now := CurrentTime()
+	code := m.Code(key.Secret, now)
+	if err := m.Confirm(ctx, 1, code); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := m.Enabled(ctx, 1); !enabled {
+		t.Error("TOTP is not enabled after the confirmation")
+	}
+	if _, err := m.Enroll(ctx, 1, "alice"); err != ErrTOTPAlreadyEnrolled {
+		t.Errorf("expected ErrTOTPAlreadyEnrolled, got %v", err)
+	}
+	// a code can only be used once
+	if err := m.Verify(ctx, 1, code); err != ErrInvalidTOTPCode {
+		t.Errorf("expected ErrInvalidTOTPCode for a used code, got %v", err)
+	}
+	if err := m.Verify(ctx, 1, m.Code(key.Secret, now.Add(m.Period))); err != nil {
+		t.Errorf("expected the next code to be valid, got %v", err)
+	}
+	m.Period = 0
+	if err := m.Verify(ctx, 1, code); err != ErrInvalidTOTPConfig {
+		t.Errorf("expected ErrInvalidTOTPConfig, got %v", err)
+	}
+}
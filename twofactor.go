@@ -0,0 +1,457 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// PendingSessionKey is the key to store the key of a pending session
+	// (see CreatePendingSession) in a gorilla session.
+	//
+	// New in version v0.6
+	PendingSessionKey = "pending"
+
+	// PendingLoginMethod is the LoginMethod stored in the metadata of
+	// pending sessions.
+	//
+	// New in version v0.6
+	PendingLoginMethod = "pending-second-factor"
+
+	// TOTPLoginMethod is the LoginMethod stored in the metadata of sessions
+	// created by TOTPLoginHandler.
+	//
+	// New in version v0.6
+	TOTPLoginMethod = "password+totp"
+
+	// DefaultPendingDuration is the duration a pending session is valid if
+	// no duration is given.
+	//
+	// New in version v0.6
+	DefaultPendingDuration = 5 * time.Minute
+
+	// DefaultMaxCodeFailures is the number of wrong codes after which a
+	// TOTPLoginHandler deletes the pending session.
+	//
+	// New in version v0.6
+	DefaultMaxCodeFailures = 3
+)
+
+// UserIDFromKey converts the user stored in a SessionKeyData to a user id.
+// Depending on the SessionHandler the user can be returned as uint64, int64,
+// []byte or string (for example by SQL drivers).
+//
+// New in version v0.6
+func UserIDFromKey(user UserKeyType) (uint64, error) {
+	switch v := user.(type) {
+	case uint64:
+		return v, nil
+	case int64:
+		if v >= 0 {
+			return uint64(v), nil
+		}
+	case int:
+		if v >= 0 {
+			return uint64(v), nil
+		}
+	case []byte:
+		return strconv.ParseUint(string(v), 10, 64)
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	}
+	return NoUserID, fmt.Errorf("Can't convert user %v of type %T to an id.", user, user)
+}
+
+// pendingKey returns the key of the pending session stored in the gorilla
+// session or ErrNotAuthSession.
+func pendingKey(session *sessions.Session) (string, error) {
+	keyVal, hasKey := session.Values[PendingSessionKey]
+	if !hasKey {
+		return "", ErrNotAuthSession
+	}
+	key, ok := keyVal.(string)
+	if !ok {
+		return "", errors.New("Internal lookup error. \"pending\" is present in the session but not of type string.")
+	}
+	return key, nil
+}
+
+// CreatePendingSession creates a pending session for a user that entered
+// the correct password but still has to provide a second factor (for
+// example a TOTP code).
+// The entry is stored with the SessionHandler like an auth session, but the
+// key is stored in session.Values[PendingSessionKey] and the entry has the
+// LoginMethod PendingLoginMethod, so ValidateSession and ValidateBearer
+// don't accept it. Use ValidatePendingSession and CompletePendingSession
+// after the second factor was checked.
+// validDuration should be short, DefaultPendingDuration is used if it is
+// <= 0. Pending sessions don't count for MaxSessions but they're returned
+// by ListEntriesForUser (with LoginMethod PendingLoginMethod).
+// The SessionHandler must implement SessionEntryUpdater, otherwise
+// ErrNotSupported is returned.
+//
+// Like CreateAuthSession this method will not call session.Save.
+//
+// New in version v0.6
+func (c *SessionController) CreatePendingSession(r *http.Request, store sessions.Store,
+	user UserKeyType, validDuration time.Duration) (*SessionKeyData, *sessions.Session, error) {
+	session, err := store.Get(r, c.SessionName)
+	if err != nil && (session == nil || !IsAuthError(err)) {
+		return nil, nil, err
+	}
+	if validDuration <= 0 {
+		validDuration = DefaultPendingDuration
+	}
+	handler := c.contextHandler()
+	// remove an old pending session
+	if oldKey, keyErr := pendingKey(session); keyErr == nil {
+		if delErr := handler.DeleteKeyContext(r.Context(), oldKey); delErr != nil {
+			log.WithError(delErr).Warn("goauth: Can't delete old pending session")
+		}
+	}
+	key, err := GenRandomBase64(c.NumBytes)
+	if err != nil {
+		return nil, session, err
+	}
+	data := CurrentTimeKeyData(user, validDuration)
+	data.Metadata = MetadataFromRequest(r)
+	data.Metadata.LoginMethod = PendingLoginMethod
+	if err := handler.InsertEntryContext(r.Context(), key, data); err != nil {
+		return nil, session, err
+	}
+	delete(session.Values, SessionKey)
+	session.Values[PendingSessionKey] = key
+	session.Options.MaxAge = int(validDuration / time.Second)
+	return data, session, nil
+}
+
+// ValidatePendingSession returns the data of the pending session (see
+// CreatePendingSession). The errors are the same as in ValidateSession:
+// ErrNotAuthSession if there is no pending session, ErrKeyNotFound or
+// ErrInvalidKey if it expired.
+//
+// New in version v0.6
+func (c *SessionController) ValidatePendingSession(r *http.Request, store sessions.Store) (*SessionKeyData, *sessions.Session, error) {
+	session, err := c.GetSession(r, store)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := pendingKey(session)
+	if err != nil {
+		return nil, session, err
+	}
+	data, err := c.contextHandler().GetDataContext(r.Context(), key)
+	if err != nil {
+		return nil, session, err
+	}
+	// only pending entries, not the key of an auth session
+	if data.Metadata.LoginMethod != PendingLoginMethod {
+		return nil, session, ErrInvalidKey
+	}
+	if KeyInvalid(CurrentTime(), data.ValidUntil) {
+		return nil, session, ErrInvalidKey
+	}
+	return data, session, nil
+}
+
+// CompletePendingSession turns a pending session into an auth session
+// after the second factor was checked: The pending entry is deleted and a
+// new auth session for the user of pending is created (like in
+// CreateAuthSessionWithMetadata). session and pending are the values
+// returned by ValidatePendingSession.
+//
+// Like CreateAuthSession this method will not call session.Save.
+//
+// New in version v0.6
+func (c *SessionController) CompletePendingSession(r *http.Request, session *sessions.Session,
+	pending *SessionKeyData, validDuration time.Duration, meta SessionMetadata) (*SessionKeyData, string, error) {
+	oldKey, err := pendingKey(session)
+	if err != nil {
+		return nil, "", err
+	}
+	// delete the pending session first, it must not be used again
+	if err := c.contextHandler().DeleteKeyContext(r.Context(), oldKey); err != nil {
+		return nil, "", err
+	}
+	delete(session.Values, PendingSessionKey)
+	data, key, err := c.AddKeyWithMetadata(r.Context(), pending.User, validDuration, meta)
+	if err != nil {
+		return nil, "", err
+	}
+	session.Values[SessionKey] = key
+	session.Options.MaxAge = int(data.ValidUntil.Sub(data.CreationTime) / time.Second)
+	return data, key, nil
+}
+
+// totpThrottleKey is the name used for a LoginThrottler to count failed TOTP
+// codes. It differs from the user name, so a correct password doesn't
+// reset the failures.
+func totpThrottleKey(userName string) string {
+	return "totp:" + userName
+}
+
+// TOTPLoginHandler is a http.Handler for the second step of a login with
+// TOTP (see LoginHandler.TOTP): It reads the code from a POST request (form
+// value or JSON {"code": "..."}), validates the pending session, verifies
+// the code with the TOTPManager and creates the auth session.
+//
+// If RecoveryCodes is set the user can send a recovery code instead of the
+// TOTP code (form value or JSON {"recovery_code": "..."}), the code is used
+// up by the RecoveryCodeManager.
+//
+// The responses are the same as in LoginHandler. If there is no valid
+// pending session or the code is wrong the status is 401 Unauthorized.
+// After MaxCodeFailures wrong codes the pending session is deleted.
+//
+// New in version v0.6
+type TOTPLoginHandler struct {
+	Users    UserHandler
+	Sessions *SessionController
+	Store    sessions.Store
+	TOTP     *TOTPManager
+
+	// ValidDuration is the duration the new auth session is valid.
+	ValidDuration time.Duration
+
+	// RecoveryCodes is used to check recovery codes if not nil.
+	RecoveryCodes *RecoveryCodeManager
+
+	// CodeField and RecoveryCodeField are the names of the form fields,
+	// they default to "code" and "recovery_code".
+	CodeField, RecoveryCodeField string
+
+	// SuccessURL and FailureURL are the URLs form requests are redirected to.
+	SuccessURL, FailureURL string
+
+	// Throttler is used to limit the number of wrong codes and must not be
+	// nil. The failures are counted separately from failed passwords.
+	// Without a Throttler all requests fail with 500 Internal Server Error.
+	Throttler *LoginThrottler
+
+	// MaxCodeFailures is the number of wrong codes after which the pending
+	// session is deleted, the user has to enter the password again. Defaults
+	// to DefaultMaxCodeFailures.
+	MaxCodeFailures int
+
+	// OnSuccess is called after the session was created and saved. If it is
+	// not nil it must write the response.
+	OnSuccess func(w http.ResponseWriter, r *http.Request, user *BaseUserInformation, data *SessionKeyData)
+
+	// OnFailure is called if the login failed. If it is not nil it must
+	// write the response.
+	OnFailure func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// NewTOTPLoginHandler returns a new TOTPLoginHandler with the default
+// field name.
+//
+// New in version v0.6
+func NewTOTPLoginHandler(users UserHandler, c *SessionController, store sessions.Store,
+	totp *TOTPManager, throttler *LoginThrottler, validDuration time.Duration) *TOTPLoginHandler {
+	return &TOTPLoginHandler{Users: users, Sessions: c, Store: store, TOTP: totp,
+		ValidDuration: validDuration, CodeField: "code", RecoveryCodeField: "recovery_code",
+		Throttler: throttler, MaxCodeFailures: DefaultMaxCodeFailures}
+}
+
+// errTOTPNoThrottler is logged if a TOTPLoginHandler has no Throttler.
+var errTOTPNoThrottler = errors.New("TOTPLoginHandler requires a Throttler.")
+
+// pendingThrottleKey is the key used in the AttemptStore of the Throttler to
+// count the wrong codes for a pending session. The key of the pending
+// session is hashed, so it's not stored in the AttemptStore.
+func pendingThrottleKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "pending:" + hex.EncodeToString(sum[:])
+}
+
+// codeFailure counts a wrong code for the pending session and deletes the
+// pending session after MaxCodeFailures wrong codes.
+func (h *TOTPLoginHandler) codeFailure(ctx context.Context, session *sessions.Session) error {
+	key, err := pendingKey(session)
+	if err != nil {
+		return err
+	}
+	now := CurrentTime()
+	info, err := h.Throttler.Store.AddFailure(ctx, pendingThrottleKey(key), now, h.Throttler.resetBefore(now))
+	if err != nil {
+		return err
+	}
+	maxFailures := h.MaxCodeFailures
+	if maxFailures <= 0 {
+		maxFailures = DefaultMaxCodeFailures
+	}
+	if info.Failures < maxFailures {
+		return nil
+	}
+	if err := h.Sessions.contextHandler().DeleteKeyContext(ctx, key); err != nil {
+		return err
+	}
+	delete(session.Values, PendingSessionKey)
+	return h.Throttler.Store.ResetAttempts(ctx, pendingThrottleKey(key))
+}
+
+// secondFactorCode is the code sent to a TOTPLoginHandler, either a TOTP
+// code or a recovery code.
+type secondFactorCode struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// code reads the code from the request.
+func (h *TOTPLoginHandler) code(w http.ResponseWriter, r *http.Request) (*secondFactorCode, error) {
+	if isJSONRequest(r) {
+		var code secondFactorCode
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCredentialsSize)).Decode(&code); err != nil {
+			return nil, err
+		}
+		return &code, nil
+	}
+	codeField, recoveryField := h.CodeField, h.RecoveryCodeField
+	if codeField == "" {
+		codeField = "code"
+	}
+	if recoveryField == "" {
+		recoveryField = "recovery_code"
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	return &secondFactorCode{Code: r.PostForm.Get(codeField), RecoveryCode: r.PostForm.Get(recoveryField)}, nil
+}
+
+// verify checks the TOTP or recovery code and returns the login method.
+func (h *TOTPLoginHandler) verify(r *http.Request, userID uint64, code *secondFactorCode) (string, error) {
+	if code.RecoveryCode == "" {
+		return TOTPLoginMethod, h.TOTP.Verify(r.Context(), userID, code.Code)
+	}
+	if h.RecoveryCodes == nil {
+		return "", ErrInvalidRecoveryCode
+	}
+	return RecoveryCodeLoginMethod, h.RecoveryCodes.Use(r.Context(), userID, code.RecoveryCode)
+}
+
+// login checks the pending session and the code and creates the session.
+func (h *TOTPLoginHandler) login(r *http.Request, code *secondFactorCode) (*BaseUserInformation, *SessionKeyData, *sessions.Session, error) {
+	ctx := r.Context()
+	pending, session, err := h.Sessions.ValidatePendingSession(r, h.Store)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	id, err := UserIDFromKey(pending.User)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	users := AsUserHandlerContext(h.Users)
+	userName, err := users.GetUserNameContext(ctx, id)
+	if err == ErrUserNotFound {
+		return nil, nil, nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	remoteAddr := MetadataFromRequest(r).RemoteAddr
+	if err := h.Throttler.Attempt(ctx, totpThrottleKey(userName), remoteAddr); err != nil {
+		return nil, nil, nil, err
+	}
+	method, err := h.verify(r, id, code)
+	if err != nil {
+		if err == ErrInvalidTOTPCode || err == ErrInvalidRecoveryCode {
+			if failErr := h.Throttler.AddressFailure(ctx, remoteAddr); failErr != nil {
+				return nil, nil, nil, failErr
+			}
+			if failErr := h.codeFailure(ctx, session); failErr != nil {
+				return nil, nil, nil, failErr
+			}
+		}
+		return nil, nil, nil, err
+	}
+	if err := h.Throttler.Success(ctx, totpThrottleKey(userName)); err != nil {
+		return nil, nil, nil, err
+	}
+	info, err := users.GetUserBaseInfoContext(ctx, userName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !info.IsActive {
+		return info, nil, nil, ErrUserInactive
+	}
+	meta := MetadataFromRequest(r)
+	meta.LoginMethod = method
+	data, _, err := h.Sessions.CompletePendingSession(r, session, pending, h.ValidDuration, meta)
+	if err != nil {
+		return info, nil, nil, err
+	}
+	return info, data, session, nil
+}
+
+func (h *TOTPLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	code, err := h.code(w, r)
+	if err != nil {
+		h.failure(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if h.Throttler == nil {
+		h.failure(w, r, http.StatusInternalServerError, errTOTPNoThrottler)
+		return
+	}
+	info, data, session, err := h.login(r, code)
+	if err != nil {
+		h.failure(w, r, loginErrorStatus(err), err)
+		return
+	}
+	if err := session.Save(r, w); err != nil {
+		h.failure(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if h.OnSuccess != nil {
+		h.OnSuccess(w, r, info, data)
+		return
+	}
+	writeLoginSuccess(w, r, h.SuccessURL, info, data)
+}
+
+// failure calls the failure hook or writes the default response.
+func (h *TOTPLoginHandler) failure(w http.ResponseWriter, r *http.Request, status int, err error) {
+	setRetryAfter(w, err)
+	if h.OnFailure != nil {
+		h.OnFailure(w, r, err)
+		return
+	}
+	writeLoginFailure(w, r, h.FailureURL, status, err)
+}
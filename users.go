@@ -23,14 +23,22 @@
 package goauth
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	scrypt "github.com/elithrar/simple-scrypt"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -42,7 +50,8 @@ plaintext password.
 A function PasswordHashLength that returns the length of the
 password hashes.
 There is an implementation BcryptHandler, so you don't have to write one
-on your own, but you could!
+on your own, but you could! There are also ScryptHandler and (since v0.6)
+Argon2idHandler.
 */
 type PasswordHandler interface {
 	// GenerateHash generates a hash from the given password.
@@ -58,9 +67,37 @@ type PasswordHandler interface {
 	// must return the length of the elements created with
 	// GenerateHash.
 	// For bcrypt the length is 60.
+	// Handlers that create hashes of different length should implement
+	// VariableLengthPasswordHandler, in this case this is the length of
+	// the hashes created by GenerateHash with the current configuration.
 	PasswordHashLength() int
 }
 
+// VariableLengthPasswordHandler is a PasswordHandler that creates hashes
+// that don't have a fixed length (or that is able to check such hashes).
+// MaxPasswordHashLength returns the maximal length of such a hash, this is
+// used to create variable-length columns in databases (for example
+// MySQLVarLengthUserQueries).
+//
+// New in version v0.6
+type VariableLengthPasswordHandler interface {
+	PasswordHandler
+	MaxPasswordHashLength() int
+}
+
+// MaxPasswordHashLength returns the maximal length of a hash of the handler:
+// MaxPasswordHashLength if the handler implements
+// VariableLengthPasswordHandler and PasswordHashLength otherwise.
+// A value <= 0 means that there is no maximal length.
+//
+// New in version v0.6
+func MaxPasswordHashLength(handler PasswordHandler) int {
+	if varHandler, ok := handler.(VariableLengthPasswordHandler); ok {
+		return varHandler.MaxPasswordHashLength()
+	}
+	return handler.PasswordHashLength()
+}
+
 const (
 	// DefaultCost is the default cost parameter for bcrypt.
 	DefaultCost = 13
@@ -69,6 +106,12 @@ const (
 	// This is 60 for bcrypt.
 	DefaultPWLength = 60
 
+	// DefaultMaxPWLength is the default maximal length of password hashes in
+	// variable-length columns (VARCHAR), see VariableLengthPasswordHandler.
+	//
+	// New in version v0.6
+	DefaultMaxPWLength = 255
+
 	// NoUserID is an user id that is returned if the user was
 	// not found or some error occurred.
 	NoUserID = math.MaxUint64
@@ -123,6 +166,13 @@ func (handler *BcryptHandler) PasswordHashLength() int {
 	return DefaultPWLength
 }
 
+// NeedsRehash returns true if hashedPW is not a bcrypt hash or was created
+// with a different cost.
+func (handler *BcryptHandler) NeedsRehash(hashedPW []byte) bool {
+	cost, err := bcrypt.Cost(hashedPW)
+	return err != nil || cost != handler.cost
+}
+
 // ScryptHandler is a PasswordHandler that uses scrypt.
 type ScryptHandler struct {
 	// Stores the parameters for scrypt.
@@ -173,13 +223,346 @@ func (handler *ScryptHandler) PasswordHashLength() int {
 	return nLength + rLength + pLength + saltLength + dkLength + 4
 }
 
+// NeedsRehash returns true if hashedPW is not a scrypt hash or was created
+// with different parameters.
+func (handler *ScryptHandler) NeedsRehash(hashedPW []byte) bool {
+	params, err := scrypt.Cost(hashedPW)
+	return err != nil || params != handler.Params
+}
+
+// Argon2Params are the parameters for Argon2id.
+//
+// New in version v0.6
+type Argon2Params struct {
+	// Memory is the amount of memory in KiB.
+	Memory uint32
+
+	// Iterations is the number of passes over the memory.
+	Iterations uint32
+
+	// Parallelism is the number of threads.
+	Parallelism uint8
+
+	// SaltLen and KeyLen are the length of the salt and the generated key
+	// in bytes.
+	SaltLen, KeyLen uint32
+}
+
+// DefaultArgon2Params are the default parameters for Argon2id: 64 MiB of
+// memory, 3 iterations, parallelism 2, a salt of 16 bytes and a key of 32
+// bytes.
+//
+// New in version v0.6
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Iterations: 3,
+	Parallelism: 2, SaltLen: 16, KeyLen: 32}
+
+// ErrInvalidArgon2Hash is returned if a hash is not a valid Argon2id hash in
+// the PHC string format.
+//
+// New in version v0.6
+var ErrInvalidArgon2Hash = errors.New("The hash is not a valid argon2id hash.")
+
+// ErrIncompatibleArgon2Version is returned if a hash was created with a
+// different version of Argon2.
+//
+// New in version v0.6
+var ErrIncompatibleArgon2Version = errors.New("Incompatible version of argon2.")
+
+// Argon2idHandler is a PasswordHandler that uses Argon2id.
+// The hashes are encoded in the PHC string format, for example
+// "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>" where salt and key are
+// encoded with base64 without padding.
+// The parameters are stored with the hash, so CheckPassword works for hashes
+// created with different parameters.
+//
+// New in version v0.6
+type Argon2idHandler struct {
+	// Stores the parameters for Argon2id.
+	Params Argon2Params
+}
+
+// NewArgon2idHandler returns a new Argon2idHandler that uses the defined
+// parameters. Set to nil to use DefaultArgon2Params.
+//
+// New in version v0.6
+func NewArgon2idHandler(params *Argon2Params) *Argon2idHandler {
+	if params == nil {
+		params = &DefaultArgon2Params
+	}
+	return &Argon2idHandler{Params: *params}
+}
+
+// GenerateHash generates the password hash using Argon2id.
+func (handler *Argon2idHandler) GenerateHash(password []byte) ([]byte, error) {
+	p := handler.Params
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey(password, salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLen)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+	return []byte(encoded), nil
+}
+
+// decodeArgon2idHash parses a hash in the PHC string format and returns the
+// parameters, the salt and the key.
+func decodeArgon2idHash(hashedPW []byte) (*Argon2Params, []byte, []byte, error) {
+	// the hash starts with $, so the first part is empty
+	parts := strings.Split(string(hashedPW), "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrInvalidArgon2Hash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, ErrInvalidArgon2Hash
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, ErrIncompatibleArgon2Version
+	}
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return nil, nil, nil, ErrInvalidArgon2Hash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidArgon2Hash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidArgon2Hash
+	}
+	// argon2.IDKey panics for zero iterations or parallelism and an empty
+	// key would match every password
+	if params.Memory < 1 || params.Iterations < 1 || params.Parallelism < 1 || len(salt) == 0 || len(key) == 0 {
+		return nil, nil, nil, ErrInvalidArgon2Hash
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	return &params, salt, key, nil
+}
+
+// CheckPassword checks if the plaintext password was used to create the
+// hashedPW.
+func (handler *Argon2idHandler) CheckPassword(hashedPW, password []byte) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(hashedPW)
+	if err != nil {
+		return false, err
+	}
+	otherKey := argon2.IDKey(password, salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLen)
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+// PasswordHashLength returns the length of the PHC string for the
+// parameters of the handler.
+func (handler *Argon2idHandler) PasswordHashLength() int {
+	p := handler.Params
+	// $argon2id$v=<version>$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+	return len("$argon2id$v=") + len(strconv.Itoa(argon2.Version)) +
+		len("$m=") + len(strconv.FormatUint(uint64(p.Memory), 10)) +
+		len(",t=") + len(strconv.FormatUint(uint64(p.Iterations), 10)) +
+		len(",p=") + len(strconv.FormatUint(uint64(p.Parallelism), 10)) +
+		1 + base64.RawStdEncoding.EncodedLen(int(p.SaltLen)) +
+		1 + base64.RawStdEncoding.EncodedLen(int(p.KeyLen))
+}
+
+// NeedsRehash returns true if hashedPW is not an Argon2id hash or was created
+// with different parameters.
+func (handler *Argon2idHandler) NeedsRehash(hashedPW []byte) bool {
+	params, _, _, err := decodeArgon2idHash(hashedPW)
+	return err != nil || *params != handler.Params
+}
+
+// RehashChecker is implemented by PasswordHandlers that can tell if a hash
+// should be replaced by a new one, for example because it was created with
+// an older cost parameter.
+// BcryptHandler, ScryptHandler, Argon2idHandler, MultiPasswordHandler and
+// PepperedPasswordHandler implement this interface.
+// The user handlers check this after a successful Validate and store a new
+// hash of the password if required.
+//
+// New in version v0.6
+type RehashChecker interface {
+	// NeedsRehash returns true if hashedPW should be replaced by a new hash
+	// created with GenerateHash.
+	NeedsRehash(hashedPW []byte) bool
+}
+
+// NeedsRehash returns true if the handler implements RehashChecker and
+// reports that hashedPW needs a rehash.
+//
+// New in version v0.6
+func NeedsRehash(handler PasswordHandler, hashedPW []byte) bool {
+	if checker, ok := handler.(RehashChecker); ok {
+		return checker.NeedsRehash(hashedPW)
+	}
+	return false
+}
+
+const (
+	// BcryptAlgorithm, ScryptAlgorithm and Argon2idAlgorithm are the names
+	// returned by HashAlgorithm.
+	//
+	// New in version v0.6
+	BcryptAlgorithm   = "bcrypt"
+	ScryptAlgorithm   = "scrypt"
+	Argon2idAlgorithm = "argon2id"
+)
+
+// HashAlgorithm detects the algorithm that was used to create hashedPW by
+// its prefix: bcrypt hashes start with "$2a$" (or "$2b$", "$2x$", "$2y$"),
+// scrypt hashes have the form "N$R$P$salt$key" and Argon2id hashes start
+// with "$argon2id$".
+// It returns "" if the algorithm is unknown.
+//
+// New in version v0.6
+func HashAlgorithm(hashedPW []byte) string {
+	hash := string(hashedPW)
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"),
+		strings.HasPrefix(hash, "$2x$"), strings.HasPrefix(hash, "$2y$"):
+		return BcryptAlgorithm
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2idAlgorithm
+	case len(hash) > 0 && hash[0] >= '0' && hash[0] <= '9' && strings.Count(hash, "$") == 4:
+		return ScryptAlgorithm
+	default:
+		return ""
+	}
+}
+
+// ErrUnknownHashAlgorithm is returned by MultiPasswordHandler if the
+// algorithm of a hash is not known.
+//
+// New in version v0.6
+var ErrUnknownHashAlgorithm = errors.New("Unknown password hash algorithm.")
+
+// MultiPasswordHandler is a PasswordHandler that creates new hashes with
+// the Preferred handler but is able to check passwords for hashes of all
+// algorithms that are known to HashAlgorithm.
+// This way you can change the cost of bcrypt or switch to a different
+// algorithm: Old hashes are still valid and NeedsRehash reports that they
+// should be replaced, the user handlers do this automatically in Validate.
+//
+// Note that PasswordHashLength returns the length of the Preferred handler,
+// the password column must be large enough for all hashes. So you should use
+// variable-length password columns (for example MySQLVarLengthUserQueries),
+// MaxPasswordHashLength returns DefaultMaxPWLength.
+//
+// New in version v0.6
+type MultiPasswordHandler struct {
+	// Preferred is used to create new hashes.
+	Preferred PasswordHandler
+
+	// Verifiers maps the names returned by HashAlgorithm to the handler that
+	// is used to check passwords. The parameters are stored in the hash, so
+	// the parameters of these handlers don't matter.
+	Verifiers map[string]PasswordHandler
+}
+
+// NewMultiPasswordHandler returns a new MultiPasswordHandler with verifiers
+// for bcrypt, scrypt and Argon2id.
+//
+// New in version v0.6
+func NewMultiPasswordHandler(preferred PasswordHandler) *MultiPasswordHandler {
+	verifiers := map[string]PasswordHandler{
+		BcryptAlgorithm:   NewBcryptHandler(-1),
+		ScryptAlgorithm:   NewScryptHandler(nil),
+		Argon2idAlgorithm: NewArgon2idHandler(nil),
+	}
+	return &MultiPasswordHandler{Preferred: preferred, Verifiers: verifiers}
+}
+
+// GenerateHash generates the password hash using the Preferred handler.
+func (handler *MultiPasswordHandler) GenerateHash(password []byte) ([]byte, error) {
+	return handler.Preferred.GenerateHash(password)
+}
+
+// CheckPassword checks the password with the handler for the algorithm
+// of hashedPW.
+func (handler *MultiPasswordHandler) CheckPassword(hashedPW, password []byte) (bool, error) {
+	// CHAR columns may pad shorter hashes with spaces
+	hashedPW = bytes.TrimRight(hashedPW, " ")
+	verifier, ok := handler.Verifiers[HashAlgorithm(hashedPW)]
+	if !ok {
+		return false, ErrUnknownHashAlgorithm
+	}
+	return verifier.CheckPassword(hashedPW, password)
+}
+
+// PasswordHashLength returns the length of the Preferred handler.
+func (handler *MultiPasswordHandler) PasswordHashLength() int {
+	return handler.Preferred.PasswordHashLength()
+}
+
+// MaxPasswordHashLength returns the maximum of DefaultMaxPWLength and the
+// max length of the Preferred handler. Old hashes may have been created with
+// arbitrary parameters, so it's not possible to compute a meaningful maximum.
+func (handler *MultiPasswordHandler) MaxPasswordHashLength() int {
+	res := MaxPasswordHashLength(handler.Preferred)
+	if res <= 0 {
+		return res
+	}
+	if res < DefaultMaxPWLength {
+		res = DefaultMaxPWLength
+	}
+	return res
+}
+
+// NeedsRehash returns true if the Preferred handler reports that the hash
+// needs a rehash. All handlers in this package report this for hashes of
+// other algorithms.
+func (handler *MultiPasswordHandler) NeedsRehash(hashedPW []byte) bool {
+	return NeedsRehash(handler.Preferred, bytes.TrimRight(hashedPW, " "))
+}
+
 // ErrUserNotFound is an error that is used in the Validate
 // function to signal that the user with the given username
 // was not found.
 var ErrUserNotFound = errors.New("User not found.")
 
+// ErrUserInactive is an error that is used to signal that a user exists but
+// is not active (see BaseUserInformation.IsActive).
+//
+// New in version v0.6
+var ErrUserInactive = errors.New("User is not active.")
+
+// ErrUserNameInUse is an error that is used to signal that a user name is
+// already in use, for example by RenameUser.
+//
+// New in version v0.6
+var ErrUserNameInUse = errors.New("Username already in use.")
+
+// ErrEmailNotVerified is an error that is used to signal that the email
+// address of a user is not verified (see BaseUserInformation.EmailVerified)
+// and the handler requires a verified address (for example
+// SQLUserHandler.RequireVerifiedEmail).
+//
+// New in version v0.6
+var ErrEmailNotVerified = errors.New("Email address is not verified.")
+
+// ErrEmailChanged is an error that is returned by UserHandler.VerifyEmail if
+// the email address of the user is not the address that should be verified.
+//
+// New in version v0.6
+var ErrEmailChanged = errors.New("The email address of the user has changed.")
+
+// UserInfoUpdate describes a partial update of the information in the
+// default scheme, see UserHandler.UpdateUserInfo. Only the fields that are
+// not nil are updated. If the email address changes it is not verified any
+// more.
+//
+// New in version v0.6
+type UserInfoUpdate struct {
+	FirstName, LastName, Email *string
+}
+
 // DefaultUserInformation is used to wrap the the information for
 // a user in the default scheme.
+// EmailVerified is the time the email address was verified, it is the zero
+// time if the address is not verified (new in version v0.6).
 //
 // New in version v0.5
 type BaseUserInformation struct {
@@ -187,6 +570,130 @@ type BaseUserInformation struct {
 	UserName, FirstName, LastName, Email string
 	LastLogin                            time.Time
 	IsActive                             bool
+	EmailVerified                        time.Time
+}
+
+// ErrInvalidPageCursor is returned by ListUsersPage if the cursor was not
+// returned by a previous call.
+//
+// New in version v0.6
+var ErrInvalidPageCursor = errors.New("Invalid page cursor.")
+
+// DefaultUserPageLimit is the number of users returned by ListUsersPage if
+// the limit is <= 0.
+//
+// New in version v0.6
+const DefaultUserPageLimit = 50
+
+// MaxUserPageLimit is the maximal number of users returned by ListUsersPage,
+// larger limits are reduced to this value.
+//
+// New in version v0.6
+const MaxUserPageLimit = 1000
+
+// UserSortField is the field the users are sorted by in ListUsersPage.
+// The order of users with the same last login depends on the handler, but
+// it is always the same.
+//
+// New in version v0.6
+type UserSortField int
+
+const (
+	SortUsersByID UserSortField = iota
+	SortUsersByName
+	SortUsersByLastLogin
+)
+
+// UserSort describes the order of the users in ListUsersPage.
+//
+// New in version v0.6
+type UserSort struct {
+	Field      UserSortField
+	Descending bool
+}
+
+// UserFilter describes the users returned by ListUsersPage, a user must
+// match all conditions that are set.
+// Active is nil if both active and inactive users should be returned.
+// UserNamePrefix and EmailPrefix are ignored if they're empty.
+// LastLoginFrom (inclusive) and LastLoginTo (exclusive) limit the last login
+// of the user, they're ignored if they're the zero time.
+// Note that the SQL handler uses LIKE for the prefixes, so whether they're
+// case sensitive depends on your database.
+//
+// New in version v0.6
+type UserFilter struct {
+	Active                      *bool
+	UserNamePrefix, EmailPrefix string
+	LastLoginFrom, LastLoginTo  time.Time
+}
+
+// Matches returns true if the user matches all conditions of the filter.
+// A nil filter matches all users.
+func (filter *UserFilter) Matches(user *BaseUserInformation) bool {
+	switch {
+	case filter == nil:
+		return true
+	case filter.Active != nil && *filter.Active != user.IsActive:
+		return false
+	case !strings.HasPrefix(user.UserName, filter.UserNamePrefix):
+		return false
+	case !strings.HasPrefix(user.Email, filter.EmailPrefix):
+		return false
+	case !filter.LastLoginFrom.IsZero() && user.LastLogin.Before(filter.LastLoginFrom):
+		return false
+	case !filter.LastLoginTo.IsZero() && !user.LastLogin.Before(filter.LastLoginTo):
+		return false
+	default:
+		return true
+	}
+}
+
+// UserPage is a page of users returned by ListUsersPage.
+// Total is the number of all users that match the filter and NextCursor is
+// the cursor to get the next page, it is empty if this is the last page.
+//
+// New in version v0.6
+type UserPage struct {
+	Users      []*BaseUserInformation
+	Total      int64
+	NextCursor string
+}
+
+// parsePageCursor returns the offset encoded in a cursor returned by
+// ListUsersPage, the empty cursor is the first page.
+func parsePageCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, ErrInvalidPageCursor
+	}
+	return offset, nil
+}
+
+// pageLimit returns the number of users ListUsersPage returns for the given
+// limit: DefaultUserPageLimit if limit <= 0 and at most MaxUserPageLimit.
+func pageLimit(limit int) int {
+	switch {
+	case limit <= 0:
+		return DefaultUserPageLimit
+	case limit > MaxUserPageLimit:
+		return MaxUserPageLimit
+	default:
+		return limit
+	}
+}
+
+// newUserPage returns a page with the users that start at offset, the
+// cursor is set if there are more users.
+func newUserPage(users []*BaseUserInformation, total, offset int64) *UserPage {
+	res := &UserPage{Users: users, Total: total}
+	if next := offset + int64(len(users)); next < total {
+		res.NextCursor = strconv.FormatInt(next, 10)
+	}
+	return res
 }
 
 // UserHandler is an interface to deal with the management of
@@ -220,9 +727,20 @@ type UserHandler interface {
 	// the returned user id:
 	// On failure it returns NoUserID and on success the id of the user with
 	// username.
+	// On success the handlers in this package store a new hash of the
+	// password if the password handler reports that the hash needs a rehash,
+	// see RehashChecker.
+	// Since version v0.6 it returns NoUserID and ErrUserInactive if the
+	// password is correct but the user is not active, and the last login of
+	// the user is updated on success. Handlers can also be configured to
+	// return NoUserID and ErrEmailNotVerified if the email address of the
+	// user is not verified (for example SQLUserHandler.RequireVerifiedEmail).
 	Validate(userName string, CleartextPwCheck []byte) (uint64, error)
 
 	// UpdatePassword updates the password for a user.
+	// The handlers in this package check the password with a PasswordPolicy
+	// (if set) in Insert and UpdatePassword and return a *PolicyError if
+	// the password is not allowed.
 	UpdatePassword(username string, plainPW []byte) error
 
 	// ListUsers returns all users currently present in the storage (by id).
@@ -256,4 +774,114 @@ type UserHandler interface {
 	//
 	// New in version v0.5
 	GetUserBaseInfo(userName string) (*BaseUserInformation, error)
+
+	// SetActive activates or deactivates the user with the given username.
+	// Users that are not active can't log in, see Validate.
+	//
+	// New in version v0.6
+	SetActive(userName string, active bool) error
+
+	// SetEmailVerified marks the email address of the user as verified (now)
+	// or not verified, see EmailVerificationManager.
+	// Returns ErrUserNotFound if the user doesn't exist.
+	//
+	// New in version v0.6
+	SetEmailVerified(userName string, verified bool) error
+
+	// VerifyEmail marks the email address of the user as verified (now) if
+	// the address of the user is still email. The check and the update
+	// happen atomically, so an address that changes in between is never
+	// marked as verified.
+	// Returns ErrUserNotFound if the user doesn't exist and ErrEmailChanged
+	// if the user has a different address.
+	//
+	// New in version v0.6
+	VerifyEmail(userName, email string) error
+
+	// UpdateUserInfo updates the first name, last name and email of a user,
+	// fields of the update that are nil are not changed. If the email address
+	// changes it is not verified any more.
+	// Returns ErrUserNotFound if the user doesn't exist.
+	//
+	// New in version v0.6
+	UpdateUserInfo(userName string, update *UserInfoUpdate) error
+
+	// RenameUser changes the username of a user, the id of the user doesn't
+	// change (so the sessions of the user are still valid).
+	// Returns ErrUserNotFound if the user doesn't exist and
+	// ErrUserNameInUse if newName is already in use.
+	//
+	// New in version v0.6
+	RenameUser(oldName, newName string) error
+
+	// ListUsersPage returns at most limit users (DefaultUserPageLimit if
+	// limit <= 0, at most MaxUserPageLimit) that match filter (nil for all users) in the given order.
+	// cursor is the empty string for the first page and UserPage.NextCursor
+	// for the following pages. Returns ErrInvalidPageCursor if the cursor is
+	// not valid.
+	// The cursor is the offset in the result, so pages may overlap or miss
+	// users if users are inserted or deleted in between.
+	//
+	// New in version v0.6
+	ListUsersPage(filter *UserFilter, sort UserSort, limit int, cursor string) (*UserPage, error)
+}
+
+// UserHandlerContext is a UserHandler that also provides variants of all
+// methods that accept a context.Context. The context should be passed on to
+// the underlying storage s.t. deadlines and cancellations of requests reach
+// the database.
+//
+// Handlers that implement this interface should implement the methods
+// without context by calling the context variant with context.Background().
+// Use AsUserHandlerContext to use a UserHandler that does not implement this
+// interface.
+//
+// New in version v0.6
+type UserHandlerContext interface {
+	UserHandler
+
+	// InitContext is Init with a context.
+	InitContext(ctx context.Context) error
+
+	// InsertContext is Insert with a context.
+	InsertContext(ctx context.Context, userName, firstName, lastName, email string, plainPW []byte) (uint64, error)
+
+	// ValidateContext is Validate with a context.
+	ValidateContext(ctx context.Context, userName string, cleartextPwCheck []byte) (uint64, error)
+
+	// UpdatePasswordContext is UpdatePassword with a context.
+	UpdatePasswordContext(ctx context.Context, username string, plainPW []byte) error
+
+	// ListUsersContext is ListUsers with a context.
+	ListUsersContext(ctx context.Context) (map[uint64]string, error)
+
+	// GetUserNameContext is GetUserName with a context.
+	GetUserNameContext(ctx context.Context, id uint64) (string, error)
+
+	// GetUserIDContext is GetUserID with a context.
+	GetUserIDContext(ctx context.Context, userName string) (uint64, error)
+
+	// DeleteUserContext is DeleteUser with a context.
+	DeleteUserContext(ctx context.Context, username string) error
+
+	// GetUserBaseInfoContext is GetUserBaseInfo with a context.
+	GetUserBaseInfoContext(ctx context.Context, userName string) (*BaseUserInformation, error)
+
+	// SetActiveContext is SetActive with a context.
+	SetActiveContext(ctx context.Context, userName string, active bool) error
+
+	// SetEmailVerifiedContext is SetEmailVerified with a context.
+	SetEmailVerifiedContext(ctx context.Context, userName string, verified bool) error
+
+	// VerifyEmailContext is VerifyEmail with a context.
+	VerifyEmailContext(ctx context.Context, userName, email string) error
+
+	// UpdateUserInfoContext is UpdateUserInfo with a context.
+	UpdateUserInfoContext(ctx context.Context, userName string, update *UserInfoUpdate) error
+
+	// RenameUserContext is RenameUser with a context.
+	RenameUserContext(ctx context.Context, oldName, newName string) error
+
+	// ListUsersPageContext is ListUsersPage with a context.
+	ListUsersPageContext(ctx context.Context, filter *UserFilter, sort UserSort, limit int, cursor string) (*UserPage, error)
 }
@@ -0,0 +1,128 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"testing"
+)
+
+// testArgon2Params are cheap parameters for the tests.
+var testArgon2Params = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1,
+	SaltLen: 8, KeyLen: 16}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	handler := NewArgon2idHandler(&testArgon2Params)
+	hash, err := handler.GenerateHash([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != handler.PasswordHashLength() {
+		t.Errorf("expected hash of length %d, got %d", handler.PasswordHashLength(), len(hash))
+	}
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *params != testArgon2Params {
+		t.Errorf("expected params %+v, got %+v", testArgon2Params, *params)
+	}
+	if len(salt) != 8 || len(key) != 16 {
+		t.Errorf("expected salt of length 8 and key of length 16, got %d and %d", len(salt), len(key))
+	}
+	tests := []struct {
+		password string
+		expected bool
+	}{
+		{"secret", true},
+		{"Secret", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		ok, err := handler.CheckPassword(hash, []byte(tc.password))
+		if err != nil {
+			t.Errorf("CheckPassword(%q) returned error %v", tc.password, err)
+		} else if ok != tc.expected {
+			t.Errorf("CheckPassword(%q): expected %v, got %v", tc.password, tc.expected, ok)
+		}
+	}
+	if handler.NeedsRehash(hash) {
+		t.Error("hash with the same parameters needs a rehash")
+	}
+	other := NewArgon2idHandler(&DefaultArgon2Params)
+	if !other.NeedsRehash(hash) {
+		t.Error("hash with other parameters doesn't need a rehash")
+	}
+}
+
+func TestDecodeArgon2idHashMalformed(t *testing.T) {
+	tests := []struct {
+		hash     string
+		expected error
+	}{
+		{"", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ", ErrInvalidArgon2Hash},
+		{"argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+		{"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+		{"$argon2id$v=x$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+		{"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", ErrIncompatibleArgon2Version},
+		{"$argon2id$v=19$m=64,t=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=1,p=1$c2FsdH!hbHQ$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5==", ErrInvalidArgon2Hash},
+		// zero parameters make argon2 panic
+		{"$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+		// an empty key would match every password
+		{"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$", ErrInvalidArgon2Hash},
+		{"$argon2id$v=19$m=64,t=1,p=1$$a2V5a2V5a2V5a2V5", ErrInvalidArgon2Hash},
+	}
+	for _, tc := range tests {
+		if _, _, _, err := decodeArgon2idHash([]byte(tc.hash)); err != tc.expected {
+			t.Errorf("decodeArgon2idHash(%q): expected error %v, got %v", tc.hash, tc.expected, err)
+		}
+	}
+}
+
+func TestHashAlgorithm(t *testing.T) {
+	tests := []struct {
+		hash     string
+		expected string
+	}{
+		{"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", BcryptAlgorithm},
+		{"$2b$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", BcryptAlgorithm},
+		{"$2x$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", BcryptAlgorithm},
+		{"$2y$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", BcryptAlgorithm},
+		{"$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$a2V5", Argon2idAlgorithm},
+		{"16384$8$1$c2FsdA==$a2V5", ScryptAlgorithm},
+		{"16384$8$1$c2FsdA==", ""},
+		{"$argon2i$v=19$m=65536,t=3,p=2$c2FsdA$a2V5", ""},
+		{"$pepper$1$$2a$10$N9qo8uLOickgx2ZMRZoMye", ""},
+		{"plain", ""},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		if got := HashAlgorithm([]byte(tc.hash)); got != tc.expected {
+			t.Errorf("HashAlgorithm(%q): expected %q, got %q", tc.hash, tc.expected, got)
+		}
+	}
+}
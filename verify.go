@@ -0,0 +1,337 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ErrNoEmail is returned by EmailVerificationManager if the user has no
+// email address.
+//
+// New in version v0.6
+var ErrNoEmail = errors.New("User has no email address.")
+
+// Mail is an email sent by a MailSender. If From is empty the MailSender
+// uses its default sender. Body is plain text.
+//
+// New in version v0.6
+type Mail struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+}
+
+// MailSender sends emails, for example the mails of
+// EmailVerificationManager.
+// There is an implementation that uses SMTP (SMTPMailSender) and one that
+// keeps the mails in memory for tests (InMemoryMailSender).
+//
+// New in version v0.6
+type MailSender interface {
+	SendMail(ctx context.Context, mail *Mail) error
+}
+
+// SMTPMailSender is a MailSender that sends mails with net/smtp.
+// Addr is the address of the server (for example "smtp.example.com:587"),
+// Auth may be nil. From is used if the From of a mail is empty.
+//
+// New in version v0.6
+type SMTPMailSender struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// NewSMTPMailSender returns a new SMTPMailSender.
+//
+// New in version v0.6
+func NewSMTPMailSender(addr string, auth smtp.Auth, from string) *SMTPMailSender {
+	return &SMTPMailSender{Addr: addr, Auth: auth, From: from}
+}
+
+// SendMail sends the mail. net/smtp doesn't support contexts, so the
+// context is only checked before the mail is sent.
+func (sender *SMTPMailSender) SendMail(ctx context.Context, m *Mail) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	from := m.From
+	if from == "" {
+		from = sender.From
+	}
+	msg, fromAddr, recipients, err := formatMail(from, m, CurrentTime())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(sender.Addr, sender.Auth, fromAddr, recipients, msg)
+}
+
+// formatMail returns the message (headers and quoted-printable body), the
+// address of the sender and the addresses of the recipients. Addresses
+// are parsed with net/mail, so they can't be used to inject headers.
+func formatMail(from string, m *Mail, date time.Time) ([]byte, string, []string, error) {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if len(m.To) == 0 {
+		return nil, "", nil, errors.New("Mail has no recipients.")
+	}
+	to := make([]string, len(m.To))
+	recipients := make([]string, len(m.To))
+	for i, rawTo := range m.To {
+		toAddr, toErr := mail.ParseAddress(rawTo)
+		if toErr != nil {
+			return nil, "", nil, toErr
+		}
+		to[i], recipients[i] = toAddr.String(), toAddr.Address
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", fromAddr.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	// non-ASCII and control characters (CR and LF) are encoded
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	body := strings.Replace(m.Body, "\r\n", "\n", -1)
+	if _, err := w.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return nil, "", nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", nil, err
+	}
+	return buf.Bytes(), fromAddr.Address, recipients, nil
+}
+
+// InMemoryMailSender is a MailSender that doesn't send the mails but keeps
+// them in memory, it is useful for tests.
+//
+// New in version v0.6
+type InMemoryMailSender struct {
+	mutex sync.Mutex
+	mails []*Mail
+}
+
+// NewInMemoryMailSender returns a new sender without mails.
+//
+// New in version v0.6
+func NewInMemoryMailSender() *InMemoryMailSender {
+	return &InMemoryMailSender{}
+}
+
+// SendMail stores a copy of the mail.
+func (sender *InMemoryMailSender) SendMail(ctx context.Context, m *Mail) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cpy := *m
+	cpy.To = append([]string(nil), m.To...)
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	sender.mails = append(sender.mails, &cpy)
+	return nil
+}
+
+// Mails returns all mails sent so far.
+func (sender *InMemoryMailSender) Mails() []*Mail {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	return append([]*Mail(nil), sender.mails...)
+}
+
+// Reset removes all mails.
+func (sender *InMemoryMailSender) Reset() {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	sender.mails = nil
+}
+
+// DefaultVerificationDuration is the default time an email verification
+// token is valid.
+//
+// New in version v0.6
+const DefaultVerificationDuration = 24 * time.Hour
+
+// DefaultVerificationSubject is the default subject of verification mails.
+//
+// New in version v0.6
+const DefaultVerificationSubject = "Please verify your email address"
+
+// DefaultVerificationTemplate is the default template of the body of
+// verification mails, it is executed with a *VerificationMailData.
+//
+// New in version v0.6
+var DefaultVerificationTemplate = template.Must(template.New("verification").Parse(`Hello {{.User.FirstName}},
+
+please verify your email address by opening the following link:
+
+{{.Link}}
+
+The link is valid until {{.ValidUntil.Format "2006-01-02 15:04 MST"}}.
+If you didn't request this mail you can ignore it.
+`))
+
+// VerificationMailData is the data the template of verification mails is
+// executed with. Link is the VerifyURL of the EmailVerificationManager with
+// the token.
+//
+// New in version v0.6
+type VerificationMailData struct {
+	User       *BaseUserInformation
+	Link       string
+	Token      string
+	ValidUntil time.Time
+}
+
+// EmailVerificationManager verifies the email addresses of users.
+//
+// SendVerification creates a token and sends a mail to the user with a
+// link: The token is added to VerifyURL as query parameter "token". When
+// the user opens the link call Verify with the token, it marks the address
+// as verified (see UserHandler.VerifyEmail). The token is stored hashed
+// in Tokens together with the address, so it can only be used once and
+// only for the address it was sent to.
+//
+// To refuse logins of users with addresses that are not verified set
+// RequireVerifiedEmail of the user handler.
+//
+// New in version v0.6
+type EmailVerificationManager struct {
+	Tokens        TokenStore
+	Users         UserHandlerContext
+	Mailer        MailSender
+	VerifyURL     string
+	ValidDuration time.Duration
+
+	// Subject is the subject of the mail and Template the template of the
+	// body, see VerificationMailData.
+	Subject  string
+	Template *template.Template
+
+	// TokenBytes is the number of random bytes of a token, see
+	// NewOneTimeToken.
+	TokenBytes int
+}
+
+// NewEmailVerificationManager returns a new manager with tokens valid for
+// DefaultVerificationDuration and the default subject and template.
+//
+// New in version v0.6
+func NewEmailVerificationManager(tokens TokenStore, users UserHandler, mailer MailSender, verifyURL string) *EmailVerificationManager {
+	return &EmailVerificationManager{
+		Tokens:        tokens,
+		Users:         AsUserHandlerContext(users),
+		Mailer:        mailer,
+		VerifyURL:     verifyURL,
+		ValidDuration: DefaultVerificationDuration,
+		Subject:       DefaultVerificationSubject,
+		Template:      DefaultVerificationTemplate,
+		TokenBytes:    DefaultTokenBytes,
+	}
+}
+
+// SendVerification creates a new token for the user and sends the mail, all
+// previous tokens of the user are not valid any more. If the address is
+// already verified no mail is sent. It returns ErrUserNotFound if the user
+// doesn't exist and ErrNoEmail if the user has no email address.
+func (m *EmailVerificationManager) SendVerification(ctx context.Context, userName string) error {
+	user, err := m.Users.GetUserBaseInfoContext(ctx, userName)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+	if !user.EmailVerified.IsZero() {
+		return nil
+	}
+	token, err := NewOneTimeToken(m.TokenBytes)
+	if err != nil {
+		return err
+	}
+	link, err := tokenURL(m.VerifyURL, token)
+	if err != nil {
+		return err
+	}
+	validUntil := CurrentTime().Add(m.ValidDuration)
+	var body bytes.Buffer
+	data := &VerificationMailData{User: user, Link: link, Token: token, ValidUntil: validUntil}
+	if err := m.Template.Execute(&body, data); err != nil {
+		return err
+	}
+	tokenData := &TokenData{UserID: user.ID, ValidUntil: validUntil, Data: user.Email}
+	if err := m.Tokens.ReplaceTokensForUser(ctx, HashToken(token), tokenData); err != nil {
+		return err
+	}
+	return m.Mailer.SendMail(ctx, &Mail{To: []string{user.Email}, Subject: m.Subject, Body: body.String()})
+}
+
+// Verify consumes the token and marks the email address of the user as
+// verified, it returns the id of the user. It returns ErrInvalidToken if
+// the token is invalid, expired, was already used or the address of the
+// user changed after the mail was sent.
+func (m *EmailVerificationManager) Verify(ctx context.Context, token string) (uint64, error) {
+	data, err := m.Tokens.ConsumeToken(ctx, HashToken(token))
+	if err != nil {
+		return NoUserID, err
+	}
+	if KeyInvalid(CurrentTime(), data.ValidUntil) {
+		return NoUserID, ErrInvalidToken
+	}
+	userName, err := m.Users.GetUserNameContext(ctx, data.UserID)
+	if err != nil {
+		return NoUserID, err
+	}
+	// the address is only verified if it didn't change after the mail was
+	// sent
+	if err := m.Users.VerifyEmailContext(ctx, userName, data.Data); err == ErrEmailChanged {
+		return NoUserID, ErrInvalidToken
+	} else if err != nil {
+		return NoUserID, err
+	}
+	if err := m.Tokens.DeleteTokensForUser(ctx, data.UserID); err != nil {
+		return data.UserID, err
+	}
+	return data.UserID, nil
+}
+
+// DeleteExpiredTokens removes all expired tokens from Tokens.
+func (m *EmailVerificationManager) DeleteExpiredTokens(ctx context.Context) (int64, error) {
+	return m.Tokens.DeleteExpiredTokens(ctx, CurrentTime())
+}